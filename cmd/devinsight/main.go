@@ -0,0 +1,311 @@
+// devinsight は Lambda と同じ処理をローカルで実行するコマンド
+//
+//	devinsight report [-post] [-period weekly] [-guild ID]
+//	devinsight roles [-apply] [-guild ID]
+//	devinsight combined [-apply] [-consumers ranking,roles,dm,export] [-export 保存先] [-period weekly] [-guild ID]
+//	devinsight purge [-apply] [-from 日付] [-to 日付] [-discord-id ID] [-language 言語] [-event ファイル]
+//	devinsight export -discord-id ID [-format json|csv] [-out ディレクトリ]
+//	devinsight runs [-action ranking|roles|combined] [-limit 件数] [-json]
+//	devinsight invoke -event ファイル
+//
+// 投稿・変更・削除はフラグを指定した場合のみ行い、指定しない場合は結果を標準出力に表示する。
+// -endpoint を指定すると DynamoDB Local などのテーブルを使用する。
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	"github.com/kkaiki/DevInsight/internal/dispatch"
+	"github.com/kkaiki/DevInsight/internal/insight"
+	"github.com/kkaiki/DevInsight/internal/pipeline"
+	"github.com/kkaiki/DevInsight/internal/purge"
+	"github.com/kkaiki/DevInsight/internal/ranking"
+	"github.com/kkaiki/DevInsight/internal/roles"
+)
+
+const usage = `使い方: devinsight <コマンド> [フラグ]
+
+コマンド:
+  report    ランキングを集計して表示する（-post で Discord に投稿）
+  roles     付与する言語ロールを表示する（-apply で付与）
+  combined  1回の集計でランキング・ロール・DM・エクスポートをまとめて実行する（-apply で投稿・付与・送信）
+  purge     削除の対象件数を表示する（-apply で削除）
+  export    ユーザーのハートビートをファイルに書き出す
+  runs      ランキング・ロール付与の実行履歴を新しい順に表示する
+  invoke    Lambda と同じイベントで実行する（投稿・削除を行います）
+
+各コマンドのフラグは devinsight <コマンド> -h で確認できます。
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	command, args := os.Args[1], os.Args[2:]
+	// ログに実行IDを付ける（invoke は Lambda と同じく dispatch で付け直す）
+	ctx := insight.StartRun(context.Background(), command)
+
+	var err error
+	switch command {
+	case "report":
+		err = runReport(ctx, args)
+	case "roles":
+		err = runRoles(ctx, args)
+	case "combined":
+		err = runCombined(ctx, args)
+	case "purge":
+		err = runPurge(ctx, args)
+	case "export":
+		err = runExport(ctx, args)
+	case "runs":
+		err = runRuns(ctx, args)
+	case "invoke":
+		err = runInvoke(args)
+	default:
+		fmt.Fprintf(os.Stderr, "不明なコマンドです: %s\n\n%s", command, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		slog.Error("実行に失敗しました", "kind", insight.KindOf(err), "error", err)
+		os.Exit(1)
+	}
+}
+
+// 接続先のフラグ
+type storeFlags struct {
+	region   *string
+	endpoint *string
+}
+
+func newFlagSet(name string) (*flag.FlagSet, storeFlags) {
+	fs := flag.NewFlagSet("devinsight "+name, flag.ExitOnError)
+	return fs, storeFlags{
+		region:   fs.String("region", "ap-northeast-1", "AWS のリージョン"),
+		endpoint: fs.String("endpoint", "", "DynamoDB のエンドポイント（例: DynamoDB Local の http://localhost:8000）"),
+	}
+}
+
+func (s storeFlags) config() *aws.Config {
+	config := &aws.Config{Region: aws.String(*s.region)}
+	if *s.endpoint != "" {
+		config.Endpoint = aws.String(*s.endpoint)
+	}
+	return config
+}
+
+func runReport(ctx context.Context, args []string) error {
+	fs, store := newFlagSet("report")
+	post := fs.Bool("post", false, "Discord に投稿する")
+	period := fs.String("period", "", `"weekly" の場合は週間の最終ランキングとして扱う`)
+	guildID := fs.String("guild", "", "指定したサーバーのみを対象にする")
+	fs.Parse(args)
+
+	insight.Configure(store.config())
+	return ranking.Run(ctx, ranking.RankingEvent{Period: *period}, ranking.Options{
+		Post:    *post,
+		GuildID: *guildID,
+		Output:  os.Stdout,
+	})
+}
+
+func runRoles(ctx context.Context, args []string) error {
+	fs, store := newFlagSet("roles")
+	apply := fs.Bool("apply", false, "ロールを付与する")
+	guildID := fs.String("guild", "", "指定したサーバーのみを対象にする")
+	fs.Parse(args)
+
+	insight.Configure(store.config())
+	return roles.Run(ctx, roles.Options{
+		Apply:   *apply,
+		GuildID: *guildID,
+		Output:  os.Stdout,
+	})
+}
+
+func runCombined(ctx context.Context, args []string) error {
+	fs, store := newFlagSet("combined")
+	apply := fs.Bool("apply", false, "投稿・ロールの付与・DM の送信を行う")
+	consumers := fs.String("consumers", "", "実行する処理をカンマ区切りで指定（ranking, roles, dm, export。省略時は ranking,roles）")
+	var event pipeline.Event
+	fs.StringVar(&event.Export, "export", "", "export の保存先（ローカルディレクトリまたは s3://bucket/prefix。-apply がなくても書き出す）")
+	fs.StringVar(&event.Period, "period", "", `"weekly" の場合は週間の最終ランキングとして扱う`)
+	guildID := fs.String("guild", "", "指定したサーバーのみを対象にする")
+	fs.Parse(args)
+	if *consumers != "" {
+		event.Consumers = strings.Split(*consumers, ",")
+	}
+
+	insight.Configure(store.config())
+	result, err := pipeline.Run(ctx, event, pipeline.Options{
+		Apply:   *apply,
+		GuildID: *guildID,
+		Output:  os.Stdout,
+	})
+	if result != nil {
+		printJSON(result)
+	}
+	return err
+}
+
+func runPurge(ctx context.Context, args []string) error {
+	fs, store := newFlagSet("purge")
+	apply := fs.Bool("apply", false, "削除する（指定しない場合は dry-run）")
+	eventFile := fs.String("event", "", "Lambda と同じ形式のイベントの JSON ファイル（復元・保持期間の適用など）")
+	var scope purge.PurgeScope
+	fs.StringVar(&scope.From, "from", "", "この日時以降（2006-01-02 または RFC3339）")
+	fs.StringVar(&scope.To, "to", "", "この日時より前（2006-01-02 または RFC3339）")
+	fs.StringVar(&scope.DiscordID, "discord-id", "", "対象のユーザー")
+	fs.StringVar(&scope.Language, "language", "", "対象の言語")
+	archive := fs.String("archive", "", "削除前のアーカイブの保存先（ローカルディレクトリまたは s3://bucket/prefix）")
+	confirm := fs.String("confirm", "", "全件削除の確認用の値")
+	fs.Parse(args)
+
+	event := purge.PurgeEvent{
+		Scopes:  []purge.PurgeScope{scope},
+		Archive: *archive,
+		Confirm: *confirm,
+	}
+	if *eventFile != "" {
+		data, err := os.ReadFile(*eventFile)
+		if err != nil {
+			return err
+		}
+		event = purge.PurgeEvent{}
+		if err := json.Unmarshal(data, &event); err != nil {
+			return fmt.Errorf("イベントの形式が不正です: %v", err)
+		}
+	}
+	// dry-run できるのはスコープの削除のみ
+	if !*apply && (event.Restore != "" || event.Retention != nil || event.Export != nil || event.Erase != nil || event.RegisterCommands) {
+		return fmt.Errorf("このイベントは dry-run に対応していないため、実行するには -apply を指定してください")
+	}
+	event.DryRun = event.DryRun || !*apply
+
+	insight.Configure(store.config())
+	result, err := purge.HandleRequest(ctx, event)
+	if result != nil {
+		printJSON(result)
+	}
+	return err
+}
+
+func runExport(ctx context.Context, args []string) error {
+	fs, store := newFlagSet("export")
+	request := purge.UserDataRequest{RequestedBy: os.Getenv("USER")}
+	fs.StringVar(&request.DiscordID, "discord-id", "", "エクスポートするユーザー")
+	fs.StringVar(&request.Format, "format", "json", "ファイルの形式（json または csv）")
+	fs.StringVar(&request.RequestedBy, "requested-by", request.RequestedBy, "監査記録に残す依頼者")
+	out := fs.String("out", ".", "書き出し先のディレクトリまたは s3://bucket/prefix")
+	fs.Parse(args)
+
+	insight.Configure(store.config())
+	result, err := purge.HandleRequest(ctx, purge.PurgeEvent{
+		Export:  &request,
+		Archive: *out,
+	})
+	if result != nil {
+		printJSON(result)
+	}
+	return err
+}
+
+func runRuns(ctx context.Context, args []string) error {
+	fs, store := newFlagSet("runs")
+	action := fs.String("action", "", "指定した処理の実行履歴のみを表示する（ranking, roles, combined）")
+	limit := fs.Int("limit", 20, "表示する件数")
+	asJSON := fs.Bool("json", false, "JSON で表示する")
+	fs.Parse(args)
+
+	insight.Configure(store.config())
+	runs, err := insight.ListRuns(ctx, insight.DB, *action, 0)
+	if err != nil {
+		return err
+	}
+	// 前回との比較に使うため、表示しない古い実行履歴も残しておく
+	shown := runs
+	if *limit > 0 && len(shown) > *limit {
+		shown = shown[:*limit]
+	}
+	if *asJSON {
+		printJSON(shown)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STARTED\tACTION\tPERIOD\tUSERS\tTOTAL\tVS PREV\tMESSAGES\tROLES\tFAILURES\tDURATION\tRUN ID")
+	for i, run := range shown {
+		// 同じ処理・期間の前回の実行と、集計した作業時間の合計を比べる
+		change := "-"
+		if previous := insight.PreviousRun(runs, i); previous != nil && run.Error == "" {
+			change = formatMinutes(run.TotalMinutes - previous.TotalMinutes)
+			if run.TotalMinutes >= previous.TotalMinutes {
+				change = "+" + change
+			}
+		}
+		assigned := 0
+		for _, role := range run.Roles {
+			assigned += role.Assigned
+		}
+		failures := fmt.Sprint(run.TotalFailures())
+		if run.Error != "" {
+			failures += " (error)"
+		}
+		period := run.Period
+		if period == "" {
+			period = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%d\t%d\t%s\t%s\t%s\n",
+			run.StartedAt, run.Action, period, run.Users, formatMinutes(run.TotalMinutes), change,
+			len(run.Messages), assigned, failures, time.Duration(run.DurationMs)*time.Millisecond, run.RunID)
+	}
+	return w.Flush()
+}
+
+// 分を "12h05m" の形式にする
+func formatMinutes(minutes int64) string {
+	sign := ""
+	if minutes < 0 {
+		sign, minutes = "-", -minutes
+	}
+	return fmt.Sprintf("%s%dh%02dm", sign, minutes/60, minutes%60)
+}
+
+func runInvoke(args []string) error {
+	fs, store := newFlagSet("invoke")
+	eventFile := fs.String("event", "", `イベントの JSON ファイル（例: {"action":"ranking","period":"weekly"}）`)
+	fs.Parse(args)
+	if *eventFile == "" {
+		return fmt.Errorf("-event を指定してください")
+	}
+	payload, err := os.ReadFile(*eventFile)
+	if err != nil {
+		return err
+	}
+
+	insight.Configure(store.config())
+	result, err := dispatch.Handle(context.Background(), payload)
+	if result != nil {
+		printJSON(result)
+	}
+	return err
+}
+
+func printJSON(v interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		slog.Error("結果の表示に失敗", "error", err)
+	}
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"github.com/aws/aws-lambda-go/lambda"
+
+	"github.com/kkaiki/DevInsight/internal/dispatch"
+)
+
+func main() {
+	lambda.Start(dispatch.Handle)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kkaiki/DevInsight/internal/insight"
+)
+
+const (
+	// 同じユーザー・同じファイルのハートビートをこの間隔以内なら重複として破棄する
+	defaultDedupIntervalSeconds = 30
+	// ユーザーごとに1分間に受け付けるハートビートの上限
+	defaultRateLimitPerMinute = 120
+	// この時間使われていない状態は削除する
+	guardStateTTL = 10 * time.Minute
+)
+
+// 重複排除とレート制限の状態（インスタンスごとにメモリ上で保持する）
+// インスタンス間で共有しないため、複数のインスタンスが動く場合はベストエフォートになる
+type ingestGuard struct {
+	mu            sync.Mutex
+	dedupInterval time.Duration
+	ratePerMinute int
+	lastSeen      map[string]time.Time
+	buckets       map[string]*tokenBucket
+	lastPrune     time.Time
+}
+
+// 1分あたり ratePerMinute 件まで補充されるトークンバケット
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+func newIngestGuard() *ingestGuard {
+	return &ingestGuard{
+		dedupInterval: time.Duration(insight.GetEnvInt("DEDUP_INTERVAL_SECONDS", defaultDedupIntervalSeconds, 0)) * time.Second,
+		ratePerMinute: insight.GetEnvInt("RATE_LIMIT_PER_MINUTE", defaultRateLimitPerMinute, 0),
+		lastSeen:      make(map[string]time.Time),
+		buckets:       make(map[string]*tokenBucket),
+	}
+}
+
+// ユーザーのレート制限の残りがあれば1件消費する
+func (g *ingestGuard) allow(discordID string, now time.Time) bool {
+	if g.ratePerMinute == 0 {
+		return true
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.prune(now)
+
+	limit := float64(g.ratePerMinute)
+	bucket, ok := g.buckets[discordID]
+	if !ok {
+		bucket = &tokenBucket{tokens: limit, updatedAt: now}
+		g.buckets[discordID] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.updatedAt).Minutes() * limit
+	if bucket.tokens > limit {
+		bucket.tokens = limit
+	}
+	bucket.updatedAt = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// 同じユーザー・同じファイル（ファイルがない場合は言語）の直前のハートビートとの間隔が
+// dedupInterval 未満なら重複とみなす。重複でなければ時刻を記録し、
+// 保存に失敗したときに記録を取り消す関数を返す
+func (g *ingestGuard) isDuplicate(heartbeat insight.InsightData, timestamp, now time.Time) (bool, func()) {
+	if g.dedupInterval == 0 {
+		return false, func() {}
+	}
+	entity := heartbeat.Entity
+	if entity == "" {
+		entity = heartbeat.Language
+	}
+	key := heartbeat.DiscordID + "\x00" + entity
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.prune(now)
+
+	previous, hadPrevious := g.lastSeen[key]
+	if hadPrevious {
+		diff := timestamp.Sub(previous)
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff < g.dedupInterval {
+			return true, nil
+		}
+	}
+	g.lastSeen[key] = timestamp
+	return false, func() { g.forget(key, timestamp, previous, hadPrevious) }
+}
+
+// isDuplicate の記録を取り消す。その後に別のハートビートが記録されていれば何もしない
+func (g *ingestGuard) forget(key string, timestamp, previous time.Time, hadPrevious bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if last, ok := g.lastSeen[key]; !ok || !last.Equal(timestamp) {
+		return
+	}
+	if hadPrevious {
+		g.lastSeen[key] = previous
+	} else {
+		delete(g.lastSeen, key)
+	}
+}
+
+// 古い状態を削除する（呼び出し元でロックを取得していること）
+func (g *ingestGuard) prune(now time.Time) {
+	if now.Sub(g.lastPrune) < guardStateTTL {
+		return
+	}
+	g.lastPrune = now
+	for key, last := range g.lastSeen {
+		if now.Sub(last) > guardStateTTL {
+			delete(g.lastSeen, key)
+		}
+	}
+	for key, bucket := range g.buckets {
+		if now.Sub(bucket.updatedAt) > guardStateTTL {
+			delete(g.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/kkaiki/DevInsight/internal/insight"
+)
+
+func newTestGuard(dedupInterval time.Duration, ratePerMinute int) *ingestGuard {
+	return &ingestGuard{
+		dedupInterval: dedupInterval,
+		ratePerMinute: ratePerMinute,
+		lastSeen:      make(map[string]time.Time),
+		buckets:       make(map[string]*tokenBucket),
+	}
+}
+
+func TestIngestGuardAllow(t *testing.T) {
+	// 送信した時刻（testNow からの経過時間）と Discord ID
+	type request struct {
+		at        time.Duration
+		discordID string
+		want      bool
+	}
+	tests := []struct {
+		name     string
+		rate     int
+		requests []request
+	}{
+		{
+			name: "up to the limit",
+			rate: 3,
+			requests: []request{
+				{0, "a", true},
+				{0, "a", true},
+				{0, "a", true},
+				{0, "a", false},
+			},
+		},
+		{
+			name: "per user",
+			rate: 1,
+			requests: []request{
+				{0, "a", true},
+				{0, "a", false},
+				{0, "b", true},
+			},
+		},
+		{
+			name: "refilled over time",
+			rate: 3,
+			requests: []request{
+				{0, "a", true},
+				{0, "a", true},
+				{0, "a", true},
+				{10 * time.Second, "a", false},
+				{20 * time.Second, "a", true},
+				{20 * time.Second, "a", false},
+			},
+		},
+		{
+			name: "refilled up to the limit",
+			rate: 2,
+			requests: []request{
+				{0, "a", true},
+				{time.Hour, "a", true},
+				{time.Hour, "a", true},
+				{time.Hour, "a", false},
+			},
+		},
+		{
+			name: "disabled",
+			rate: 0,
+			requests: []request{
+				{0, "a", true},
+				{0, "a", true},
+				{0, "a", true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			guard := newTestGuard(0, tt.rate)
+			for i, r := range tt.requests {
+				if got := guard.allow(r.discordID, testNow.Add(r.at)); got != r.want {
+					t.Errorf("requests[%d]: allow() = %v, want %v", i, got, r.want)
+				}
+			}
+		})
+	}
+}
+
+func TestIngestGuardIsDuplicate(t *testing.T) {
+	// ハートビートの時刻（testNow からの経過時間）とファイル
+	type heartbeat struct {
+		at       time.Duration
+		entity   string
+		language string
+		want     bool
+	}
+	tests := []struct {
+		name       string
+		interval   time.Duration
+		heartbeats []heartbeat
+	}{
+		{
+			name:     "within the interval",
+			interval: 30 * time.Second,
+			heartbeats: []heartbeat{
+				{0, "main.go", "go", false},
+				{10 * time.Second, "main.go", "go", true},
+				{29 * time.Second, "main.go", "go", true},
+			},
+		},
+		{
+			name:     "interval is from the last stored heartbeat",
+			interval: 30 * time.Second,
+			heartbeats: []heartbeat{
+				{0, "main.go", "go", false},
+				{20 * time.Second, "main.go", "go", true},
+				{30 * time.Second, "main.go", "go", false},
+				{50 * time.Second, "main.go", "go", true},
+			},
+		},
+		{
+			name:     "out of order",
+			interval: 30 * time.Second,
+			heartbeats: []heartbeat{
+				{time.Minute, "main.go", "go", false},
+				{40 * time.Second, "main.go", "go", true},
+				{0, "main.go", "go", false},
+			},
+		},
+		{
+			name:     "another file",
+			interval: 30 * time.Second,
+			heartbeats: []heartbeat{
+				{0, "main.go", "go", false},
+				{0, "util.go", "go", false},
+			},
+		},
+		{
+			name:     "language without a file",
+			interval: 30 * time.Second,
+			heartbeats: []heartbeat{
+				{0, "", "go", false},
+				{10 * time.Second, "", "go", true},
+				{10 * time.Second, "", "python", false},
+			},
+		},
+		{
+			name:     "disabled",
+			interval: 0,
+			heartbeats: []heartbeat{
+				{0, "main.go", "go", false},
+				{0, "main.go", "go", false},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			guard := newTestGuard(tt.interval, 0)
+			for i, h := range tt.heartbeats {
+				timestamp := testNow.Add(h.at)
+				data := insight.InsightData{DiscordID: testDiscordID, Entity: h.entity, Language: h.language}
+				if got, _ := guard.isDuplicate(data, timestamp, testNow); got != h.want {
+					t.Errorf("heartbeats[%d]: isDuplicate() = %v, want %v", i, got, h.want)
+				}
+			}
+		})
+	}
+}
+
+func TestIngestGuardUndo(t *testing.T) {
+	guard := newTestGuard(30*time.Second, 0)
+	data := insight.InsightData{DiscordID: testDiscordID, Entity: "main.go"}
+
+	guard.isDuplicate(data, testNow, testNow)
+	_, undo := guard.isDuplicate(data, testNow.Add(time.Minute), testNow)
+	undo()
+	// 取り消した後は前のハートビートとの間隔で判定する
+	if duplicate, _ := guard.isDuplicate(data, testNow.Add(10*time.Second), testNow); !duplicate {
+		t.Error("heartbeat within the interval of the previous one is not a duplicate")
+	}
+	if duplicate, _ := guard.isDuplicate(data, testNow.Add(70*time.Second), testNow); duplicate {
+		t.Error("heartbeat after undo is a duplicate of the undone one")
+	}
+
+	// 後から記録されたハートビートは取り消さない
+	_, undo = guard.isDuplicate(data, testNow.Add(5*time.Minute), testNow)
+	guard.isDuplicate(data, testNow.Add(6*time.Minute), testNow)
+	undo()
+	if duplicate, _ := guard.isDuplicate(data, testNow.Add(6*time.Minute+time.Second), testNow); !duplicate {
+		t.Error("undo removed a later heartbeat")
+	}
+}
+
+func TestIngestGuardPrune(t *testing.T) {
+	guard := newTestGuard(30*time.Second, 1)
+	data := insight.InsightData{DiscordID: testDiscordID, Entity: "main.go"}
+	guard.allow(testDiscordID, testNow)
+	guard.isDuplicate(data, testNow, testNow)
+
+	later := testNow.Add(guardStateTTL + time.Minute)
+	guard.allow("876543210987654321", later)
+	if len(guard.lastSeen) != 0 || len(guard.buckets) != 1 {
+		t.Errorf("lastSeen = %d, buckets = %d after the TTL, want 0 and 1", len(guard.lastSeen), len(guard.buckets))
+	}
+}
+
+func TestHandleHeartbeatsRateLimited(t *testing.T) {
+	t.Setenv("RATE_LIMIT_PER_MINUTE", "2")
+	s, _ := newTestServer(t)
+	body := "[" + heartbeatJSON(testNow.Add(-3*time.Minute), "") + "," + heartbeatJSON(testNow.Add(-2*time.Minute), "") + "," + heartbeatJSON(testNow.Add(-time.Minute), "") + "]"
+	w := serve(s, http.MethodPost, "/api/v1/heartbeats", testToken, body)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+
+	w = serve(s, http.MethodPost, "/api/v1/heartbeats", testToken, heartbeatJSON(testNow, ""))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusTooManyRequests, w.Body)
+	}
+	if w.Header().Get("Retry-After") != "60" {
+		t.Errorf("Retry-After = %q, want 60", w.Header().Get("Retry-After"))
+	}
+}
+
+func TestNewIngestGuardEnv(t *testing.T) {
+	tests := []struct {
+		dedup, rate   string
+		wantInterval  time.Duration
+		wantRateLimit int
+	}{
+		{"", "", defaultDedupIntervalSeconds * time.Second, defaultRateLimitPerMinute},
+		{"0", "0", 0, 0},
+		{"5", "10", 5 * time.Second, 10},
+		{"-1", "many", defaultDedupIntervalSeconds * time.Second, defaultRateLimitPerMinute},
+	}
+	for _, tt := range tests {
+		t.Setenv("DEDUP_INTERVAL_SECONDS", tt.dedup)
+		t.Setenv("RATE_LIMIT_PER_MINUTE", tt.rate)
+		guard := newIngestGuard()
+		if guard.dedupInterval != tt.wantInterval || guard.ratePerMinute != tt.wantRateLimit {
+			t.Errorf("DEDUP_INTERVAL_SECONDS=%q RATE_LIMIT_PER_MINUTE=%q: got %v, %d, want %v, %d",
+				tt.dedup, tt.rate, guard.dedupInterval, guard.ratePerMinute, tt.wantInterval, tt.wantRateLimit)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/kkaiki/DevInsight/internal/insight"
+)
+
+const (
+	// 1回のリクエストで受け付けるハートビートの上限
+	maxHeartbeatsPerRequest = 100
+	maxBodyBytes            = 1 << 20
+	maxLanguageLength       = 64
+	// project, branch, editor, machine の最大文字数
+	maxFieldLength = 256
+	// 受け付けるタイムスタンプの範囲
+	maxClockSkew    = 10 * time.Minute
+	maxHeartbeatAge = 7 * 24 * time.Hour
+	// expires_at の既定の保持日数（internal/purge の保持期間と同じ）
+	defaultRetentionDays = 90
+)
+
+// クライアントから送信されるハートビート
+type HeartbeatRequest struct {
+	DiscordID string `json:"discord_id"`
+	Timestamp string `json:"timestamp"` // RFC3339（タイムゾーン付き）
+	Language  string `json:"language"`
+	// 以下は省略可能
+	Project string `json:"project,omitempty"`
+	Branch  string `json:"branch,omitempty"`
+	Entity  string `json:"entity,omitempty"` // ファイルパス（ハッシュ化して保存する）
+	IsWrite bool   `json:"is_write,omitempty"`
+	Editor  string `json:"editor,omitempty"`
+	Machine string `json:"machine,omitempty"`
+}
+
+type rejectedHeartbeat struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+type ingestResponse struct {
+	Accepted   int                 `json:"accepted"`
+	Duplicates int                 `json:"duplicates"`
+	Rejected   []rejectedHeartbeat `json:"rejected,omitempty"`
+}
+
+type Server struct {
+	heartbeats    HeartbeatStore
+	tokens        TokenStore
+	settings      SettingsStore
+	retentionDays int
+	guard         *ingestGuard
+	now           func() time.Time
+	mux           *http.ServeMux
+}
+
+func newServer(heartbeats HeartbeatStore, tokens TokenStore, settings SettingsStore) *Server {
+	s := &Server{
+		heartbeats:    heartbeats,
+		tokens:        tokens,
+		settings:      settings,
+		retentionDays: getRetentionDays(),
+		guard:         newIngestGuard(),
+		now:           time.Now,
+		mux:           http.NewServeMux(),
+	}
+	s.mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	s.mux.HandleFunc("POST /api/v1/heartbeats", s.authenticate(s.handleHeartbeats))
+	// WakaTime 互換（api_url に https://<host>/api/v1 を指定する）
+	s.mux.HandleFunc("POST /api/v1/users/current/heartbeats", s.authenticate(s.handleWakaTimeHeartbeat))
+	s.mux.HandleFunc("POST /api/v1/users/current/heartbeats.bulk", s.authenticate(s.handleWakaTimeBulk))
+	s.mux.HandleFunc("GET /api/v1/users/current/status_bar/today", s.authenticate(s.handleStatusBarToday))
+	s.mux.HandleFunc("GET /api/v1/users/current/settings", s.authenticate(s.handleGetSettings))
+	s.mux.HandleFunc("PUT /api/v1/users/current/settings", s.authenticate(s.handlePutSettings))
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// RETENTION_DAYS が 0 の場合は expires_at を設定しない
+func getRetentionDays() int {
+	return insight.GetEnvInt("RETENTION_DAYS", defaultRetentionDays, 0)
+}
+
+// 認証済みのユーザーの Discord ID
+type authenticatedHandler func(w http.ResponseWriter, r *http.Request, discordID string)
+
+// Authorization: Bearer <token> でユーザーを認証する。
+// WakaTime のクライアントは Basic <base64(api key)> または api_key クエリで送信する
+func (s *Server) authenticate(next authenticatedHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := requestToken(r)
+		if token == "" {
+			writeError(w, http.StatusUnauthorized, "missing bearer token")
+			return
+		}
+		discordID, err := s.tokens.LookupToken(r.Context(), token)
+		if errors.Is(err, errInvalidToken) {
+			writeError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		if err != nil {
+			slog.Error("トークンの確認に失敗しました", "step", "auth", "error", err)
+			writeError(w, http.StatusInternalServerError, "failed to verify token")
+			return
+		}
+		next(w, r, discordID)
+	}
+}
+
+func requestToken(r *http.Request) string {
+	authorization := r.Header.Get("Authorization")
+	if token, ok := strings.CutPrefix(authorization, "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	if encoded, ok := strings.CutPrefix(authorization, "Basic "); ok {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return ""
+		}
+		// "api key" または "api key:" の形式
+		token, _, _ := strings.Cut(string(decoded), ":")
+		return token
+	}
+	return r.URL.Query().Get("api_key")
+}
+
+// 1件のハートビート、またはハートビートの配列を受け付ける
+func (s *Server) handleHeartbeats(w http.ResponseWriter, r *http.Request, discordID string) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodyBytes+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "failed to read body")
+		return
+	}
+	if len(body) > maxBodyBytes {
+		writeError(w, http.StatusRequestEntityTooLarge, "body too large")
+		return
+	}
+
+	var requests []HeartbeatRequest
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &requests)
+	} else {
+		var single HeartbeatRequest
+		err = json.Unmarshal(trimmed, &single)
+		requests = []HeartbeatRequest{single}
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	if len(requests) == 0 || len(requests) > maxHeartbeatsPerRequest {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("send between 1 and %d heartbeats", maxHeartbeatsPerRequest))
+		return
+	}
+
+	// データの削除でソルトも消えるため、キャッシュせずにリクエストごとに読む
+	salt, err := s.settings.EnsureEntitySalt(r.Context(), discordID)
+	if err != nil {
+		slog.Error("ユーザー設定の取得に失敗しました", "step", "ingest", "discord_id", discordID, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to load settings")
+		return
+	}
+
+	response := ingestResponse{}
+	counts := make(map[string]int)
+	defer recordMetrics(counts)
+	for i, request := range requests {
+		heartbeat, timestamp, err := s.normalizeHeartbeat(request, discordID, salt)
+		if err != nil {
+			counts[resultInvalid]++
+			response.Rejected = append(response.Rejected, rejectedHeartbeat{Index: i, Error: err.Error()})
+			continue
+		}
+		result := s.ingest(r.Context(), heartbeat, timestamp)
+		counts[result]++
+		switch result {
+		case resultAccepted:
+			response.Accepted++
+		case resultDuplicate:
+			response.Duplicates++
+		default:
+			response.Rejected = append(response.Rejected, rejectedHeartbeat{Index: i, Error: resultMessage(result)})
+		}
+	}
+
+	status := http.StatusCreated
+	switch {
+	case response.Accepted+response.Duplicates == 0 && counts[resultRateLimited] == len(requests):
+		w.Header().Set("Retry-After", "60")
+		status = http.StatusTooManyRequests
+	case response.Accepted+response.Duplicates == 0:
+		status = http.StatusBadRequest
+	case len(response.Rejected) > 0 || response.Duplicates > 0:
+		status = http.StatusAccepted
+	}
+	writeJSON(w, status, response)
+}
+
+// レート制限と重複排除を行ってからハートビートを保存し、処理結果を返す
+func (s *Server) ingest(ctx context.Context, heartbeat insight.InsightData, timestamp time.Time) string {
+	now := s.now()
+	if !s.guard.allow(heartbeat.DiscordID, now) {
+		return resultRateLimited
+	}
+	duplicate, undo := s.guard.isDuplicate(heartbeat, timestamp, now)
+	if duplicate {
+		return resultDuplicate
+	}
+	err := s.heartbeats.PutHeartbeat(ctx, heartbeat)
+	if errors.Is(err, errDuplicateHeartbeat) {
+		return resultDuplicate
+	}
+	if err != nil {
+		// 保存できなかったハートビートを重複扱いにしないよう、クライアントの再送を受け付ける
+		undo()
+		slog.Error("ハートビートの保存に失敗しました", "step", "ingest", "discord_id", heartbeat.DiscordID, "error", err)
+		return resultStoreError
+	}
+	return resultAccepted
+}
+
+// クライアントに返すエラーメッセージ
+func resultMessage(result string) string {
+	switch result {
+	case resultRateLimited:
+		return "rate limit exceeded"
+	case resultStoreError:
+		return "failed to store heartbeat"
+	}
+	return result
+}
+
+// ハートビートを検証し、タイムスタンプを UTC に揃える
+func (s *Server) normalizeHeartbeat(request HeartbeatRequest, discordID, salt string) (insight.InsightData, time.Time, error) {
+	if request.DiscordID != "" && request.DiscordID != discordID {
+		return insight.InsightData{}, time.Time{}, errors.New("discord_id does not match the token")
+	}
+	if !insight.IsValidDiscordID(discordID) {
+		return insight.InsightData{}, time.Time{}, errors.New("invalid discord_id")
+	}
+
+	timestamp, err := time.Parse(time.RFC3339, request.Timestamp)
+	if err != nil {
+		return insight.InsightData{}, time.Time{}, errors.New("timestamp must be RFC3339 with a time zone")
+	}
+	heartbeat, err := s.buildHeartbeat(discordID, salt, timestamp, request)
+	return heartbeat, timestamp, err
+}
+
+// 時刻と各項目を検証して保存する形式に変換する（request の DiscordID と Timestamp は使用しない）
+func (s *Server) buildHeartbeat(discordID, salt string, timestamp time.Time, request HeartbeatRequest) (insight.InsightData, error) {
+	now := s.now()
+	if timestamp.After(now.Add(maxClockSkew)) {
+		return insight.InsightData{}, errors.New("timestamp is in the future")
+	}
+	if timestamp.Before(now.Add(-maxHeartbeatAge)) {
+		return insight.InsightData{}, errors.New("timestamp is too old")
+	}
+
+	language := strings.TrimSpace(request.Language)
+	if language == "" {
+		return insight.InsightData{}, fmt.Errorf("language must be 1-%d characters", maxLanguageLength)
+	}
+	heartbeat := insight.InsightData{
+		DiscordID: discordID,
+		Timestamp: insight.FormatTimestamp(timestamp),
+		Language:  language,
+		IsWrite:   request.IsWrite,
+	}
+	fields := []struct {
+		name      string
+		value     string
+		maxLength int
+		target    *string
+	}{
+		{"language", language, maxLanguageLength, &heartbeat.Language},
+		{"project", request.Project, maxFieldLength, &heartbeat.Project},
+		{"branch", request.Branch, maxFieldLength, &heartbeat.Branch},
+		{"editor", request.Editor, maxFieldLength, &heartbeat.Editor},
+		{"machine", request.Machine, maxFieldLength, &heartbeat.Machine},
+	}
+	for _, field := range fields {
+		value, err := sanitizeField(field.name, field.value, field.maxLength)
+		if err != nil {
+			return insight.InsightData{}, err
+		}
+		*field.target = value
+	}
+	if request.Entity != "" {
+		heartbeat.Entity = hashEntity(salt, request.Entity)
+	}
+	if s.retentionDays > 0 {
+		heartbeat.ExpiresAt = timestamp.AddDate(0, 0, s.retentionDays).Unix()
+	}
+	return heartbeat, nil
+}
+
+// 前後の空白を除き、長さと制御文字を検証する
+func sanitizeField(name, value string, maxLength int) (string, error) {
+	value = strings.TrimSpace(value)
+	if len(value) > maxLength {
+		return "", fmt.Errorf("%s must be at most %d characters", name, maxLength)
+	}
+	for _, r := range value {
+		if !unicode.IsPrint(r) {
+			return "", fmt.Errorf("%s contains invalid characters", name)
+		}
+	}
+	return value, nil
+}
+
+// ファイルパスはユーザーごとのソルトで HMAC-SHA256 したハッシュ値だけを保存する
+// （ユーザー間で同じパスを突き合わせられないようにする）
+func hashEntity(salt, entity string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(entity))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		slog.Error("レスポンスの書き込みに失敗しました", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kkaiki/DevInsight/internal/insight"
+)
+
+const (
+	testDiscordID = "123456789012345678"
+	testToken     = "waka_test-token"
+)
+
+var testNow = time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+
+// テーブルの代わりにメモリ上に保存するハートビート
+type memoryHeartbeatStore struct {
+	mu    sync.Mutex
+	items map[string]insight.InsightData // discord_id と timestamp
+	err   error                          // 設定した場合は保存に失敗する
+}
+
+func (s *memoryHeartbeatStore) PutHeartbeat(ctx context.Context, heartbeat insight.InsightData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	key := heartbeat.DiscordID + "\x00" + heartbeat.Timestamp
+	if _, ok := s.items[key]; ok {
+		return errDuplicateHeartbeat
+	}
+	s.items[key] = heartbeat
+	return nil
+}
+
+func (s *memoryHeartbeatStore) QueryHeartbeats(ctx context.Context, discordID string, from, to time.Time) ([]insight.InsightData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var heartbeats []insight.InsightData
+	for _, item := range s.items {
+		if item.DiscordID == discordID && item.Timestamp >= insight.FormatTimestamp(from) && item.Timestamp < insight.FormatTimestamp(to) {
+			heartbeats = append(heartbeats, item)
+		}
+	}
+	sort.Slice(heartbeats, func(i, j int) bool {
+		return heartbeats[i].Timestamp < heartbeats[j].Timestamp
+	})
+	return heartbeats, nil
+}
+
+// トークンと Discord ID
+type memoryTokenStore map[string]string
+
+func (s memoryTokenStore) LookupToken(ctx context.Context, token string) (string, error) {
+	if discordID, ok := s[token]; ok {
+		return discordID, nil
+	}
+	return "", errInvalidToken
+}
+
+func (s memoryTokenStore) IssueToken(ctx context.Context, discordID string) (string, error) {
+	return "", errors.New("not supported")
+}
+
+type memorySettingsStore struct {
+	mu       sync.Mutex
+	settings map[string]insight.UserSettings
+}
+
+func (s *memorySettingsStore) GetSettings(ctx context.Context, discordID string) (insight.UserSettings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if settings, ok := s.settings[discordID]; ok {
+		return settings, nil
+	}
+	return insight.UserSettings{DiscordID: discordID}, nil
+}
+
+func (s *memorySettingsStore) PutSettings(ctx context.Context, settings insight.UserSettings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	settings.EntitySalt = s.settings[settings.DiscordID].EntitySalt
+	s.settings[settings.DiscordID] = settings
+	return nil
+}
+
+func (s *memorySettingsStore) EnsureEntitySalt(ctx context.Context, discordID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	settings := s.settings[discordID]
+	if settings.EntitySalt == "" {
+		settings.DiscordID = discordID
+		settings.EntitySalt = "salt-" + discordID
+		s.settings[discordID] = settings
+	}
+	return settings.EntitySalt, nil
+}
+
+// 時刻を testNow に固定し、メモリ上のストアを使うサーバー
+func newTestServer(t *testing.T) (*Server, *memoryHeartbeatStore) {
+	t.Helper()
+	heartbeats := &memoryHeartbeatStore{items: make(map[string]insight.InsightData)}
+	settings := &memorySettingsStore{settings: make(map[string]insight.UserSettings)}
+	s := newServer(heartbeats, memoryTokenStore{testToken: testDiscordID}, settings)
+	s.now = func() time.Time { return testNow }
+	return s, heartbeats
+}
+
+func serve(s *Server, method, path, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func heartbeatJSON(timestamp time.Time, fields string) string {
+	return fmt.Sprintf(`{"timestamp": %q, "language": "go"%s}`, timestamp.Format(time.RFC3339Nano), fields)
+}
+
+func TestHandleHeartbeats(t *testing.T) {
+	valid := heartbeatJSON(testNow.Add(-time.Minute), `, "entity": "/src/main.go"`)
+
+	tests := []struct {
+		name       string
+		token      string
+		body       string
+		status     int
+		accepted   int
+		duplicates int
+		rejected   []string // 拒否したハートビートのエラー
+	}{
+		{name: "single", token: testToken, body: valid, status: http.StatusCreated, accepted: 1},
+		{
+			name:     "array",
+			token:    testToken,
+			body:     "[" + valid + "," + heartbeatJSON(testNow.Add(-30*time.Minute), `, "entity": "/src/main.go"`) + "]",
+			status:   http.StatusCreated,
+			accepted: 2,
+		},
+		{
+			name:       "duplicate within the interval",
+			token:      testToken,
+			body:       "[" + valid + "," + heartbeatJSON(testNow.Add(-50*time.Second), `, "entity": "/src/main.go"`) + "]",
+			status:     http.StatusAccepted,
+			accepted:   1,
+			duplicates: 1,
+		},
+		{
+			name:     "same time in another file",
+			token:    testToken,
+			body:     "[" + valid + "," + heartbeatJSON(testNow.Add(-50*time.Second), `, "entity": "/src/other.go"`) + "]",
+			status:   http.StatusCreated,
+			accepted: 2,
+		},
+		{
+			name:     "valid and invalid",
+			token:    testToken,
+			body:     "[" + valid + `, {"timestamp": "2024-04-01T11:00:00", "language": "go"}]`,
+			status:   http.StatusAccepted,
+			accepted: 1,
+			rejected: []string{"timestamp must be RFC3339 with a time zone"},
+		},
+		{name: "missing token", body: valid, status: http.StatusUnauthorized},
+		{name: "invalid token", token: "waka_unknown", body: valid, status: http.StatusUnauthorized},
+		{name: "invalid JSON", token: testToken, body: `{"timestamp":`, status: http.StatusBadRequest},
+		{name: "empty array", token: testToken, body: `[]`, status: http.StatusBadRequest},
+		{
+			name:   "too many heartbeats",
+			token:  testToken,
+			body:   "[" + strings.Repeat(valid+",", maxHeartbeatsPerRequest) + valid + "]",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:     "another user's discord_id",
+			token:    testToken,
+			body:     fmt.Sprintf(`{"discord_id": "876543210987654321", "timestamp": %q, "language": "go"}`, testNow.Format(time.RFC3339)),
+			status:   http.StatusBadRequest,
+			rejected: []string{"discord_id does not match the token"},
+		},
+		{
+			name:     "future timestamp",
+			token:    testToken,
+			body:     heartbeatJSON(testNow.Add(11*time.Minute), ""),
+			status:   http.StatusBadRequest,
+			rejected: []string{"timestamp is in the future"},
+		},
+		{
+			name:     "clock skew within the limit",
+			token:    testToken,
+			body:     heartbeatJSON(testNow.Add(9*time.Minute), ""),
+			status:   http.StatusCreated,
+			accepted: 1,
+		},
+		{
+			name:     "old timestamp",
+			token:    testToken,
+			body:     heartbeatJSON(testNow.Add(-8*24*time.Hour), ""),
+			status:   http.StatusBadRequest,
+			rejected: []string{"timestamp is too old"},
+		},
+		{
+			name:     "no language",
+			token:    testToken,
+			body:     fmt.Sprintf(`{"timestamp": %q, "language": " "}`, testNow.Format(time.RFC3339)),
+			status:   http.StatusBadRequest,
+			rejected: []string{"language must be 1-64 characters"},
+		},
+		{
+			name:     "control characters",
+			token:    testToken,
+			body:     heartbeatJSON(testNow, `, "project": "dev\u0007insight"`),
+			status:   http.StatusBadRequest,
+			rejected: []string{"project contains invalid characters"},
+		},
+		{
+			name:     "long branch",
+			token:    testToken,
+			body:     heartbeatJSON(testNow, fmt.Sprintf(`, "branch": %q`, strings.Repeat("b", maxFieldLength+1))),
+			status:   http.StatusBadRequest,
+			rejected: []string{"branch must be at most 256 characters"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t)
+			w := serve(s, http.MethodPost, "/api/v1/heartbeats", tt.token, tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status == http.StatusUnauthorized || len(tt.rejected) == 0 && tt.accepted == 0 {
+				return
+			}
+			var response ingestResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Accepted != tt.accepted || response.Duplicates != tt.duplicates {
+				t.Errorf("accepted = %d, duplicates = %d, want %d, %d", response.Accepted, response.Duplicates, tt.accepted, tt.duplicates)
+			}
+			if len(response.Rejected) != len(tt.rejected) {
+				t.Fatalf("rejected = %+v, want %v", response.Rejected, tt.rejected)
+			}
+			for i, want := range tt.rejected {
+				if response.Rejected[i].Error != want {
+					t.Errorf("rejected[%d] = %q, want %q", i, response.Rejected[i].Error, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleHeartbeatsStoresNormalizedHeartbeat(t *testing.T) {
+	s, store := newTestServer(t)
+	timestamp := time.Date(2024, 4, 1, 20, 30, 15, 123456789, time.FixedZone("JST", 9*60*60))
+	body := heartbeatJSON(timestamp, `, "project": " devinsight ", "entity": "/home/user/src/main.go", "is_write": true`)
+	if w := serve(s, http.MethodPost, "/api/v1/heartbeats", testToken, body); w.Code != http.StatusCreated {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if len(store.items) != 1 {
+		t.Fatalf("stored %d heartbeats, want 1", len(store.items))
+	}
+	for _, heartbeat := range store.items {
+		want := insight.InsightData{
+			DiscordID: testDiscordID,
+			Timestamp: "2024-04-01T11:30:15.123Z",
+			Language:  "go",
+			Project:   "devinsight",
+			Entity:    hashEntity("salt-"+testDiscordID, "/home/user/src/main.go"),
+			IsWrite:   true,
+			ExpiresAt: timestamp.AddDate(0, 0, defaultRetentionDays).Unix(),
+		}
+		if heartbeat != want {
+			t.Errorf("stored %+v, want %+v", heartbeat, want)
+		}
+	}
+}
+
+func TestHandleHeartbeatsStoreError(t *testing.T) {
+	s, store := newTestServer(t)
+	body := heartbeatJSON(testNow.Add(-time.Minute), "")
+	store.err = errors.New("throttled")
+	if w := serve(s, http.MethodPost, "/api/v1/heartbeats", testToken, body); w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	// 保存できなかったハートビートの再送は重複にしない
+	store.err = nil
+	if w := serve(s, http.MethodPost, "/api/v1/heartbeats", testToken, body); w.Code != http.StatusCreated {
+		t.Fatalf("resend status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	// 保存済みのハートビートの再送は重複
+	if w := serve(s, http.MethodPost, "/api/v1/heartbeats", testToken, body); w.Code != http.StatusAccepted {
+		t.Fatalf("duplicate status = %d, want %d", w.Code, http.StatusAccepted)
+	}
+}
+
+func TestRequestToken(t *testing.T) {
+	basic := func(value string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(value))
+	}
+	tests := []struct {
+		name          string
+		authorization string
+		query         string
+		want          string
+	}{
+		{"bearer", "Bearer " + testToken, "", testToken},
+		{"basic", basic(testToken), "", testToken},
+		{"basic with a colon", basic(testToken + ":"), "", testToken},
+		{"invalid basic", "Basic %%%", "", ""},
+		{"query", "", "api_key=" + testToken, testToken},
+		{"none", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/users/current/status_bar/today?"+tt.query, nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			if got := requestToken(r); got != tt.want {
+				t.Errorf("requestToken() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHashEntity(t *testing.T) {
+	a := hashEntity("salt-a", "/src/main.go")
+	if a == "/src/main.go" || len(a) != 64 {
+		t.Errorf("hashEntity() = %q, want a hex SHA-256", a)
+	}
+	if a != hashEntity("salt-a", "/src/main.go") {
+		t.Error("hashEntity() is not stable")
+	}
+	// ユーザー間で同じパスを突き合わせられない
+	if a == hashEntity("salt-b", "/src/main.go") {
+		t.Error("hashEntity() does not depend on the salt")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+
+	"github.com/kkaiki/DevInsight/internal/insight"
+)
+
+// DynamoDB の呼び出しは insight.DB（SDK の再試行は無効）を使い、insight.Retry で再試行する
+var (
+	tableName             = insight.TableName
+	tokenTableName        = insight.TokenTableName
+	userSettingsTableName = insight.UserSettingsTableName
+)
+
+func main() {
+	issueToken := flag.String("issue-token", "", "指定した Discord ID の API トークンを発行して表示する")
+	addr := flag.String("addr", ":8080", "スタンドアロンで起動する場合の待ち受けアドレス")
+	flag.Parse()
+	slog.SetDefault(insight.NewLogger(os.Stderr))
+
+	server := newServer(&dynamoHeartbeatStore{svc: insight.DB}, &dynamoTokenStore{svc: insight.DB}, &dynamoSettingsStore{svc: insight.DB})
+
+	if *issueToken != "" {
+		token, err := server.tokens.IssueToken(context.Background(), *issueToken)
+		if err != nil {
+			slog.Error("トークンの発行に失敗しました", "step", "issue_token", "discord_id", *issueToken, "error", err)
+			os.Exit(1)
+		}
+		fmt.Println(token)
+		return
+	}
+
+	// Lambda 上では関数 URL のリクエストとして処理する
+	if os.Getenv("AWS_LAMBDA_RUNTIME_API") != "" {
+		lambda.Start(func(ctx context.Context, request events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
+			return serveFunctionURL(insight.StartRun(ctx, "api"), server, request)
+		})
+		return
+	}
+
+	slog.Info("待ち受けを開始します", "addr", *addr)
+	httpServer := &http.Server{
+		Addr:              *addr,
+		Handler:           server,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	err := httpServer.ListenAndServe()
+	slog.Error("サーバーが停止しました", "error", err)
+	os.Exit(1)
+}
+
+// 関数 URL のリクエストを http.Handler で処理する
+func serveFunctionURL(ctx context.Context, handler http.Handler, request events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
+	body := []byte(request.Body)
+	if request.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(request.Body)
+		if err != nil {
+			return events.LambdaFunctionURLResponse{StatusCode: http.StatusBadRequest}, nil
+		}
+		body = decoded
+	}
+
+	url := request.RawPath
+	if request.RawQueryString != "" {
+		url += "?" + request.RawQueryString
+	}
+	httpRequest, err := http.NewRequestWithContext(ctx, request.RequestContext.HTTP.Method, url, bytes.NewReader(body))
+	if err != nil {
+		return events.LambdaFunctionURLResponse{StatusCode: http.StatusBadRequest}, nil
+	}
+	for name, value := range request.Headers {
+		httpRequest.Header.Set(name, value)
+	}
+	httpRequest.RemoteAddr = request.RequestContext.HTTP.SourceIP
+
+	writer := &functionURLResponseWriter{header: http.Header{}, status: http.StatusOK}
+	handler.ServeHTTP(writer, httpRequest)
+
+	headers := make(map[string]string, len(writer.header))
+	for name, values := range writer.header {
+		headers[name] = strings.Join(values, ", ")
+	}
+	return events.LambdaFunctionURLResponse{
+		StatusCode: writer.status,
+		Headers:    headers,
+		Body:       writer.body.String(),
+	}, nil
+}
+
+type functionURLResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *functionURLResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *functionURLResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *functionURLResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"time"
+)
+
+// ハートビートの処理結果
+const (
+	resultAccepted    = "accepted"
+	resultDuplicate   = "duplicate"
+	resultRateLimited = "rate_limited"
+	resultInvalid     = "invalid"
+	resultStoreError  = "store_error"
+)
+
+const metricsNamespace = "DevInsight/Ingest"
+
+// 1リクエスト分の処理結果ごとの件数を、CloudWatch の Embedded Metric Format で出力する
+// 累計は CloudWatch で確認する（認証なしで公開しないよう、API では返さない）
+func recordMetrics(counts map[string]int) {
+	if len(counts) == 0 {
+		return
+	}
+
+	results := make([]string, 0, len(counts))
+	for result := range counts {
+		results = append(results, result)
+	}
+	sort.Strings(results)
+	for _, result := range results {
+		line, err := json.Marshal(map[string]interface{}{
+			"_aws": map[string]interface{}{
+				"Timestamp": time.Now().UnixMilli(),
+				"CloudWatchMetrics": []map[string]interface{}{{
+					"Namespace":  metricsNamespace,
+					"Dimensions": [][]string{{"Result"}},
+					"Metrics":    []map[string]string{{"Name": "Heartbeats", "Unit": "Count"}},
+				}},
+			},
+			"Result":     result,
+			"Heartbeats": counts[result],
+		})
+		if err != nil {
+			slog.Warn("メトリクスの出力に失敗しました", "step", "metrics", "error", err)
+			continue
+		}
+		// EMF は1行がそのまま JSON である必要があるため、ログ（標準エラー出力）ではなく標準出力に書く
+		fmt.Fprintln(os.Stdout, string(line))
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+
+	"github.com/kkaiki/DevInsight/internal/insight"
+)
+
+// 1つのリストに登録できるプロジェクトの上限
+const maxSettingsProjects = 100
+
+type SettingsStore interface {
+	// 設定がない場合は既定値を返す
+	GetSettings(ctx context.Context, discordID string) (insight.UserSettings, error)
+	// ソルト以外の設定を保存する
+	PutSettings(ctx context.Context, settings insight.UserSettings) error
+	// ソルトがなければ作成し、保存されているソルトを返す
+	EnsureEntitySalt(ctx context.Context, discordID string) (string, error)
+}
+
+type dynamoSettingsStore struct {
+	svc *dynamodb.DynamoDB
+}
+
+func (s *dynamoSettingsStore) GetSettings(ctx context.Context, discordID string) (insight.UserSettings, error) {
+	settings := insight.UserSettings{DiscordID: discordID}
+	var result *dynamodb.GetItemOutput
+	err := insight.Retry(ctx, "get "+userSettingsTableName, func() error {
+		var err error
+		result, err = s.svc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+			TableName: aws.String(userSettingsTableName),
+			Key: map[string]*dynamodb.AttributeValue{
+				"discord_id": {S: aws.String(discordID)},
+			},
+		})
+		return err
+	})
+	if err != nil {
+		return settings, fmt.Errorf("ユーザー設定の取得に失敗: %w", err)
+	}
+	if result.Item == nil {
+		return settings, nil
+	}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &settings); err != nil {
+		return settings, fmt.Errorf("ユーザー設定のアンマーシャルに失敗: %w", err)
+	}
+	return settings, nil
+}
+
+func (s *dynamoSettingsStore) PutSettings(ctx context.Context, settings insight.UserSettings) error {
+	update := expression.Set(expression.Name("hide_project_names"), expression.Value(settings.HideProjectNames)).
+		Set(expression.Name("private_projects"), expression.Value(settings.PrivateProjects)).
+		Set(expression.Name("leaderboard_projects"), expression.Value(settings.LeaderboardProjects)).
+		Set(expression.Name("leaderboard_excluded_projects"), expression.Value(settings.LeaderboardExcludedProjects)).
+		Set(expression.Name("weekly_summary_dm"), expression.Value(settings.WeeklySummaryDM)).
+		Set(expression.Name("updated_at"), expression.Value(settings.UpdatedAt))
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	if err != nil {
+		return fmt.Errorf("更新式の構築に失敗: %w", err)
+	}
+	err = insight.Retry(ctx, "update "+userSettingsTableName, func() error {
+		_, err := s.svc.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(userSettingsTableName),
+			Key: map[string]*dynamodb.AttributeValue{
+				"discord_id": {S: aws.String(settings.DiscordID)},
+			},
+			UpdateExpression:          expr.Update(),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("ユーザー設定の保存に失敗: %w", err)
+	}
+	return nil
+}
+
+func (s *dynamoSettingsStore) EnsureEntitySalt(ctx context.Context, discordID string) (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	// 同時に作成された場合も先に保存されたソルトを使う
+	update := expression.Set(expression.Name("entity_salt"),
+		expression.IfNotExists(expression.Name("entity_salt"), expression.Value(hex.EncodeToString(random))))
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	if err != nil {
+		return "", fmt.Errorf("更新式の構築に失敗: %w", err)
+	}
+	var result *dynamodb.UpdateItemOutput
+	err = insight.Retry(ctx, "update "+userSettingsTableName, func() error {
+		var err error
+		result, err = s.svc.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(userSettingsTableName),
+			Key: map[string]*dynamodb.AttributeValue{
+				"discord_id": {S: aws.String(discordID)},
+			},
+			UpdateExpression:          expr.Update(),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+			ReturnValues:              aws.String(dynamodb.ReturnValueAllNew),
+		})
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("ソルトの保存に失敗: %w", err)
+	}
+	salt := result.Attributes["entity_salt"]
+	if salt == nil || salt.S == nil {
+		return "", errors.New("ソルトが保存されていません")
+	}
+	return *salt.S, nil
+}
+
+func (s *Server) handleGetSettings(w http.ResponseWriter, r *http.Request, discordID string) {
+	settings, err := s.settings.GetSettings(r.Context(), discordID)
+	if err != nil {
+		slog.Error("ユーザー設定の取得に失敗しました", "step", "settings", "discord_id", discordID, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to load settings")
+		return
+	}
+	settings.EntitySalt = ""
+	writeJSON(w, http.StatusOK, settings)
+}
+
+func (s *Server) handlePutSettings(w http.ResponseWriter, r *http.Request, discordID string) {
+	var settings insight.UserSettings
+	if err := decodeBody(r, &settings); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if settings.DiscordID != "" && settings.DiscordID != discordID {
+		writeError(w, http.StatusBadRequest, "discord_id does not match the token")
+		return
+	}
+	settings.DiscordID = discordID
+	settings.EntitySalt = ""
+	settings.UpdatedAt = s.now().UTC().Format(time.RFC3339)
+
+	lists := []struct {
+		name     string
+		projects *[]string
+	}{
+		{"private_projects", &settings.PrivateProjects},
+		{"leaderboard_projects", &settings.LeaderboardProjects},
+		{"leaderboard_excluded_projects", &settings.LeaderboardExcludedProjects},
+	}
+	for _, list := range lists {
+		projects, err := sanitizeProjects(list.name, *list.projects)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		*list.projects = projects
+	}
+
+	if err := s.settings.PutSettings(r.Context(), settings); err != nil {
+		slog.Error("ユーザー設定の保存に失敗しました", "step", "settings", "discord_id", discordID, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to save settings")
+		return
+	}
+	writeJSON(w, http.StatusOK, settings)
+}
+
+// プロジェクト名は保存時と同じく前後の空白を除いて比較する
+func sanitizeProjects(name string, projects []string) ([]string, error) {
+	if len(projects) > maxSettingsProjects {
+		return nil, fmt.Errorf("%s must have at most %d projects", name, maxSettingsProjects)
+	}
+	seen := make(map[string]bool)
+	sanitized := make([]string, 0, len(projects))
+	for _, project := range projects {
+		project, err := sanitizeField(name, project, maxFieldLength)
+		if err != nil {
+			return nil, err
+		}
+		if project == "" || seen[project] {
+			continue
+		}
+		seen[project] = true
+		sanitized = append(sanitized, project)
+	}
+	return sanitized, nil
+}
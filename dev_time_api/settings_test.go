@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kkaiki/DevInsight/internal/insight"
+)
+
+func TestHandlePutSettings(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		want       insight.UserSettings
+	}{
+		{
+			name:       "sanitized",
+			body:       `{"hide_project_names": true, "private_projects": [" secret ", "secret", ""], "leaderboard_excluded_projects": ["side"], "weekly_summary_dm": true}`,
+			wantStatus: http.StatusOK,
+			want: insight.UserSettings{
+				HideProjectNames:            true,
+				PrivateProjects:             []string{"secret"},
+				LeaderboardProjects:         []string{},
+				LeaderboardExcludedProjects: []string{"side"},
+				WeeklySummaryDM:             true,
+			},
+		},
+		{
+			name:       "salt is ignored",
+			body:       `{"discord_id": "` + testDiscordID + `", "entity_salt": "chosen"}`,
+			wantStatus: http.StatusOK,
+			want: insight.UserSettings{
+				PrivateProjects:             []string{},
+				LeaderboardProjects:         []string{},
+				LeaderboardExcludedProjects: []string{},
+			},
+		},
+		{"another user", `{"discord_id": "876543210987654321"}`, http.StatusBadRequest, insight.UserSettings{}},
+		{"invalid project", `{"private_projects": ["a\u0007b"]}`, http.StatusBadRequest, insight.UserSettings{}},
+		{"too many projects", `{"leaderboard_projects": [` + strings.TrimSuffix(strings.Repeat(`"p",`, maxSettingsProjects+1), ",") + `]}`, http.StatusBadRequest, insight.UserSettings{}},
+		{"invalid JSON", `{"hide_project_names": "yes"}`, http.StatusBadRequest, insight.UserSettings{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t)
+			settings := s.settings.(*memorySettingsStore)
+			w := serve(s, http.MethodPut, "/api/v1/users/current/settings", testToken, tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if _, ok := settings.settings[testDiscordID]; ok {
+					t.Error("invalid settings were saved")
+				}
+				return
+			}
+			want := tt.want
+			want.DiscordID = testDiscordID
+			want.UpdatedAt = testNow.Format(time.RFC3339)
+			if got := settings.settings[testDiscordID]; !reflect.DeepEqual(got, want) {
+				t.Errorf("saved %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestHandleGetSettingsHidesSalt(t *testing.T) {
+	s, _ := newTestServer(t)
+	if _, err := s.settings.EnsureEntitySalt(context.Background(), testDiscordID); err != nil {
+		t.Fatal(err)
+	}
+	w := serve(s, http.MethodGet, "/api/v1/users/current/settings", testToken, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := body["entity_salt"]; ok {
+		t.Errorf("response has entity_salt: %s", w.Body)
+	}
+}
+
+func TestEntityHashedWithUserSalt(t *testing.T) {
+	s, store := newTestServer(t)
+	const otherToken = "waka_other-token"
+	s.tokens = memoryTokenStore{testToken: testDiscordID, otherToken: "876543210987654321"}
+
+	body := heartbeatJSON(testNow, `, "entity": "/src/main.go"`)
+	for _, token := range []string{testToken, otherToken} {
+		if w := serve(s, http.MethodPost, "/api/v1/heartbeats", token, body); w.Code != http.StatusCreated {
+			t.Fatalf("status = %d: %s", w.Code, w.Body)
+		}
+	}
+	// 設定を更新してもソルトは変わらない
+	serve(s, http.MethodPut, "/api/v1/users/current/settings", testToken, `{"hide_project_names": true}`)
+	if w := serve(s, http.MethodPost, "/api/v1/heartbeats", testToken, heartbeatJSON(testNow.Add(time.Minute), `, "entity": "/src/main.go"`)); w.Code != http.StatusCreated {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+
+	entities := make(map[string]map[string]bool)
+	for _, heartbeat := range store.items {
+		if strings.Contains(heartbeat.Entity, "main.go") {
+			t.Errorf("stored the file path: %q", heartbeat.Entity)
+		}
+		if entities[heartbeat.DiscordID] == nil {
+			entities[heartbeat.DiscordID] = make(map[string]bool)
+		}
+		entities[heartbeat.DiscordID][heartbeat.Entity] = true
+	}
+	if len(entities[testDiscordID]) != 1 {
+		t.Errorf("the same file has %d hashes for one user, want 1", len(entities[testDiscordID]))
+	}
+	for entity := range entities[testDiscordID] {
+		if entities["876543210987654321"][entity] {
+			t.Error("the same file has the same hash for different users")
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+
+	"github.com/kkaiki/DevInsight/internal/insight"
+)
+
+var (
+	// トークンが存在しない、または無効化されている
+	errInvalidToken = errors.New("invalid token")
+	// 同じ discord_id と timestamp のハートビートが保存済み
+	errDuplicateHeartbeat = errors.New("duplicate heartbeat")
+)
+
+// ハートビートの保存先
+type HeartbeatStore interface {
+	PutHeartbeat(ctx context.Context, heartbeat insight.InsightData) error
+	// from 以上 to 未満のハートビートを時刻順に返す
+	QueryHeartbeats(ctx context.Context, discordID string, from, to time.Time) ([]insight.InsightData, error)
+}
+
+// API トークンの保存先。トークンはハッシュ値のみを保存する
+type TokenStore interface {
+	LookupToken(ctx context.Context, token string) (string, error)
+	IssueToken(ctx context.Context, discordID string) (string, error)
+}
+
+type dynamoHeartbeatStore struct {
+	svc *dynamodb.DynamoDB
+}
+
+func (s *dynamoHeartbeatStore) PutHeartbeat(ctx context.Context, heartbeat insight.InsightData) error {
+	item, err := dynamodbattribute.MarshalMap(heartbeat)
+	if err != nil {
+		return fmt.Errorf("ハートビートのマーシャルに失敗: %w", err)
+	}
+	// 再送されたハートビートで既存の項目を上書きしない
+	err = insight.Retry(ctx, "put "+tableName, func() error {
+		_, err := s.svc.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+			TableName:           aws.String(tableName),
+			Item:                item,
+			ConditionExpression: aws.String("attribute_not_exists(#ts)"),
+			ExpressionAttributeNames: map[string]*string{
+				"#ts": aws.String("timestamp"),
+			},
+		})
+		return err
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return errDuplicateHeartbeat
+	}
+	if err != nil {
+		return fmt.Errorf("ハートビートの保存に失敗: %w", err)
+	}
+	return nil
+}
+
+func (s *dynamoHeartbeatStore) QueryHeartbeats(ctx context.Context, discordID string, from, to time.Time) ([]insight.InsightData, error) {
+	keyCond := expression.Key("discord_id").Equal(expression.Value(discordID)).
+		And(expression.Key("timestamp").Between(
+			expression.Value(insight.FormatTimestamp(from)),
+			expression.Value(insight.FormatTimestamp(to.Add(-time.Millisecond))),
+		))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyCond).Build()
+	if err != nil {
+		return nil, fmt.Errorf("クエリ式の構築に失敗: %w", err)
+	}
+
+	var heartbeats []insight.InsightData
+	var unmarshalErr error
+	err = insight.Retry(ctx, "query "+tableName, func() error {
+		// 途中のページで失敗した場合は最初から取得し直す
+		heartbeats, unmarshalErr = nil, nil
+		return s.svc.QueryPagesWithContext(ctx, &dynamodb.QueryInput{
+			TableName:                 aws.String(tableName),
+			KeyConditionExpression:    expr.KeyCondition(),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+		}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+			var items []insight.InsightData
+			if unmarshalErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &items); unmarshalErr != nil {
+				return false
+			}
+			heartbeats = append(heartbeats, items...)
+			return true
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ハートビートの取得に失敗: %w", err)
+	}
+	// 一部のページを飛ばすと集計が欠けるため、アンマーシャルの失敗はエラーにする
+	if unmarshalErr != nil {
+		return nil, fmt.Errorf("ハートビートのアンマーシャルに失敗: %w", unmarshalErr)
+	}
+	return heartbeats, nil
+}
+
+// dev_insight_tokens テーブルの項目
+type apiToken struct {
+	TokenHash string `json:"token_hash"`
+	DiscordID string `json:"discord_id"`
+	CreatedAt string `json:"created_at"`
+	Revoked   bool   `json:"revoked"`
+}
+
+type dynamoTokenStore struct {
+	svc *dynamodb.DynamoDB
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *dynamoTokenStore) LookupToken(ctx context.Context, token string) (string, error) {
+	var result *dynamodb.GetItemOutput
+	err := insight.Retry(ctx, "get "+tokenTableName, func() error {
+		var err error
+		result, err = s.svc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+			TableName: aws.String(tokenTableName),
+			Key: map[string]*dynamodb.AttributeValue{
+				"token_hash": {S: aws.String(hashToken(token))},
+			},
+		})
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("トークンの取得に失敗: %w", err)
+	}
+	if result.Item == nil {
+		return "", errInvalidToken
+	}
+	var record apiToken
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &record); err != nil {
+		return "", fmt.Errorf("トークンのアンマーシャルに失敗: %w", err)
+	}
+	if record.Revoked {
+		return "", errInvalidToken
+	}
+	return record.DiscordID, nil
+}
+
+func (s *dynamoTokenStore) IssueToken(ctx context.Context, discordID string) (string, error) {
+	if !insight.IsValidDiscordID(discordID) {
+		return "", fmt.Errorf("不正なDiscord ID: %q", discordID)
+	}
+	// wakatime-cli は UUID 形式以外の API キーを受け付けないため、WakaTime と同じ形式で発行する
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	random[6] = random[6]&0x0f | 0x40
+	random[8] = random[8]&0x3f | 0x80
+	token := fmt.Sprintf("waka_%x-%x-%x-%x-%x", random[0:4], random[4:6], random[6:8], random[8:10], random[10:16])
+
+	item, err := dynamodbattribute.MarshalMap(apiToken{
+		TokenHash: hashToken(token),
+		DiscordID: discordID,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return "", err
+	}
+	err = insight.Retry(ctx, "put "+tokenTableName, func() error {
+		_, err := s.svc.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(tokenTableName),
+			Item:      item,
+		})
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("トークンの保存に失敗: %w", err)
+	}
+	return token, nil
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	_ "time/tzdata" // Lambda の実行環境にタイムゾーンのデータがない場合に備える
+
+	"github.com/kkaiki/DevInsight/internal/insight"
+)
+
+const (
+	// 言語が送信されなかった場合（WakaTime の "Other" と同じ扱い）
+	unknownLanguage = "other"
+)
+
+// WakaTime の言語名を VS Code の言語ID（拡張機能が送信する形式）に揃える
+var wakaTimeLanguages = map[string]string{
+	"c#":           "csharp",
+	"c++":          "cpp",
+	"f#":           "fsharp",
+	"shell script": "shellscript",
+	"bash":         "shellscript",
+	"vue.js":       "vue",
+	"jsx":          "javascriptreact",
+	"tsx":          "typescriptreact",
+	"text":         "plaintext",
+}
+
+// wakatime-cli が送信するハートビート（集計に使う項目のみ）
+type wakaTimeHeartbeat struct {
+	Entity    string  `json:"entity"`
+	Type      string  `json:"type"`
+	Category  string  `json:"category,omitempty"`
+	Time      float64 `json:"time"`
+	Project   *string `json:"project,omitempty"`
+	Branch    *string `json:"branch,omitempty"`
+	Language  *string `json:"language,omitempty"`
+	IsWrite   bool    `json:"is_write,omitempty"`
+	UserAgent string  `json:"user_agent,omitempty"`
+}
+
+type wakaTimeHeartbeatData struct {
+	ID string `json:"id"`
+	wakaTimeHeartbeat
+}
+
+type wakaTimeDuration struct {
+	Name         string  `json:"name,omitempty"`
+	TotalSeconds float64 `json:"total_seconds"`
+	Digital      string  `json:"digital"`
+	Decimal      string  `json:"decimal"`
+	Text         string  `json:"text"`
+	Hours        int     `json:"hours"`
+	Minutes      int     `json:"minutes"`
+	Percent      float64 `json:"percent,omitempty"`
+}
+
+type wakaTimeRange struct {
+	Date     string `json:"date"`
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	Text     string `json:"text"`
+	Timezone string `json:"timezone"`
+}
+
+type wakaTimeStatusBar struct {
+	GrandTotal wakaTimeDuration   `json:"grand_total"`
+	Categories []wakaTimeDuration `json:"categories"`
+	Languages  []wakaTimeDuration `json:"languages"`
+	Range      wakaTimeRange      `json:"range"`
+}
+
+func (s *Server) handleWakaTimeHeartbeat(w http.ResponseWriter, r *http.Request, discordID string) {
+	var heartbeat wakaTimeHeartbeat
+	if err := decodeBody(r, &heartbeat); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	salt, err := s.settings.EnsureEntitySalt(r.Context(), discordID)
+	if err != nil {
+		slog.Error("ユーザー設定の取得に失敗しました", "step", "wakatime", "discord_id", discordID, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to load settings")
+		return
+	}
+	counts := make(map[string]int)
+	defer recordMetrics(counts)
+	data, status, err := s.storeWakaTimeHeartbeat(r, discordID, salt, heartbeat, counts)
+	if err != nil {
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "60")
+		}
+		writeError(w, status, err.Error())
+		return
+	}
+	writeJSON(w, status, map[string]interface{}{"data": data})
+}
+
+// wakatime-cli は [レスポンス, ステータス] の配列を見て、失敗したハートビートを再送する
+func (s *Server) handleWakaTimeBulk(w http.ResponseWriter, r *http.Request, discordID string) {
+	var heartbeats []wakaTimeHeartbeat
+	if err := decodeBody(r, &heartbeats); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(heartbeats) == 0 || len(heartbeats) > maxHeartbeatsPerRequest {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("send between 1 and %d heartbeats", maxHeartbeatsPerRequest))
+		return
+	}
+
+	salt, err := s.settings.EnsureEntitySalt(r.Context(), discordID)
+	if err != nil {
+		slog.Error("ユーザー設定の取得に失敗しました", "step", "wakatime", "discord_id", discordID, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to load settings")
+		return
+	}
+	counts := make(map[string]int)
+	defer recordMetrics(counts)
+	responses := make([][]interface{}, 0, len(heartbeats))
+	for _, heartbeat := range heartbeats {
+		data, status, err := s.storeWakaTimeHeartbeat(r, discordID, salt, heartbeat, counts)
+		if err != nil {
+			responses = append(responses, []interface{}{map[string]string{"error": err.Error()}, status})
+			continue
+		}
+		responses = append(responses, []interface{}{map[string]interface{}{"data": data}, status})
+	}
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"responses": responses})
+}
+
+// 重複として破棄したハートビートは再送されないよう 202 を返す
+func (s *Server) storeWakaTimeHeartbeat(r *http.Request, discordID, salt string, heartbeat wakaTimeHeartbeat, counts map[string]int) (*wakaTimeHeartbeatData, int, error) {
+	if heartbeat.Time <= 0 || math.IsInf(heartbeat.Time, 0) || math.IsNaN(heartbeat.Time) {
+		counts[resultInvalid]++
+		return nil, http.StatusBadRequest, errors.New("time must be a unix timestamp")
+	}
+	seconds, fraction := math.Modf(heartbeat.Time)
+	timestamp := time.Unix(int64(seconds), int64(fraction*float64(time.Second)))
+
+	request := HeartbeatRequest{
+		Language: unknownLanguage,
+		Project:  stringValue(heartbeat.Project),
+		Branch:   stringValue(heartbeat.Branch),
+		IsWrite:  heartbeat.IsWrite,
+		Machine:  r.Header.Get("X-Machine-Name"),
+	}
+	if heartbeat.Language != nil && strings.TrimSpace(*heartbeat.Language) != "" {
+		request.Language = normalizeWakaTimeLanguage(*heartbeat.Language)
+	}
+	// アプリやドメインの場合はファイルではないため entity を保存しない
+	if heartbeat.Type == "" || heartbeat.Type == "file" {
+		request.Entity = heartbeat.Entity
+	}
+	userAgent := heartbeat.UserAgent
+	if userAgent == "" {
+		userAgent = r.Header.Get("User-Agent")
+	}
+	request.Editor = editorFromUserAgent(userAgent)
+
+	record, err := s.buildHeartbeat(discordID, salt, timestamp, request)
+	if err != nil {
+		counts[resultInvalid]++
+		return nil, http.StatusBadRequest, err
+	}
+	result := s.ingest(r.Context(), record, timestamp)
+	counts[result]++
+	data := &wakaTimeHeartbeatData{ID: record.Timestamp, wakaTimeHeartbeat: heartbeat}
+	switch result {
+	case resultAccepted:
+		return data, http.StatusCreated, nil
+	case resultDuplicate:
+		return data, http.StatusAccepted, nil
+	case resultRateLimited:
+		return nil, http.StatusTooManyRequests, errors.New(resultMessage(result))
+	}
+	return nil, http.StatusInternalServerError, errors.New(resultMessage(result))
+}
+
+func stringValue(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
+
+// "wakatime/v1.73.1 (linux-x86_64) go1.20 vscode/1.77.0 vscode-wakatime/24.0.0" の
+// 最後のプラグイン名からエディタ名を取り出す
+func editorFromUserAgent(userAgent string) string {
+	fields := strings.Fields(userAgent)
+	if len(fields) == 0 {
+		return ""
+	}
+	plugin, _, _ := strings.Cut(fields[len(fields)-1], "/")
+	editor, ok := strings.CutSuffix(strings.ToLower(plugin), "-wakatime")
+	if !ok {
+		return ""
+	}
+	return editor
+}
+
+func normalizeWakaTimeLanguage(language string) string {
+	language = strings.ToLower(strings.TrimSpace(language))
+	if mapped, ok := wakaTimeLanguages[language]; ok {
+		return mapped
+	}
+	return language
+}
+
+// 今日（TimeZone ヘッダーのタイムゾーン、省略時は UTC）の作業時間を返す
+func (s *Server) handleStatusBarToday(w http.ResponseWriter, r *http.Request, discordID string) {
+	location := time.UTC
+	if name := r.Header.Get("TimeZone"); name != "" {
+		loaded, err := time.LoadLocation(name)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "unknown time zone")
+			return
+		}
+		location = loaded
+	}
+
+	now := s.now().In(location)
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+	end := start.AddDate(0, 0, 1)
+
+	heartbeats, err := s.heartbeats.QueryHeartbeats(r.Context(), discordID, start, end)
+	if err != nil {
+		slog.Error("ハートビートの取得に失敗しました", "step", "status_bar", "discord_id", discordID, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to load heartbeats")
+		return
+	}
+
+	// ランキングと同じセッションの計算で、今日の作業時間を集計する
+	sessions, languageDurations, _ := insight.CalculateSessionTimes(insight.ToHeartbeats(heartbeats, nil))
+	total := insight.TotalWorkTime(sessions)
+	summary := wakaTimeStatusBar{
+		GrandTotal: newWakaTimeDuration("", total, total),
+		Categories: []wakaTimeDuration{},
+		Languages:  []wakaTimeDuration{},
+		Range: wakaTimeRange{
+			Date:     start.Format("2006-01-02"),
+			Start:    start.Format(time.RFC3339),
+			End:      end.Add(-time.Second).Format(time.RFC3339),
+			Text:     "Today",
+			Timezone: location.String(),
+		},
+	}
+	if total > 0 {
+		summary.Categories = append(summary.Categories, newWakaTimeDuration("Coding", total, total))
+	}
+	for language, duration := range languageDurations {
+		summary.Languages = append(summary.Languages, newWakaTimeDuration(language, duration, total))
+	}
+	sort.Slice(summary.Languages, func(i, j int) bool {
+		return summary.Languages[i].TotalSeconds > summary.Languages[j].TotalSeconds
+	})
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data":      summary,
+		"cached_at": s.now().UTC().Format(time.RFC3339),
+	})
+}
+
+func newWakaTimeDuration(name string, duration, total time.Duration) wakaTimeDuration {
+	hours := int(duration.Hours())
+	minutes := int(duration.Minutes()) % 60
+	result := wakaTimeDuration{
+		Name:         name,
+		TotalSeconds: duration.Seconds(),
+		Digital:      fmt.Sprintf("%d:%02d", hours, minutes),
+		Decimal:      fmt.Sprintf("%.2f", duration.Hours()),
+		Text:         wakaTimeText(hours, minutes),
+		Hours:        hours,
+		Minutes:      minutes,
+	}
+	if name != "" && total > 0 {
+		result.Percent = math.Round(float64(duration)/float64(total)*10000) / 100
+	}
+	return result
+}
+
+// WakaTime と同じ "1 hr 5 mins" 形式
+func wakaTimeText(hours, minutes int) string {
+	var parts []string
+	if hours > 0 {
+		unit := "hrs"
+		if hours == 1 {
+			unit = "hr"
+		}
+		parts = append(parts, fmt.Sprintf("%d %s", hours, unit))
+	}
+	if minutes > 0 || hours == 0 {
+		unit := "mins"
+		if minutes == 1 {
+			unit = "min"
+		}
+		parts = append(parts, fmt.Sprintf("%d %s", minutes, unit))
+	}
+	return strings.Join(parts, " ")
+}
+
+func decodeBody(r *http.Request, value interface{}) error {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodyBytes+1))
+	if err != nil {
+		return errors.New("failed to read body")
+	}
+	if len(body) > maxBodyBytes {
+		return errors.New("body too large")
+	}
+	if err := json.Unmarshal(body, value); err != nil {
+		return errors.New("invalid JSON")
+	}
+	return nil
+}
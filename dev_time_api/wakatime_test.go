@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kkaiki/DevInsight/internal/insight"
+)
+
+// wakatime-cli と同じ Basic 認証でリクエストする
+func serveWakaTime(s *Server, method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(testToken)))
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func wakaTimeJSON(timestamp time.Time, fields string) string {
+	return fmt.Sprintf(`{"entity": "/src/main.go", "type": "file", "time": %d.5%s}`, timestamp.Unix(), fields)
+}
+
+func TestHandleWakaTimeHeartbeat(t *testing.T) {
+	tests := []struct {
+		name   string
+		bodies []string // 最後のリクエストのステータスを確認する
+		want   int
+	}{
+		{"accepted", []string{wakaTimeJSON(testNow, "")}, http.StatusCreated},
+		{"duplicate", []string{wakaTimeJSON(testNow, ""), wakaTimeJSON(testNow.Add(10*time.Second), "")}, http.StatusAccepted},
+		{"zero time", []string{`{"entity": "/src/main.go", "time": 0}`}, http.StatusBadRequest},
+		{"string time", []string{`{"entity": "/src/main.go", "time": "now"}`}, http.StatusBadRequest},
+		{"too old", []string{wakaTimeJSON(testNow.Add(-maxHeartbeatAge-time.Hour), "")}, http.StatusBadRequest},
+		{"in the future", []string{wakaTimeJSON(testNow.Add(maxClockSkew+time.Minute), "")}, http.StatusBadRequest},
+		{"invalid field", []string{wakaTimeJSON(testNow, `, "project": "a\u0000b"`)}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t)
+			var w *httptest.ResponseRecorder
+			for _, body := range tt.bodies {
+				w = serveWakaTime(s, http.MethodPost, "/api/v1/users/current/heartbeats", body, nil)
+			}
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want >= http.StatusBadRequest {
+				return
+			}
+			var response struct {
+				Data wakaTimeHeartbeatData `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Data.ID == "" || response.Data.Entity != "/src/main.go" {
+				t.Errorf("data = %+v, want the heartbeat with an id", response.Data)
+			}
+		})
+	}
+}
+
+func TestHandleWakaTimeHeartbeatStoresHeartbeat(t *testing.T) {
+	tests := []struct {
+		name    string
+		fields  string
+		headers map[string]string
+		want    insight.InsightData
+	}{
+		{
+			name:   "file",
+			fields: `, "language": "C#", "project": "devinsight", "branch": "main", "is_write": true`,
+			headers: map[string]string{
+				"User-Agent":     "wakatime/v1.73.1 (linux-x86_64) go1.20 vscode/1.77.0 vscode-wakatime/24.0.0",
+				"X-Machine-Name": "laptop",
+			},
+			want: insight.InsightData{
+				Language: "csharp",
+				Project:  "devinsight",
+				Branch:   "main",
+				Editor:   "vscode",
+				Machine:  "laptop",
+				Entity:   hashEntity("salt-"+testDiscordID, "/src/main.go"),
+				IsWrite:  true,
+			},
+		},
+		{
+			name:   "user agent in the body",
+			fields: `, "language": "Go", "user_agent": "wakatime/v1.73.1 neovim/0.9.0 vim-wakatime/11.0.0"`,
+			want: insight.InsightData{
+				Language: "go",
+				Editor:   "vim",
+				Entity:   hashEntity("salt-"+testDiscordID, "/src/main.go"),
+			},
+		},
+		{
+			name:   "app",
+			fields: `, "type": "app", "language": ""`,
+			want:   insight.InsightData{Language: unknownLanguage},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, store := newTestServer(t)
+			w := serveWakaTime(s, http.MethodPost, "/api/v1/users/current/heartbeats", wakaTimeJSON(testNow, tt.fields), tt.headers)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			want := tt.want
+			want.DiscordID = testDiscordID
+			want.Timestamp = "2024-04-01T12:00:00.500Z"
+			want.ExpiresAt = testNow.Add(500*time.Millisecond).AddDate(0, 0, defaultRetentionDays).Unix()
+			for _, heartbeat := range store.items {
+				if heartbeat != want {
+					t.Errorf("stored %+v, want %+v", heartbeat, want)
+				}
+			}
+			if len(store.items) != 1 {
+				t.Errorf("stored %d heartbeats, want 1", len(store.items))
+			}
+		})
+	}
+}
+
+func TestHandleWakaTimeBulk(t *testing.T) {
+	s, store := newTestServer(t)
+	body := "[" + strings.Join([]string{
+		wakaTimeJSON(testNow.Add(-time.Minute), ""),
+		wakaTimeJSON(testNow.Add(-50*time.Second), ""),
+		`{"entity": "/src/main.go", "time": 0}`,
+		wakaTimeJSON(testNow, `, "entity": "/src/util.go"`),
+	}, ",") + "]"
+	w := serveWakaTime(s, http.MethodPost, "/api/v1/users/current/heartbeats.bulk", body, nil)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+	var response struct {
+		Responses [][]json.RawMessage `json:"responses"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	want := []int{http.StatusCreated, http.StatusAccepted, http.StatusBadRequest, http.StatusCreated}
+	if len(response.Responses) != len(want) {
+		t.Fatalf("got %d responses, want %d", len(response.Responses), len(want))
+	}
+	for i, item := range response.Responses {
+		var status int
+		if len(item) != 2 || json.Unmarshal(item[1], &status) != nil || status != want[i] {
+			t.Errorf("responses[%d] = %s, want status %d", i, item, want[i])
+		}
+	}
+	if len(store.items) != 2 {
+		t.Errorf("stored %d heartbeats, want 2", len(store.items))
+	}
+
+	for _, body := range []string{"[]", "{}", "[" + strings.Repeat(wakaTimeJSON(testNow, "")+",", maxHeartbeatsPerRequest) + wakaTimeJSON(testNow, "") + "]"} {
+		if w := serveWakaTime(s, http.MethodPost, "/api/v1/users/current/heartbeats.bulk", body, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestHandleStatusBarToday(t *testing.T) {
+	s, store := newTestServer(t)
+	for _, heartbeat := range []struct {
+		timestamp string
+		language  string
+	}{
+		// 日本時間の今日、UTC の昨日
+		{"2024-03-31T23:58:00.000Z", "go"},
+		{"2024-03-31T23:59:00.000Z", "go"},
+		{"2024-04-01T10:00:00.000Z", "go"},
+		{"2024-04-01T10:03:00.000Z", "go"},
+		{"2024-04-01T10:06:00.000Z", "go"},
+		{"2024-04-01T11:00:00.000Z", "python"},
+		{"2024-04-01T11:02:00.000Z", "python"},
+	} {
+		store.items[testDiscordID+"\x00"+heartbeat.timestamp] = insight.InsightData{
+			DiscordID: testDiscordID,
+			Timestamp: heartbeat.timestamp,
+			Language:  heartbeat.language,
+		}
+	}
+
+	tests := []struct {
+		timeZone      string
+		wantStatus    int
+		wantDate      string
+		wantTotal     string
+		wantLanguages []string
+	}{
+		{"", http.StatusOK, "2024-04-01", "0:08", []string{"go 6 mins 75", "python 2 mins 25"}},
+		{"Asia/Tokyo", http.StatusOK, "2024-04-01", "0:09", []string{"go 7 mins 77.78", "python 2 mins 22.22"}},
+		{"Pacific/Honolulu", http.StatusOK, "2024-04-01", "0:08", []string{"go 6 mins 75", "python 2 mins 25"}},
+		{"Mars/Olympus", http.StatusBadRequest, "", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.timeZone, func(t *testing.T) {
+			w := serveWakaTime(s, http.MethodGet, "/api/v1/users/current/status_bar/today", "", map[string]string{"TimeZone": tt.timeZone})
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var response struct {
+				Data wakaTimeStatusBar `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Data.Range.Date != tt.wantDate || response.Data.GrandTotal.Digital != tt.wantTotal {
+				t.Errorf("date = %s, total = %s, want %s and %s", response.Data.Range.Date, response.Data.GrandTotal.Digital, tt.wantDate, tt.wantTotal)
+			}
+			var languages []string
+			for _, language := range response.Data.Languages {
+				languages = append(languages, fmt.Sprintf("%s %s %v", language.Name, language.Text, language.Percent))
+			}
+			if strings.Join(languages, ", ") != strings.Join(tt.wantLanguages, ", ") {
+				t.Errorf("languages = %v, want %v", languages, tt.wantLanguages)
+			}
+		})
+	}
+}
+
+func TestWakaTimeAuthentication(t *testing.T) {
+	s, _ := newTestServer(t)
+	tests := []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{"basic", "Basic " + base64.StdEncoding.EncodeToString([]byte(testToken)), http.StatusOK},
+		{"basic with a colon", "Basic " + base64.StdEncoding.EncodeToString([]byte(testToken+":")), http.StatusOK},
+		{"unknown token", "Basic " + base64.StdEncoding.EncodeToString([]byte("waka_unknown")), http.StatusUnauthorized},
+		{"missing", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/users/current/status_bar/today", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestEditorFromUserAgent(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		want      string
+	}{
+		{"wakatime/v1.73.1 (linux-x86_64) go1.20 vscode/1.77.0 vscode-wakatime/24.0.0", "vscode"},
+		{"wakatime/v1.73.1 (darwin-arm64) go1.20 JetBrains-WakaTime/14.0.0", "jetbrains"},
+		{"wakatime/v1.73.1 (linux-x86_64) go1.20", ""},
+		{"curl/8.0.0", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := editorFromUserAgent(tt.userAgent); got != tt.want {
+			t.Errorf("editorFromUserAgent(%q) = %q, want %q", tt.userAgent, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeWakaTimeLanguage(t *testing.T) {
+	tests := []struct {
+		language string
+		want     string
+	}{
+		{"Go", "go"},
+		{"C#", "csharp"},
+		{"C++", "cpp"},
+		{" Shell Script ", "shellscript"},
+		{"Bash", "shellscript"},
+		{"TSX", "typescriptreact"},
+		{"Text", "plaintext"},
+		{"Haskell", "haskell"},
+	}
+	for _, tt := range tests {
+		if got := normalizeWakaTimeLanguage(tt.language); got != tt.want {
+			t.Errorf("normalizeWakaTimeLanguage(%q) = %q, want %q", tt.language, got, tt.want)
+		}
+	}
+}
+
+func TestWakaTimeText(t *testing.T) {
+	tests := []struct {
+		hours, minutes int
+		want           string
+	}{
+		{0, 0, "0 mins"},
+		{0, 1, "1 min"},
+		{0, 45, "45 mins"},
+		{1, 0, "1 hr"},
+		{1, 5, "1 hr 5 mins"},
+		{2, 1, "2 hrs 1 min"},
+	}
+	for _, tt := range tests {
+		if got := wakaTimeText(tt.hours, tt.minutes); got != tt.want {
+			t.Errorf("wakaTimeText(%d, %d) = %q, want %q", tt.hours, tt.minutes, got, tt.want)
+		}
+	}
+}
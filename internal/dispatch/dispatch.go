@@ -0,0 +1,65 @@
+// Package dispatch はイベントの action で、1つの Lambda からランキング・ロール付与・データ削除とそれらをまとめた処理を実行する
+package dispatch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/kkaiki/DevInsight/internal/insight"
+	"github.com/kkaiki/DevInsight/internal/pipeline"
+	"github.com/kkaiki/DevInsight/internal/purge"
+	"github.com/kkaiki/DevInsight/internal/ranking"
+	"github.com/kkaiki/DevInsight/internal/roles"
+)
+
+// EventBridge のルールで指定する action
+const (
+	ActionRanking  = "ranking"  // {"action":"ranking","period":"weekly"}
+	ActionRoles    = "roles"    // {"action":"roles"}
+	ActionPurge    = "purge"    // {"action":"purge","scopes":[...]} など、データ削除のイベントと同じ項目
+	ActionCombined = "combined" // {"action":"combined","consumers":["ranking","roles"]} 集計を共有して複数の処理を実行
+)
+
+// 関数 URL からのスラッシュコマンドのログに付ける action
+const actionInteraction = "interaction"
+
+// Lambda のハンドラー。action 以外の項目はそれぞれの処理のイベントとして解釈する
+func Handle(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	var event struct {
+		Action         string          `json:"action"`
+		RequestContext json.RawMessage `json:"requestContext"`
+	}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, fmt.Errorf("イベントの形式が不正です: %v", err)
+	}
+	// 関数 URL からのリクエストは Discord のスラッシュコマンド（データのエクスポート・削除）
+	if event.RequestContext != nil {
+		ctx = insight.StartRun(ctx, actionInteraction)
+		return purge.HandleInvoke(ctx, payload)
+	}
+
+	// 以降のログに実行ID（Lambda のリクエストID）と action を付ける
+	ctx = insight.StartRun(ctx, event.Action)
+	slog.Info("イベントを受け取りました")
+	switch event.Action {
+	case ActionRanking:
+		var rankingEvent ranking.RankingEvent
+		if err := json.Unmarshal(payload, &rankingEvent); err != nil {
+			return nil, fmt.Errorf("イベントの形式が不正です: %v", err)
+		}
+		return nil, ranking.HandleRequest(ctx, rankingEvent)
+	case ActionRoles:
+		return nil, roles.Run(ctx, roles.Options{Apply: true})
+	case ActionPurge:
+		return purge.HandleInvoke(ctx, payload)
+	case ActionCombined:
+		var pipelineEvent pipeline.Event
+		if err := json.Unmarshal(payload, &pipelineEvent); err != nil {
+			return nil, fmt.Errorf("イベントの形式が不正です: %v", err)
+		}
+		return pipeline.Run(ctx, pipelineEvent, pipeline.Options{Apply: true})
+	}
+	return nil, fmt.Errorf("不明な action です: %q（%s, %s, %s, %s のいずれかを指定してください）", event.Action, ActionRanking, ActionRoles, ActionPurge, ActionCombined)
+}
@@ -0,0 +1,310 @@
+package insight
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// ユーザーごとの集計結果。ランキング・ロール付与・DM・エクスポートで共通に使う
+type DiscordWorkTime struct {
+	DiscordID string
+	TotalTime time.Duration
+	Languages map[string]time.Duration
+	Projects  map[string]time.Duration
+	Anomalies []Anomaly     // 検出した不自然な作業記録
+	Settings  *UserSettings // 集計に適用したユーザー設定
+
+	// 本人向けの集計（DM）。ランキングに含めないプロジェクトも含め、プロジェクト名を隠さない
+	PersonalTotalTime time.Duration
+	PersonalLanguages map[string]time.Duration
+	PersonalProjects  map[string]time.Duration
+}
+
+// 言語のマッピングを取得
+func getLanguageMapping() map[string]string {
+	mergeLanguages := os.Getenv("MERGE_LANGUAGES")
+	slog.Debug("言語のマッピング", "merge_languages", mergeLanguages)
+	mapping := make(map[string]string)
+	pairs := strings.Split(mergeLanguages, ",")
+	for _, pair := range pairs {
+		kv := strings.Split(pair, ":")
+		if len(kv) == 2 {
+			mapping[kv[0]] = kv[1]
+		}
+	}
+	return mapping
+}
+
+func getDiscordIDAndTimes(ctx context.Context, svc *dynamodb.DynamoDB, discordID string, since time.Time, languageMapping map[string]string) ([]Heartbeat, error) {
+	items, err := QueryHeartbeats(ctx, svc, discordID, since, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	heartbeats := ToHeartbeats(items, func(language string) string {
+		if mappedLanguage, ok := languageMapping[language]; ok {
+			return mappedLanguage // 言語のマッピングを適用
+		}
+		return language
+	})
+	return heartbeats, nil
+}
+
+// 同時に集計するユーザー数の既定値（AGGREGATE_CONCURRENCY で変更する）
+const defaultAggregateConcurrency = 8
+
+// 集計を打ち切ってから Lambda の実行期限までに残す時間の既定値（DELIVERY_RESERVE_SECONDS で変更する）
+const defaultDeliveryReserve = 30 * time.Second
+
+// 集計に使うコンテキスト。ctx に実行期限がある場合は、投稿などに使う時間を残して集計を打ち切る
+// データの削除・復元・エクスポートでも、途中までの結果と監査記録を返す時間を残すために使う
+func AggregateContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	reserve := time.Duration(GetEnvInt("DELIVERY_RESERVE_SECONDS", int(defaultDeliveryReserve/time.Second), 1)) * time.Second
+	slog.Debug("集計の期限", "deadline", deadline.Add(-reserve).Format(time.RFC3339), "reserve", reserve)
+	return context.WithDeadline(ctx, deadline.Add(-reserve))
+}
+
+// 集計の結果
+type Aggregation struct {
+	From, To time.Time         // 集計した期間
+	Data     []DiscordWorkTime // 作業時間の長い順
+	Personal []DiscordWorkTime // ランキングの対象の作業がなく、本人向けの集計（Personal*）だけがあるユーザー。DM にだけ使う
+	Failures []UserError       // 集計に失敗したユーザー
+	Skipped  []string          // 期限までに集計できなかったユーザー
+}
+
+// 期限までにすべてのユーザーを集計できなかったか
+func (a *Aggregation) Partial() bool {
+	return len(a.Skipped) > 0
+}
+
+// 集計できなかったユーザーとその理由
+type UserError struct {
+	DiscordID string
+	Err       error
+}
+
+func (e UserError) Error() string {
+	return fmt.Sprintf("%s: %v", e.DiscordID, e.Err)
+}
+
+func (e UserError) Unwrap() error {
+	return e.Err
+}
+
+// すべてのユーザーに適用する集計の設定
+type aggregateRules struct {
+	since           time.Time
+	languageMapping map[string]string
+	antiCheat       AntiCheatConfig
+	fairness        FairnessRules
+}
+
+// since 以降にハートビートを送信した全ユーザーの作業時間を集計し、作業時間の長い順に返す
+// ユーザー設定・不自然な作業記録への対応・集計ルールを適用する
+// ユーザーごとの集計は AGGREGATE_CONCURRENCY 人ずつ並行して行い、失敗したユーザーは除いて Failures に入れる
+// ctx が期限切れ・キャンセルになった場合は、それまでに集計できたユーザーだけを返し、残りを Skipped に入れる
+func Aggregate(ctx context.Context, svc *dynamodb.DynamoDB, since time.Time) (*Aggregation, error) {
+	// 1. Discord IDの取得
+	discordIDs, err := ActiveDiscordIDs(ctx, svc, since)
+	if err != nil {
+		return nil, fmt.Errorf("集計対象の Discord IDの取得に失敗: %w", err)
+	}
+	slog.Info("集計対象のユーザーを取得しました", "step", "aggregate", "users", len(discordIDs), "since", since.Format(time.RFC3339))
+
+	aggregation := &Aggregation{From: since, To: time.Now().UTC()}
+	if len(discordIDs) == 0 {
+		slog.Warn("対象期間内のデータが見つかりません", "step", "aggregate")
+		return aggregation, nil
+	}
+
+	// 2. 各ユーザーの言語ごとの時間データ取得
+	rules := aggregateRules{
+		since:           since,
+		languageMapping: getLanguageMapping(),
+		antiCheat:       GetAntiCheatConfig(),
+		fairness:        GetFairnessRules(),
+	}
+	concurrency := GetEnvInt("AGGREGATE_CONCURRENCY", defaultAggregateConcurrency, 1)
+	aggregateUsers(ctx, aggregation, discordIDs, concurrency, func(discordID string) (*DiscordWorkTime, bool, error) {
+		return aggregateUser(ctx, svc, discordID, rules)
+	})
+	return aggregation, nil
+}
+
+// discordIDs のユーザーを concurrency 人ずつ並行して aggregate で集計し、結果を aggregation に入れる
+// ctx が終了した場合は新しいユーザーを集計せず、未集計のユーザーを Skipped に入れる
+func aggregateUsers(ctx context.Context, aggregation *Aggregation, discordIDs []string, concurrency int, aggregate func(discordID string) (*DiscordWorkTime, bool, error)) {
+	if concurrency > len(discordIDs) {
+		concurrency = len(discordIDs)
+	}
+	slog.Debug("ユーザーごとの集計を開始します", "step", "aggregate", "users", len(discordIDs), "concurrency", concurrency)
+
+	type userResult struct {
+		discordID string
+		entry     *DiscordWorkTime
+		ranked    bool
+		err       error
+	}
+	jobs := make(chan string)
+	results := make(chan userResult)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for discordID := range jobs {
+				entry, ranked, err := aggregate(discordID)
+				results <- userResult{discordID: discordID, entry: entry, ranked: ranked, err: err}
+			}
+		}()
+	}
+	// キャンセルされた場合は、処理中のユーザーを待って新しいユーザーを渡さない
+	go func() {
+		defer close(jobs)
+		for _, discordID := range discordIDs {
+			select {
+			case jobs <- discordID:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	processed := make(map[string]bool)
+	for result := range results {
+		// 期限切れで中断したユーザーは失敗ではなく未集計として扱う
+		if result.err != nil && ctx.Err() != nil {
+			continue
+		}
+		processed[result.discordID] = true
+		if result.err != nil {
+			slog.Error("ユーザーの集計に失敗", "step", "aggregate", "discord_id", result.discordID, "error", result.err)
+			aggregation.Failures = append(aggregation.Failures, UserError{DiscordID: result.discordID, Err: result.err})
+			continue
+		}
+		switch {
+		case result.entry == nil:
+		case result.ranked:
+			aggregation.Data = append(aggregation.Data, *result.entry)
+		default:
+			aggregation.Personal = append(aggregation.Personal, *result.entry)
+		}
+	}
+	for _, discordID := range discordIDs {
+		if !processed[discordID] {
+			aggregation.Skipped = append(aggregation.Skipped, discordID)
+		}
+	}
+	if aggregation.Partial() {
+		slog.Warn("集計を打ち切りました", "step", "aggregate", "reason", ctx.Err(), "skipped", len(aggregation.Skipped), "users", len(discordIDs))
+	}
+	if len(aggregation.Failures) > 0 {
+		slog.Warn("集計できなかったユーザーがいます", "step", "aggregate", "failed", len(aggregation.Failures), "users", len(discordIDs))
+	}
+
+	if len(aggregation.Data) == 0 {
+		slog.Warn("集計可能なデータが見つかりません", "step", "aggregate")
+		return
+	}
+
+	// 作業時間でソート（並行して集計するため、同じ時間のユーザーは Discord ID 順）
+	data := aggregation.Data
+	sort.Slice(data, func(i, j int) bool {
+		if data[i].TotalTime != data[j].TotalTime {
+			return data[i].TotalTime > data[j].TotalTime
+		}
+		return data[i].DiscordID < data[j].DiscordID
+	})
+}
+
+// 1人分の集計。集計するハートビートがない場合は nil
+// ランキングの対象のハートビートがない場合は、本人向けの集計だけを入れて ranked を false にする
+func aggregateUser(ctx context.Context, svc *dynamodb.DynamoDB, discordID string, rules aggregateRules) (entry *DiscordWorkTime, ranked bool, err error) {
+	started := time.Now()
+	heartbeats, err := getDiscordIDAndTimes(ctx, svc, discordID, rules.since, rules.languageMapping)
+	if err != nil {
+		return nil, false, fmt.Errorf("言語データの取得失敗: %w", err)
+	}
+	slog.Debug("ハートビートを取得しました", "discord_id", discordID, "heartbeats", len(heartbeats))
+
+	// 設定を確認できない場合は、非公開のプロジェクトを表示しないよう集計から除外する
+	settings, err := GetUserSettings(ctx, svc, discordID)
+	if err != nil {
+		return nil, false, err
+	}
+	// ランキングに含めないプロジェクトは本人向けの集計には含めるため、設定を適用する前のハートビートを残す
+	personal := heartbeats
+	heartbeats = ApplyUserSettings(settings, heartbeats)
+
+	anomalies, heartbeats := rules.detectAnomalies(heartbeats)
+	if len(anomalies) > 0 {
+		slog.Warn("不自然な作業記録を検出しました", "discord_id", discordID, "anomalies", len(anomalies), "anti_cheat_action", rules.antiCheat.Action)
+	}
+
+	// 本人向けの集計にも同じ上限・集計ルールを適用し、ランキングの時間と比べられるようにする
+	_, personal = rules.detectAnomalies(personal)
+	if len(personal) == 0 {
+		return nil, false, nil
+	}
+	personalSessions, personalLanguages, personalProjects := rules.workTime(personal)
+	entry = &DiscordWorkTime{
+		DiscordID:         discordID,
+		Anomalies:         anomalies,
+		Settings:          settings,
+		PersonalTotalTime: TotalWorkTime(personalSessions),
+		PersonalLanguages: personalLanguages,
+		PersonalProjects:  personalProjects,
+	}
+
+	// すべてのプロジェクトをランキングに含めないユーザーは、本人向けの集計だけを返す（ランキング・ロールには含めない）
+	if len(heartbeats) == 0 {
+		slog.Info("本人向けの集計だけを行いました", "step", "aggregate", "discord_id", discordID, "personal_total_time", entry.PersonalTotalTime, "duration", time.Since(started))
+		return entry, false, nil
+	}
+	sessionTimes, languageDurations, projectDurations := rules.workTime(heartbeats)
+	entry.TotalTime = TotalWorkTime(sessionTimes)
+	entry.Languages = languageDurations
+	entry.Projects = projectDurations
+
+	slog.Info("ユーザーを集計しました", "step", "aggregate", "discord_id", discordID, "total_time", entry.TotalTime, "sessions", len(sessionTimes), "duration", time.Since(started))
+	return entry, true, nil
+}
+
+// 不自然な作業記録を検出し、集計に使うハートビートを返す（cap の場合は上限を超えた分を除く）
+func (rules aggregateRules) detectAnomalies(heartbeats []Heartbeat) ([]Anomaly, []Heartbeat) {
+	if rules.antiCheat.Action == AntiCheatOff {
+		return nil, heartbeats
+	}
+	anomalies, credited := DetectAnomalies(heartbeats, rules.antiCheat)
+	if rules.antiCheat.Action == AntiCheatCap {
+		return anomalies, credited
+	}
+	return anomalies, heartbeats
+}
+
+// セッションに分け、集計ルールを適用した作業時間
+func (rules aggregateRules) workTime(heartbeats []Heartbeat) ([]SessionTime, map[string]time.Duration, map[string]time.Duration) {
+	sessionTimes, languageDurations, projectDurations := CalculateSessionTimes(heartbeats)
+	if rules.fairness.Enabled() {
+		sessionTimes = ApplyFairnessRules(sessionTimes, rules.fairness)
+		languageDurations, projectDurations = SummarizeSessions(sessionTimes)
+	}
+	return sessionTimes, languageDurations, projectDurations
+}
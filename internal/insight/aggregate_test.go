@@ -0,0 +1,196 @@
+package insight
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ユーザーごとの集計結果（aggregateUser の代わり）
+type fakeUser struct {
+	total    time.Duration
+	personal bool  // 本人向けの集計だけ
+	empty    bool  // 集計するハートビートがない
+	err      error // 集計に失敗する
+	cancel   bool  // 集計中に期限切れになる
+}
+
+func TestAggregateUsers(t *testing.T) {
+	storeErr := &AppError{Kind: KindStore, Message: "ハートビートの取得に失敗", Err: errors.New("throttled")}
+	tests := []struct {
+		name         string
+		users        []string
+		fakes        map[string]fakeUser
+		concurrency  int
+		canceled     bool // 集計を始める前に期限切れになっている
+		wantData     []string
+		wantPersonal []string
+		wantFailures []string
+		wantSkipped  []string
+	}{
+		{
+			name:  "all users",
+			users: []string{"a", "b", "c", "d", "e"},
+			fakes: map[string]fakeUser{
+				"a": {total: time.Hour},
+				"b": {total: 3 * time.Hour},
+				"c": {total: time.Hour},
+				"d": {personal: true},
+				"e": {empty: true},
+			},
+			concurrency:  3,
+			wantData:     []string{"b", "a", "c"},
+			wantPersonal: []string{"d"},
+		},
+		{
+			name:  "failed users are excluded",
+			users: []string{"a", "b", "c"},
+			fakes: map[string]fakeUser{
+				"a": {total: time.Hour},
+				"b": {err: storeErr},
+				"c": {personal: true, err: errors.New("invalid settings")},
+			},
+			concurrency:  2,
+			wantData:     []string{"a"},
+			wantFailures: []string{"b", "c"},
+		},
+		{
+			name:  "all users failed",
+			users: []string{"a", "b"},
+			fakes: map[string]fakeUser{
+				"a": {err: storeErr},
+				"b": {err: storeErr},
+			},
+			concurrency:  8,
+			wantFailures: []string{"a", "b"},
+		},
+		{
+			name:  "deadline during aggregation",
+			users: []string{"a", "b", "c", "d"},
+			fakes: map[string]fakeUser{
+				"a": {total: time.Hour},
+				"b": {cancel: true},
+				"c": {total: time.Hour},
+				"d": {total: time.Hour},
+			},
+			concurrency: 1,
+			wantData:    []string{"a"},
+			wantSkipped: []string{"b", "c", "d"},
+		},
+		{
+			name:        "deadline before aggregation",
+			users:       []string{"a", "b"},
+			fakes:       map[string]fakeUser{"a": {total: time.Hour}, "b": {total: time.Hour}},
+			concurrency: 2,
+			canceled:    true,
+			wantSkipped: []string{"a", "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.canceled {
+				cancel()
+			}
+			aggregation := &Aggregation{}
+			aggregateUsers(ctx, aggregation, tt.users, tt.concurrency, func(discordID string) (*DiscordWorkTime, bool, error) {
+				fake := tt.fakes[discordID]
+				if fake.cancel {
+					cancel()
+				}
+				switch {
+				case ctx.Err() != nil:
+					return nil, false, ctx.Err()
+				case fake.err != nil:
+					return nil, false, fake.err
+				case fake.empty:
+					return nil, false, nil
+				}
+				entry := &DiscordWorkTime{DiscordID: discordID, TotalTime: fake.total, PersonalTotalTime: time.Hour}
+				return entry, !fake.personal, nil
+			})
+
+			// Data は作業時間の長い順（同じ時間は Discord ID 順）
+			if got := workTimeIDs(aggregation.Data); got != strings.Join(tt.wantData, ",") {
+				t.Errorf("Data = %s, want %s", got, strings.Join(tt.wantData, ","))
+			}
+			if got := sortedIDs(workTimeIDs(aggregation.Personal)); got != strings.Join(tt.wantPersonal, ",") {
+				t.Errorf("Personal = %s, want %s", got, strings.Join(tt.wantPersonal, ","))
+			}
+			var failures []string
+			for _, failure := range aggregation.Failures {
+				failures = append(failures, failure.DiscordID)
+				if want := tt.fakes[failure.DiscordID].err; !errors.Is(failure, want) || KindOf(failure) != KindOf(want) {
+					t.Errorf("failure %v does not wrap %v", failure, want)
+				}
+			}
+			if got := sortedIDs(strings.Join(failures, ",")); got != strings.Join(tt.wantFailures, ",") {
+				t.Errorf("Failures = %s, want %s", got, strings.Join(tt.wantFailures, ","))
+			}
+			if got := strings.Join(aggregation.Skipped, ","); got != strings.Join(tt.wantSkipped, ",") {
+				t.Errorf("Skipped = %s, want %s", got, strings.Join(tt.wantSkipped, ","))
+			}
+			if aggregation.Partial() != (len(tt.wantSkipped) > 0) {
+				t.Errorf("Partial() = %v, want %v", aggregation.Partial(), len(tt.wantSkipped) > 0)
+			}
+		})
+	}
+}
+
+func TestRecordAggregation(t *testing.T) {
+	aggregation := &Aggregation{
+		Failures: []UserError{
+			{DiscordID: "a", Err: &AppError{Kind: KindStore, Message: "ハートビートの取得に失敗"}},
+			{DiscordID: "b", Err: errors.New("invalid settings")},
+		},
+		Skipped: []string{"c"},
+	}
+	summary := &RunSummary{}
+	summary.RecordAggregation(aggregation)
+	want := []Failure{
+		{Step: "aggregate", Target: "a", Kind: KindStore, Error: "StoreError: ハートビートの取得に失敗"},
+		{Step: "aggregate", Target: "b", Error: "invalid settings"},
+	}
+	if len(summary.Failures) != len(want) {
+		t.Fatalf("recorded %d failures, want %d", len(summary.Failures), len(want))
+	}
+	for i := range want {
+		if summary.Failures[i] != want[i] {
+			t.Errorf("Failures[%d] = %+v, want %+v", i, summary.Failures[i], want[i])
+		}
+	}
+	if strings.Join(summary.Skipped, ",") != "c" || !summary.Failed() {
+		t.Errorf("Skipped = %v, Failed() = %v, want [c] and true", summary.Skipped, summary.Failed())
+	}
+
+	// 集計がすべて成功した場合は失敗を記録しない
+	summary = &RunSummary{}
+	summary.RecordAggregation(&Aggregation{})
+	if summary.Failed() || len(summary.Skipped) != 0 {
+		t.Errorf("recorded %+v for a successful aggregation", summary)
+	}
+	var none *RunSummary
+	none.RecordAggregation(aggregation)
+}
+
+func workTimeIDs(entries []DiscordWorkTime) string {
+	var ids []string
+	for _, entry := range entries {
+		ids = append(ids, entry.DiscordID)
+	}
+	return strings.Join(ids, ",")
+}
+
+// 並行して集計するため順序が決まらない結果を Discord ID 順にする
+func sortedIDs(ids string) string {
+	if ids == "" {
+		return ""
+	}
+	list := strings.Split(ids, ",")
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
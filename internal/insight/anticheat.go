@@ -0,0 +1,191 @@
+package insight
+
+import (
+	"log/slog"
+	"os"
+	"sort"
+	"time"
+)
+
+// 不自然な作業記録への対応（ANTI_CHEAT_ACTION）
+const (
+	AntiCheatOff  = "off"
+	AntiCheatMark = "mark" // ランキングに印を付ける
+	AntiCheatCap  = "cap"  // 該当するハートビートを集計から除く
+)
+
+// 不自然な作業記録の種類
+const (
+	AnomalyLongSession  = "long_session"  // 長時間途切れないセッション
+	AnomalyPeriodic     = "periodic"      // 間隔が一定すぎるハートビート
+	AnomalyMultiMachine = "multi_machine" // 複数のマシンで別の言語を同時に作業
+)
+
+type AntiCheatConfig struct {
+	Action            string
+	MaxSession        time.Duration // これより長いセッション
+	PeriodicRun       int           // この回数以上間隔が一定
+	PeriodicTolerance time.Duration // 一定とみなす間隔の誤差
+	MaxOverlap        time.Duration // 同時作業の合計がこれ以上
+}
+
+type Anomaly struct {
+	Kind     string
+	Start    time.Time
+	End      time.Time
+	Count    int           // periodic: 連続した回数
+	Duration time.Duration // long_session: セッションの長さ, multi_machine: 同時作業の合計
+}
+
+func GetAntiCheatConfig() AntiCheatConfig {
+	config := AntiCheatConfig{
+		Action:            os.Getenv("ANTI_CHEAT_ACTION"),
+		MaxSession:        time.Duration(GetEnvInt("ANTI_CHEAT_MAX_SESSION_HOURS", 24, 1)) * time.Hour,
+		PeriodicRun:       GetEnvInt("ANTI_CHEAT_PERIODIC_RUN", 90, 1),
+		PeriodicTolerance: time.Duration(GetEnvInt("ANTI_CHEAT_PERIODIC_TOLERANCE_MS", 1000, 1)) * time.Millisecond,
+		MaxOverlap:        time.Duration(GetEnvInt("ANTI_CHEAT_MAX_OVERLAP_MINUTES", 30, 1)) * time.Minute,
+	}
+	// 誤検出でユーザーに印を付けないよう、明示的に有効にした場合だけ検出する
+	switch config.Action {
+	case AntiCheatOff, AntiCheatMark, AntiCheatCap:
+	case "":
+		config.Action = AntiCheatOff
+	default:
+		slog.Warn("ANTI_CHEAT_ACTION が不正なため検出しません", "value", config.Action)
+		config.Action = AntiCheatOff
+	}
+	return config
+}
+
+// 時刻順のハートビートから不自然な作業記録を検出し、検出した部分を除いたハートビートも返す
+func DetectAnomalies(heartbeats []Heartbeat, config AntiCheatConfig) ([]Anomaly, []Heartbeat) {
+	var anomalies []Anomaly
+	excluded := make(map[int]bool)
+
+	// 間隔が一定すぎるハートビート（自動入力など）。runStart からの間隔が最初の間隔と誤差以内で続く数を数える
+	runStart := 0
+	closeRun := func(end int) {
+		if intervals := end - runStart; intervals >= config.PeriodicRun {
+			anomalies = append(anomalies, Anomaly{
+				Kind:  AnomalyPeriodic,
+				Start: heartbeats[runStart].Time,
+				End:   heartbeats[end].Time,
+				Count: intervals,
+			})
+			for j := runStart; j <= end; j++ {
+				excluded[j] = true
+			}
+		}
+	}
+	for i := 1; i < len(heartbeats); i++ {
+		interval := heartbeats[i].Time.Sub(heartbeats[i-1].Time)
+		if interval > 5*time.Minute {
+			closeRun(i - 1)
+			runStart = i
+			continue
+		}
+		if i-runStart < 2 {
+			continue
+		}
+		diff := interval - heartbeats[runStart+1].Time.Sub(heartbeats[runStart].Time)
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff > config.PeriodicTolerance {
+			closeRun(i - 1)
+			runStart = i - 1
+		}
+	}
+	if len(heartbeats) > 0 {
+		closeRun(len(heartbeats) - 1)
+	}
+
+	// 複数のマシンで別の言語を同時に作業した時間。ハートビートは作業中2分ごとに送られるため5分単位で比べる
+	const overlapWindow = 5 * time.Minute
+	type windowActivity struct {
+		machines  map[string]bool
+		languages map[string]bool
+		indexes   []int
+	}
+	windows := make(map[int64]*windowActivity)
+	machineCounts := make(map[string]int)
+	for i, heartbeat := range heartbeats {
+		if heartbeat.Machine == "" {
+			continue
+		}
+		key := heartbeat.Time.Unix() / int64(overlapWindow/time.Second)
+		activity, ok := windows[key]
+		if !ok {
+			activity = &windowActivity{machines: make(map[string]bool), languages: make(map[string]bool)}
+			windows[key] = activity
+		}
+		activity.machines[heartbeat.Machine] = true
+		activity.languages[heartbeat.Language] = true
+		activity.indexes = append(activity.indexes, i)
+		machineCounts[heartbeat.Machine]++
+	}
+	var overlapKeys []int64
+	for key, activity := range windows {
+		if len(activity.machines) >= 2 && len(activity.languages) >= 2 {
+			overlapKeys = append(overlapKeys, key)
+		}
+	}
+	if overlap := time.Duration(len(overlapKeys)) * overlapWindow; len(overlapKeys) > 0 && overlap >= config.MaxOverlap {
+		sort.Slice(overlapKeys, func(i, j int) bool { return overlapKeys[i] < overlapKeys[j] })
+		anomalies = append(anomalies, Anomaly{
+			Kind:     AnomalyMultiMachine,
+			Start:    time.Unix(0, 0).Add(time.Duration(overlapKeys[0]) * overlapWindow).UTC(),
+			End:      time.Unix(0, 0).Add(time.Duration(overlapKeys[len(overlapKeys)-1]+1) * overlapWindow).UTC(),
+			Duration: overlap,
+		})
+		// 同時作業の時間は、最も多く使っているマシンのハートビートだけを残す
+		primary := ""
+		for machine, count := range machineCounts {
+			if count > machineCounts[primary] || (count == machineCounts[primary] && machine < primary) {
+				primary = machine
+			}
+		}
+		for _, key := range overlapKeys {
+			for _, i := range windows[key].indexes {
+				if heartbeats[i].Machine != primary {
+					excluded[i] = true
+				}
+			}
+		}
+	}
+
+	var credited []Heartbeat
+	for i, heartbeat := range heartbeats {
+		if !excluded[i] {
+			credited = append(credited, heartbeat)
+		}
+	}
+
+	// 長時間途切れないセッション。MaxSession を超えた部分を除く
+	var capped []Heartbeat
+	sessionStart := time.Time{}
+	for i, heartbeat := range credited {
+		if i == 0 || heartbeat.Time.Sub(credited[i-1].Time) > 5*time.Minute {
+			sessionStart = heartbeat.Time
+		}
+		if heartbeat.Time.Sub(sessionStart) <= config.MaxSession {
+			capped = append(capped, heartbeat)
+		}
+	}
+	sessions, _, _ := CalculateSessionTimes(heartbeats)
+	for _, session := range sessions {
+		if length := session.End.Sub(session.Start); length > config.MaxSession {
+			anomalies = append(anomalies, Anomaly{
+				Kind:     AnomalyLongSession,
+				Start:    session.Start,
+				End:      session.End,
+				Duration: length,
+			})
+		}
+	}
+
+	sort.Slice(anomalies, func(i, j int) bool {
+		return anomalies[i].Start.Before(anomalies[j].Start)
+	})
+	return anomalies, capped
+}
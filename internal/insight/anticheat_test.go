@@ -0,0 +1,193 @@
+package insight
+
+import (
+	"testing"
+	"time"
+)
+
+var testAntiCheatConfig = AntiCheatConfig{
+	Action:            AntiCheatCap,
+	MaxSession:        24 * time.Hour,
+	PeriodicRun:       90,
+	PeriodicTolerance: time.Second,
+	MaxOverlap:        30 * time.Minute,
+}
+
+var anticheatBase = time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+
+// 100秒・120秒・140秒の間隔で送られる、人が作業しているときのハートビート
+func humanHeartbeats(start time.Time, count int, machine, language string) []Heartbeat {
+	var heartbeats []Heartbeat
+	t := start
+	for i := 0; i < count; i++ {
+		heartbeats = append(heartbeats, Heartbeat{Time: t, Language: language, Machine: machine})
+		t = t.Add(100*time.Second + time.Duration(i%3)*20*time.Second)
+	}
+	return heartbeats
+}
+
+// interval ごとに送られるハートビート。jitter を指定すると交互に前後にずらす
+func periodicHeartbeats(start time.Time, count int, interval, jitter time.Duration) []Heartbeat {
+	var heartbeats []Heartbeat
+	for i := 0; i < count; i++ {
+		t := start.Add(time.Duration(i) * interval)
+		if i%2 == 1 {
+			t = t.Add(jitter)
+		}
+		heartbeats = append(heartbeats, Heartbeat{Time: t, Language: "go"})
+	}
+	return heartbeats
+}
+
+// 2台のマシンで同時に作業したハートビート。machine-a のほうが多い
+func overlappingHeartbeats(duration time.Duration, languageB string) []Heartbeat {
+	var heartbeats []Heartbeat
+	heartbeats = append(heartbeats, Heartbeat{Time: anticheatBase.Add(-2 * time.Minute), Language: "go", Machine: "machine-a"})
+	for t := time.Duration(0); t < duration; t += 2 * time.Minute {
+		heartbeats = append(heartbeats,
+			Heartbeat{Time: anticheatBase.Add(t), Language: "go", Machine: "machine-a"},
+			Heartbeat{Time: anticheatBase.Add(t + time.Minute), Language: languageB, Machine: "machine-b"},
+		)
+	}
+	return heartbeats
+}
+
+func TestDetectAnomalies(t *testing.T) {
+	tests := []struct {
+		name       string
+		heartbeats []Heartbeat
+		kinds      []string
+		credited   int // -1 の場合は確認しない
+		check      func(t *testing.T, anomalies []Anomaly, credited []Heartbeat)
+	}{
+		{
+			name:       "no heartbeats",
+			heartbeats: nil,
+			credited:   0,
+		},
+		{
+			name:       "human activity",
+			heartbeats: humanHeartbeats(anticheatBase, 200, "", "go"),
+			credited:   200,
+		},
+		{
+			name:       "periodic run",
+			heartbeats: periodicHeartbeats(anticheatBase, 100, 2*time.Minute, 0),
+			kinds:      []string{AnomalyPeriodic},
+			credited:   0,
+			check: func(t *testing.T, anomalies []Anomaly, credited []Heartbeat) {
+				if anomalies[0].Count != 99 {
+					t.Errorf("Count = %d, want 99", anomalies[0].Count)
+				}
+			},
+		},
+		{
+			name:       "periodic run within tolerance",
+			heartbeats: periodicHeartbeats(anticheatBase, 100, 2*time.Minute, 400*time.Millisecond),
+			kinds:      []string{AnomalyPeriodic},
+			credited:   0,
+		},
+		{
+			name:       "periodic run shorter than the threshold",
+			heartbeats: periodicHeartbeats(anticheatBase, 80, 2*time.Minute, 0),
+			credited:   80,
+		},
+		{
+			name: "periodic run followed by human activity",
+			heartbeats: append(periodicHeartbeats(anticheatBase, 100, 2*time.Minute, 0),
+				humanHeartbeats(anticheatBase.Add(4*time.Hour), 30, "", "go")...),
+			kinds:    []string{AnomalyPeriodic},
+			credited: 30,
+		},
+		{
+			name:       "multi-machine overlap",
+			heartbeats: overlappingHeartbeats(40*time.Minute, "python"),
+			kinds:      []string{AnomalyMultiMachine},
+			credited:   21,
+			check: func(t *testing.T, anomalies []Anomaly, credited []Heartbeat) {
+				if anomalies[0].Duration != 40*time.Minute {
+					t.Errorf("Duration = %v, want 40m", anomalies[0].Duration)
+				}
+				for _, heartbeat := range credited {
+					if heartbeat.Machine != "machine-a" {
+						t.Fatalf("credited heartbeat from %s, want only the primary machine", heartbeat.Machine)
+					}
+				}
+			},
+		},
+		{
+			name:       "multi-machine overlap shorter than the threshold",
+			heartbeats: overlappingHeartbeats(20*time.Minute, "python"),
+			credited:   21,
+		},
+		{
+			name:       "same language on two machines",
+			heartbeats: overlappingHeartbeats(40*time.Minute, "go"),
+			credited:   41,
+		},
+		{
+			name:       "long session is capped",
+			heartbeats: humanHeartbeats(anticheatBase, 900, "", "go"),
+			kinds:      []string{AnomalyLongSession},
+			credited:   -1,
+			check: func(t *testing.T, anomalies []Anomaly, credited []Heartbeat) {
+				if anomalies[0].Duration <= 24*time.Hour {
+					t.Errorf("Duration = %v, want more than 24h", anomalies[0].Duration)
+				}
+				last := credited[len(credited)-1].Time
+				if last.Sub(anticheatBase) > 24*time.Hour {
+					t.Errorf("credited until %v, want at most 24h after the start", last)
+				}
+				if last.Sub(anticheatBase) < 24*time.Hour-3*time.Minute {
+					t.Errorf("credited until %v, want up to 24h after the start", last)
+				}
+			},
+		},
+		{
+			name: "sessions separated by a gap are capped separately",
+			heartbeats: append(humanHeartbeats(anticheatBase, 600, "", "go"),
+				humanHeartbeats(anticheatBase.Add(21*time.Hour), 600, "", "go")...),
+			credited: 1200,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SortHeartbeats(tt.heartbeats)
+			anomalies, credited := DetectAnomalies(tt.heartbeats, testAntiCheatConfig)
+			if len(anomalies) != len(tt.kinds) {
+				t.Fatalf("got %d anomalies %+v, want %v", len(anomalies), anomalies, tt.kinds)
+			}
+			for i, kind := range tt.kinds {
+				if anomalies[i].Kind != kind {
+					t.Errorf("anomalies[%d].Kind = %s, want %s", i, anomalies[i].Kind, kind)
+				}
+			}
+			if tt.credited >= 0 && len(credited) != tt.credited {
+				t.Errorf("got %d credited heartbeats, want %d", len(credited), tt.credited)
+			}
+			if tt.check != nil {
+				tt.check(t, anomalies, credited)
+			}
+		})
+	}
+}
+
+func TestGetAntiCheatConfigAction(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"", AntiCheatOff},
+		{"off", AntiCheatOff},
+		{"mark", AntiCheatMark},
+		{"cap", AntiCheatCap},
+		{"block", AntiCheatOff},
+	}
+	for _, tt := range tests {
+		t.Setenv("ANTI_CHEAT_ACTION", tt.value)
+		if got := GetAntiCheatConfig().Action; got != tt.want {
+			t.Errorf("ANTI_CHEAT_ACTION=%q: Action = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package insight
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/bwmarrin/discordgo"
+)
+
+// エラーの種類
+type ErrorKind string
+
+const (
+	KindConfig   ErrorKind = "ConfigError"   // 環境変数・サーバー登録などの設定の不備
+	KindStore    ErrorKind = "StoreError"    // DynamoDB・S3 の読み書き
+	KindDelivery ErrorKind = "DeliveryError" // Discord への投稿・ロールの変更・DM
+	KindData     ErrorKind = "DataError"     // 保存されたデータの不備・集計対象のデータがない
+)
+
+// 種類ごとの判定に使う値（errors.Is(err, insight.ErrStore) など）
+var (
+	ErrConfig   error = &AppError{Kind: KindConfig}
+	ErrStore    error = &AppError{Kind: KindStore}
+	ErrDelivery error = &AppError{Kind: KindDelivery}
+	ErrData     error = &AppError{Kind: KindData}
+)
+
+// 種類と原因を持つエラー。原因は errors.As で取り出せる
+type AppError struct {
+	Kind    ErrorKind
+	Message string
+	Err     error
+}
+
+func (e *AppError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%s: %s", e.Kind, e.Message)
+	}
+	return fmt.Sprintf("%s: %s (%v)", e.Kind, e.Message, e.Err)
+}
+
+func (e *AppError) Unwrap() error {
+	return e.Err
+}
+
+// Message も原因もない AppError（ErrConfig など）とは種類だけで比べる
+func (e *AppError) Is(target error) bool {
+	t, ok := target.(*AppError)
+	if !ok || t.Message != "" || t.Err != nil {
+		return false
+	}
+	return t.Kind == e.Kind
+}
+
+// エラーの種類。AppError でない場合は空
+func KindOf(err error) ErrorKind {
+	var appErr *AppError
+	if errors.As(err, &appErr) {
+		return appErr.Kind
+	}
+	return ""
+}
+
+// 再試行すれば成功する可能性がある一時的なエラーか
+// （DynamoDB のスロットリング・5xx、Discord のレート制限・5xx、通信のタイムアウト）
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) {
+		if restErr.Response == nil {
+			return false
+		}
+		status := restErr.Response.StatusCode
+		return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		if awsErr.Code() == request.CanceledErrorCode {
+			return false
+		}
+		if request.IsErrorThrottle(awsErr) || request.IsErrorRetryable(awsErr) {
+			return true
+		}
+		if awsErr.OrigErr() != nil {
+			return IsRetryable(awsErr.OrigErr())
+		}
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// 一時的なエラーを再試行する回数の既定値（RETRY_MAX_ATTEMPTS で変更する）
+const defaultRetryAttempts = 3
+
+// 再試行の間隔。1回ごとに倍にし、retryMaxDelay を上限とする（テストで短くするため変数にする）
+var (
+	retryBaseDelay = 200 * time.Millisecond
+	retryMaxDelay  = 5 * time.Second
+)
+
+// fn が一時的なエラーを返した場合に、間隔を空けて RETRY_MAX_ATTEMPTS 回まで実行する
+// 一時的でないエラーと、ctx が終了した場合はその時点のエラーを返す
+func Retry(ctx context.Context, step string, fn func() error) error {
+	attempts := GetEnvInt("RETRY_MAX_ATTEMPTS", defaultRetryAttempts, 1)
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil || !IsRetryable(err) || attempt >= attempts {
+			return err
+		}
+		delay := retryBaseDelay << (attempt - 1)
+		if delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+		// 並行して再試行する場合に間隔が揃わないよう、最大で半分ずらす
+		delay += time.Duration(rand.Int63n(int64(delay/2) + 1))
+		slog.Warn("一時的なエラーのため再試行します", "step", step, "attempt", attempt, "max_attempts", attempts, "delay", delay.Round(time.Millisecond), "error", err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
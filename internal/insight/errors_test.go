@@ -0,0 +1,155 @@
+package insight
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestAppErrorIs(t *testing.T) {
+	cause := errors.New("connection reset")
+	store := &AppError{Kind: KindStore, Message: "ハートビートの取得に失敗", Err: cause}
+	tests := []struct {
+		name     string
+		err      error
+		kinds    []error // errors.Is が true になる種類
+		wantKind ErrorKind
+	}{
+		{"app error", store, []error{ErrStore}, KindStore},
+		{"wrapped with fmt", fmt.Errorf("ranking: %w", store), []error{ErrStore}, KindStore},
+		{"nested", &AppError{Kind: KindDelivery, Message: "DM の送信に失敗", Err: store}, []error{ErrDelivery, ErrStore}, KindDelivery},
+		{"joined", errors.Join(errors.New("other"), &AppError{Kind: KindConfig, Message: "未登録"}), []error{ErrConfig}, KindConfig},
+		{"user error", UserError{DiscordID: "1", Err: &AppError{Kind: KindData, Message: "不正"}}, []error{ErrData}, KindData},
+		{"plain error", cause, nil, ""},
+		{"nil", nil, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, kind := range []error{ErrConfig, ErrStore, ErrDelivery, ErrData} {
+				want := false
+				for _, k := range tt.kinds {
+					want = want || k == kind
+				}
+				if got := errors.Is(tt.err, kind); got != want {
+					t.Errorf("errors.Is(err, %v) = %v, want %v", kind, got, want)
+				}
+			}
+			if got := KindOf(tt.err); got != tt.wantKind {
+				t.Errorf("KindOf() = %q, want %q", got, tt.wantKind)
+			}
+		})
+	}
+
+	// 原因は errors.Is・errors.As で取り出せる
+	if !errors.Is(fmt.Errorf("ranking: %w", store), cause) {
+		t.Error("errors.Is does not find the cause")
+	}
+	// Message のある AppError とは種類が同じでも一致しない
+	if errors.Is(store, &AppError{Kind: KindStore, Message: "別のエラー"}) {
+		t.Error("errors.Is matches an AppError with another message")
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	restError := func(status int) error {
+		return &discordgo.RESTError{Response: &http.Response{StatusCode: status}}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"plain error", errors.New("failed"), false},
+		{"discord rate limit", restError(http.StatusTooManyRequests), true},
+		{"discord server error", restError(http.StatusBadGateway), true},
+		{"discord not found", restError(http.StatusNotFound), false},
+		{"discord forbidden", restError(http.StatusForbidden), false},
+		{"discord without response", &discordgo.RESTError{}, false},
+		{"wrapped discord rate limit", &AppError{Kind: KindDelivery, Err: restError(http.StatusTooManyRequests)}, true},
+		{"dynamodb throttling", awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "throttled", nil), true},
+		{"throttling", awserr.New("ThrottlingException", "throttled", nil), true},
+		{"aws request timeout", awserr.New("RequestTimeout", "timeout", nil), true},
+		{"conditional check", awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "failed", nil), false},
+		{"aws canceled", awserr.New(request.CanceledErrorCode, "canceled", context.Canceled), false},
+		{"aws with network timeout", awserr.New("Unknown", "failed", &net.DNSError{IsTimeout: true}), true},
+		{"network timeout", fmt.Errorf("get: %w", &net.DNSError{IsTimeout: true}), true},
+		{"network error", &net.DNSError{IsNotFound: true}, false},
+		{"context canceled", fmt.Errorf("get: %w", context.Canceled), false},
+		{"deadline exceeded", context.DeadlineExceeded, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRetryable(tt.err); got != tt.want {
+				t.Errorf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetry(t *testing.T) {
+	retryBaseDelay, retryMaxDelay = time.Millisecond, 2*time.Millisecond
+	t.Cleanup(func() { retryBaseDelay, retryMaxDelay = 200*time.Millisecond, 5*time.Second })
+
+	throttled := awserr.New("ThrottlingException", "throttled", nil)
+	permanent := errors.New("validation error")
+	tests := []struct {
+		name         string
+		maxAttempts  string
+		errs         []error // 各回の fn の結果（足りない場合は nil）
+		wantErr      error
+		wantAttempts int
+	}{
+		{"success", "", nil, nil, 1},
+		{"success after retries", "", []error{throttled, throttled}, nil, 3},
+		{"gives up", "", []error{throttled, throttled, throttled, throttled}, throttled, 3},
+		{"configured attempts", "5", []error{throttled, throttled, throttled, throttled}, nil, 5},
+		{"no retries", "1", []error{throttled}, throttled, 1},
+		{"invalid attempts", "0", []error{throttled, throttled, throttled}, throttled, 3},
+		{"not retryable", "", []error{permanent, throttled}, permanent, 1},
+		{"not retryable after retry", "", []error{throttled, permanent}, permanent, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("RETRY_MAX_ATTEMPTS", tt.maxAttempts)
+			attempts := 0
+			err := Retry(context.Background(), "test", func() error {
+				attempts++
+				if attempts <= len(tt.errs) {
+					return tt.errs[attempts-1]
+				}
+				return nil
+			})
+			if err != tt.wantErr {
+				t.Errorf("Retry() = %v, want %v", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	t.Setenv("RETRY_MAX_ATTEMPTS", "5")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	throttled := awserr.New("ThrottlingException", "throttled", nil)
+	attempts := 0
+	err := Retry(ctx, "test", func() error {
+		attempts++
+		return throttled
+	})
+	if err != throttled || attempts != 1 {
+		t.Errorf("Retry() = %v after %d attempts, want the error after 1 attempt", err, attempts)
+	}
+}
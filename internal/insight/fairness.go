@@ -0,0 +1,128 @@
+package insight
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// セッション計算後に適用する集計ルール（長時間の放置より継続的な作業を評価する）
+type FairnessRules struct {
+	MaxDaily   time.Duration // 1日に集計する上限
+	MaxSession time.Duration // 1セッションの上限
+	QuietStart time.Duration // 集計しない時間帯の開始（0時からの時間）
+	QuietEnd   time.Duration // 集計しない時間帯の終了（開始より前の場合は翌日）
+	QuietHours bool
+	Location   *time.Location // 日付と時間帯の基準
+}
+
+func GetFairnessRules() FairnessRules {
+	rules := FairnessRules{Location: time.UTC}
+	if os.Getenv("FAIR_MAX_DAILY_HOURS") != "" {
+		rules.MaxDaily = time.Duration(GetEnvInt("FAIR_MAX_DAILY_HOURS", 0, 1)) * time.Hour
+	}
+	if os.Getenv("FAIR_MAX_SESSION_HOURS") != "" {
+		rules.MaxSession = time.Duration(GetEnvInt("FAIR_MAX_SESSION_HOURS", 0, 1)) * time.Hour
+	}
+	if name := os.Getenv("FAIR_TIMEZONE"); name != "" {
+		location, err := time.LoadLocation(name)
+		if err != nil {
+			slog.Warn("FAIR_TIMEZONE が不正です", "value", name)
+		} else {
+			rules.Location = location
+		}
+	}
+	if value := os.Getenv("FAIR_QUIET_HOURS"); value != "" {
+		start, end, ok := strings.Cut(value, "-")
+		quietStart, startErr := parseClock(start)
+		quietEnd, endErr := parseClock(end)
+		if !ok || startErr != nil || endErr != nil || quietStart == quietEnd {
+			slog.Warn("FAIR_QUIET_HOURS が不正です", "value", value)
+		} else {
+			rules.QuietStart, rules.QuietEnd, rules.QuietHours = quietStart, quietEnd, true
+		}
+	}
+	return rules
+}
+
+// "HH:MM" を0時からの時間に変換する
+func parseClock(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func FormatClock(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+}
+
+func (r FairnessRules) Enabled() bool {
+	return r.MaxDaily > 0 || r.MaxSession > 0 || r.QuietHours
+}
+
+// その日の集計する時間帯
+func (r FairnessRules) countedRanges(day time.Time) [][2]time.Time {
+	dayStart := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, r.Location)
+	dayEnd := dayStart.AddDate(0, 0, 1)
+	if !r.QuietHours {
+		return [][2]time.Time{{dayStart, dayEnd}}
+	}
+	at := func(offset time.Duration) time.Time {
+		return time.Date(day.Year(), day.Month(), day.Day(), int(offset.Hours()), int(offset.Minutes())%60, 0, 0, r.Location)
+	}
+	quietStart, quietEnd := at(r.QuietStart), at(r.QuietEnd)
+	if r.QuietStart < r.QuietEnd {
+		return [][2]time.Time{{dayStart, quietStart}, {quietEnd, dayEnd}}
+	}
+	// 23:00-06:00 のように日をまたぐ場合
+	return [][2]time.Time{{quietEnd, quietStart}}
+}
+
+// セッションの長さの上限、集計しない時間帯、1日の上限の順に適用する
+func ApplyFairnessRules(sessions []SessionTime, rules FairnessRules) []SessionTime {
+	var pieces []SessionTime
+	for _, session := range sessions {
+		if rules.MaxSession > 0 && session.End.Sub(session.Start) > rules.MaxSession {
+			session.End = session.Start.Add(rules.MaxSession)
+		}
+		// 日ごとに分け、集計する時間帯だけを残す
+		for day := session.Start.In(rules.Location); day.Before(session.End); {
+			for _, counted := range rules.countedRanges(day) {
+				piece := session
+				if counted[0].After(piece.Start) {
+					piece.Start = counted[0]
+				}
+				if counted[1].Before(piece.End) {
+					piece.End = counted[1]
+				}
+				if piece.End.After(piece.Start) {
+					pieces = append(pieces, piece)
+				}
+			}
+			day = time.Date(day.Year(), day.Month(), day.Day()+1, 0, 0, 0, 0, rules.Location)
+		}
+	}
+
+	if rules.MaxDaily == 0 {
+		return pieces
+	}
+	var capped []SessionTime
+	credited := make(map[string]time.Duration)
+	for _, piece := range pieces {
+		day := piece.Start.In(rules.Location).Format("2006-01-02")
+		remaining := rules.MaxDaily - credited[day]
+		if remaining <= 0 {
+			continue
+		}
+		if piece.End.Sub(piece.Start) > remaining {
+			piece.End = piece.Start.Add(remaining)
+		}
+		credited[day] += piece.End.Sub(piece.Start)
+		capped = append(capped, piece)
+	}
+	return capped
+}
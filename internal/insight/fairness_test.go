@@ -0,0 +1,163 @@
+package insight
+
+import (
+	"testing"
+	"time"
+)
+
+var fairnessBase = time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+
+// fairnessBase からの時間で表したセッションの範囲
+type span struct {
+	start, end time.Duration
+}
+
+func sessionsOf(spans ...span) []SessionTime {
+	var sessions []SessionTime
+	for _, s := range spans {
+		sessions = append(sessions, SessionTime{
+			Start:    fairnessBase.Add(s.start),
+			End:      fairnessBase.Add(s.end),
+			Language: "go",
+		})
+	}
+	return sessions
+}
+
+func hours(h float64) time.Duration {
+	return time.Duration(h * float64(time.Hour))
+}
+
+func TestApplyFairnessRules(t *testing.T) {
+	quietNight := FairnessRules{QuietHours: true, QuietStart: 23 * time.Hour, QuietEnd: 6 * time.Hour, Location: time.UTC}
+
+	tests := []struct {
+		name     string
+		sessions []SessionTime
+		rules    FairnessRules
+		want     []span
+	}{
+		{
+			name:     "no rules",
+			sessions: sessionsOf(span{hours(9), hours(12)}),
+			rules:    FairnessRules{Location: time.UTC},
+			want:     []span{{hours(9), hours(12)}},
+		},
+		{
+			name:     "session spanning midnight is split by day",
+			sessions: sessionsOf(span{hours(22), hours(26)}),
+			rules:    FairnessRules{Location: time.UTC},
+			want:     []span{{hours(22), hours(24)}, {hours(24), hours(26)}},
+		},
+		{
+			name:     "quiet hours 23:00-06:00 cut the end of a session",
+			sessions: sessionsOf(span{hours(21), hours(25)}),
+			rules:    quietNight,
+			want:     []span{{hours(21), hours(23)}},
+		},
+		{
+			name:     "quiet hours 23:00-06:00 with a session spanning midnight",
+			sessions: sessionsOf(span{hours(22), hours(32)}),
+			rules:    quietNight,
+			want:     []span{{hours(22), hours(23)}, {hours(30), hours(32)}},
+		},
+		{
+			name:     "session inside quiet hours 23:00-06:00",
+			sessions: sessionsOf(span{hours(0), hours(5)}),
+			rules:    quietNight,
+			want:     nil,
+		},
+		{
+			name:     "quiet hours 23:00-06:00 in the rules' time zone",
+			sessions: sessionsOf(span{hours(14), hours(16)}, span{hours(21), hours(22)}),
+			rules:    FairnessRules{QuietHours: true, QuietStart: 23 * time.Hour, QuietEnd: 6 * time.Hour, Location: time.FixedZone("JST", 9*60*60)},
+			want:     []span{{hours(21), hours(22)}},
+		},
+		{
+			name:     "quiet hours within a day",
+			sessions: sessionsOf(span{hours(11), hours(14)}),
+			rules:    FairnessRules{QuietHours: true, QuietStart: 12 * time.Hour, QuietEnd: 13 * time.Hour, Location: time.UTC},
+			want:     []span{{hours(11), hours(12)}, {hours(13), hours(14)}},
+		},
+		{
+			name:     "MaxSession",
+			sessions: sessionsOf(span{hours(10), hours(16)}),
+			rules:    FairnessRules{MaxSession: 3 * time.Hour, Location: time.UTC},
+			want:     []span{{hours(10), hours(13)}},
+		},
+		{
+			name:     "MaxDaily with MaxSession",
+			sessions: sessionsOf(span{hours(8), hours(12)}, span{hours(13), hours(16)}, span{hours(33), hours(34)}),
+			rules:    FairnessRules{MaxDaily: 4 * time.Hour, MaxSession: 3 * time.Hour, Location: time.UTC},
+			want:     []span{{hours(8), hours(11)}, {hours(13), hours(14)}, {hours(33), hours(34)}},
+		},
+		{
+			name:     "MaxDaily is counted per day for a session spanning midnight",
+			sessions: sessionsOf(span{hours(21), hours(27)}),
+			rules:    FairnessRules{MaxDaily: 1 * time.Hour, Location: time.UTC},
+			want:     []span{{hours(21), hours(22)}, {hours(24), hours(25)}},
+		},
+		{
+			name:     "MaxSession is applied before quiet hours and MaxDaily",
+			sessions: sessionsOf(span{hours(20), hours(32)}),
+			rules:    FairnessRules{MaxDaily: 2 * time.Hour, MaxSession: 5 * time.Hour, QuietHours: true, QuietStart: 23 * time.Hour, QuietEnd: 6 * time.Hour, Location: time.UTC},
+			want:     []span{{hours(20), hours(22)}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ApplyFairnessRules(tt.sessions, tt.rules)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d sessions %v, want %d", len(got), got, len(tt.want))
+			}
+			for i, want := range tt.want {
+				start, end := fairnessBase.Add(want.start), fairnessBase.Add(want.end)
+				if !got[i].Start.Equal(start) || !got[i].End.Equal(end) {
+					t.Errorf("sessions[%d] = %v - %v, want %v - %v", i, got[i].Start.UTC(), got[i].End.UTC(), start, end)
+				}
+			}
+		})
+	}
+}
+
+func TestCountedRanges(t *testing.T) {
+	day := time.Date(2024, 4, 1, 15, 0, 0, 0, time.UTC)
+	at := func(h int) time.Time { return time.Date(2024, 4, 1, h, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name  string
+		rules FairnessRules
+		want  [][2]time.Time
+	}{
+		{"no quiet hours", FairnessRules{Location: time.UTC}, [][2]time.Time{{at(0), at(24)}}},
+		{"23:00-06:00", FairnessRules{QuietHours: true, QuietStart: 23 * time.Hour, QuietEnd: 6 * time.Hour, Location: time.UTC}, [][2]time.Time{{at(6), at(23)}}},
+		{"12:00-13:00", FairnessRules{QuietHours: true, QuietStart: 12 * time.Hour, QuietEnd: 13 * time.Hour, Location: time.UTC}, [][2]time.Time{{at(0), at(12)}, {at(13), at(24)}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.rules.countedRanges(day)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range tt.want {
+				if !got[i][0].Equal(tt.want[i][0]) || !got[i][1].Equal(tt.want[i][1]) {
+					t.Errorf("ranges[%d] = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestGetFairnessRulesQuietHours(t *testing.T) {
+	t.Setenv("FAIR_QUIET_HOURS", "23:00-06:00")
+	rules := GetFairnessRules()
+	if !rules.QuietHours || rules.QuietStart != 23*time.Hour || rules.QuietEnd != 6*time.Hour {
+		t.Errorf("got %+v, want quiet hours 23:00-06:00", rules)
+	}
+
+	t.Setenv("FAIR_QUIET_HOURS", "06:00-06:00")
+	if GetFairnessRules().QuietHours {
+		t.Error("quiet hours with the same start and end should be ignored")
+	}
+}
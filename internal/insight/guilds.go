@@ -0,0 +1,88 @@
+package insight
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/bwmarrin/discordgo"
+)
+
+// サーバーごとの投稿先とロール設定
+type GuildConfig struct {
+	GuildID              string            `json:"guild_id"`
+	ChannelIDs           []string          `json:"channel_ids"`
+	RolesEnabled         bool              `json:"roles_enabled"`
+	RoleSuffix           string            `json:"role_suffix"`
+	RoleThresholdMinutes int               `json:"role_threshold_minutes"`
+	ExcludedLanguages    []string          `json:"excluded_languages"`
+	LiveLeaderboard      bool              `json:"live_leaderboard"`     // ピン留めしたメッセージを編集し、最終ランキングはスレッドに投稿
+	Locale               string            `json:"locale"`               // レポートの言語 (ja, en)
+	Templates            map[string]string `json:"templates"`            // header, entries, footer のテンプレートの上書き
+	MinRankingMinutes    *int              `json:"min_ranking_minutes"`  // ランキングに表示する最低作業時間（分）
+	ModeratorChannelID   string            `json:"moderator_channel_id"` // 不自然な作業記録を通知するチャンネル
+}
+
+// サーバー登録テーブルのすべてのサーバーを読み込む
+// テーブルがない場合のみ nil を返し、呼び出し元で環境変数の設定を使用する。スキャンに失敗した場合は KindStore のエラー
+func ScanGuildRegistry(ctx context.Context, svc *dynamodb.DynamoDB) ([]GuildConfig, error) {
+	var guilds []GuildConfig
+	var lastKey map[string]*dynamodb.AttributeValue
+	for {
+		var result *dynamodb.ScanOutput
+		err := Retry(ctx, "scan "+GuildTableName, func() error {
+			var err error
+			result, err = svc.ScanWithContext(ctx, &dynamodb.ScanInput{
+				TableName:         aws.String(GuildTableName),
+				ExclusiveStartKey: lastKey,
+			})
+			return err
+		})
+		if err != nil {
+			var awsErr awserr.Error
+			if errors.As(err, &awsErr) && awsErr.Code() == dynamodb.ErrCodeResourceNotFoundException {
+				slog.Warn("サーバー登録テーブルがありません", "table", GuildTableName)
+				return nil, nil
+			}
+			return nil, &AppError{Kind: KindStore, Message: "サーバー登録テーブルのスキャンに失敗", Err: err}
+		}
+		var items []GuildConfig
+		if err := dynamodbattribute.UnmarshalListOfMaps(result.Items, &items); err != nil {
+			return nil, &AppError{Kind: KindData, Message: "サーバー登録データのアンマーシャルに失敗", Err: err}
+		}
+		guilds = append(guilds, items...)
+		lastKey = result.LastEvaluatedKey
+		if lastKey == nil {
+			return guilds, nil
+		}
+	}
+}
+
+// 指定したサーバーのみを残す。登録がない場合は空
+func SelectGuild(guilds []GuildConfig, guildID string) []GuildConfig {
+	for _, guild := range guilds {
+		if guild.GuildID == guildID {
+			return []GuildConfig{guild}
+		}
+	}
+	return nil
+}
+
+// 未参加・退出済みメンバーかどうかを判定
+func IsUnknownMemberError(err error) bool {
+	restErr, ok := err.(*discordgo.RESTError)
+	if !ok {
+		return false
+	}
+	if restErr.Message != nil {
+		switch restErr.Message.Code {
+		case discordgo.ErrCodeUnknownMember, discordgo.ErrCodeUnknownUser:
+			return true
+		}
+	}
+	return restErr.Response != nil && restErr.Response.StatusCode == 404
+}
@@ -0,0 +1,146 @@
+package insight
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+)
+
+// 集計期間の開始日時（7日前の0時、UTC）
+func PeriodStart(now time.Time) time.Time {
+	sevenDaysAgo := now.UTC().AddDate(0, 0, -7)
+	return time.Date(
+		sevenDaysAgo.Year(),
+		sevenDaysAgo.Month(),
+		sevenDaysAgo.Day(),
+		0, 0, 0, 0,
+		time.UTC,
+	)
+}
+
+// since 以降にハートビートを送信したユーザーの Discord ID
+func ActiveDiscordIDs(ctx context.Context, svc *dynamodb.DynamoDB, since time.Time) ([]string, error) {
+	filt := expression.Name("timestamp").GreaterThanEqual(expression.Value(FormatTimestamp(since)))
+	proj := expression.NamesList(expression.Name("discord_id"))
+	expr, err := expression.NewBuilder().WithFilter(filt).WithProjection(proj).Build()
+	if err != nil {
+		return nil, &AppError{Kind: KindData, Message: "クエリ式の構築に失敗", Err: err}
+	}
+
+	seen := make(map[string]bool)
+	var discordIDs []string
+	var lastKey map[string]*dynamodb.AttributeValue
+	for {
+		var result *dynamodb.ScanOutput
+		err := Retry(ctx, "scan "+TableName, func() error {
+			var err error
+			result, err = svc.ScanWithContext(ctx, &dynamodb.ScanInput{
+				TableName:                 aws.String(TableName),
+				FilterExpression:          expr.Filter(),
+				ProjectionExpression:      expr.Projection(),
+				ExpressionAttributeNames:  expr.Names(),
+				ExpressionAttributeValues: expr.Values(),
+				ExclusiveStartKey:         lastKey,
+			})
+			return err
+		})
+		if err != nil {
+			return nil, &AppError{Kind: KindStore, Message: "DynamoDBのスキャンに失敗", Err: err}
+		}
+		var items []InsightData
+		if err := dynamodbattribute.UnmarshalListOfMaps(result.Items, &items); err != nil {
+			return nil, &AppError{Kind: KindData, Message: "データのアンマーシャルに失敗", Err: err}
+		}
+		for _, item := range items {
+			if !seen[item.DiscordID] {
+				seen[item.DiscordID] = true
+				discordIDs = append(discordIDs, item.DiscordID)
+			}
+		}
+		lastKey = result.LastEvaluatedKey
+		if lastKey == nil {
+			break
+		}
+	}
+	slog.Debug("Discord IDを取得しました", "users", len(discordIDs), "since", since.Format(time.RFC3339))
+	return discordIDs, nil
+}
+
+// ユーザーの from 以降、to より前のハートビートを取得する（to がゼロ値の場合は上限なし）
+func QueryHeartbeats(ctx context.Context, svc *dynamodb.DynamoDB, discordID string, from, to time.Time) ([]InsightData, error) {
+	keyCond := expression.Key("discord_id").Equal(expression.Value(discordID))
+	if to.IsZero() {
+		keyCond = keyCond.And(expression.Key("timestamp").GreaterThanEqual(expression.Value(FormatTimestamp(from))))
+	} else {
+		// Between は終端を含むため、to の1ミリ秒前までにする
+		keyCond = keyCond.And(expression.Key("timestamp").Between(
+			expression.Value(FormatTimestamp(from)),
+			expression.Value(FormatTimestamp(to.Add(-time.Millisecond))),
+		))
+	}
+	expr, err := expression.NewBuilder().WithKeyCondition(keyCond).Build()
+	if err != nil {
+		return nil, &AppError{Kind: KindData, Message: "クエリ式の構築に失敗", Err: err}
+	}
+
+	var items []InsightData
+	var lastKey map[string]*dynamodb.AttributeValue
+	for {
+		var result *dynamodb.QueryOutput
+		err := Retry(ctx, "query "+TableName, func() error {
+			var err error
+			result, err = svc.QueryWithContext(ctx, &dynamodb.QueryInput{
+				TableName:                 aws.String(TableName),
+				KeyConditionExpression:    expr.KeyCondition(),
+				ExpressionAttributeNames:  expr.Names(),
+				ExpressionAttributeValues: expr.Values(),
+				ExclusiveStartKey:         lastKey,
+			})
+			return err
+		})
+		if err != nil {
+			return nil, &AppError{Kind: KindStore, Message: "クエリの実行に失敗", Err: err}
+		}
+		var page []InsightData
+		if err := dynamodbattribute.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return nil, &AppError{Kind: KindData, Message: "データのアンマーシャルに失敗", Err: err}
+		}
+		items = append(items, page...)
+		lastKey = result.LastEvaluatedKey
+		if lastKey == nil {
+			break
+		}
+	}
+	slog.Debug("ハートビートを取得しました", "discord_id", discordID, "items", len(items))
+	return items, nil
+}
+
+// タイムスタンプを解析し、時刻順に並べたハートビートを返す
+// mapLanguage を指定した場合は言語名を変換する
+func ToHeartbeats(items []InsightData, mapLanguage func(string) string) []Heartbeat {
+	var heartbeats []Heartbeat
+	for _, item := range items {
+		t, err := time.Parse(time.RFC3339, item.Timestamp)
+		if err != nil {
+			slog.Error("タイムスタンプの解析に失敗", "discord_id", item.DiscordID, "error", err)
+			continue
+		}
+		language := item.Language
+		if mapLanguage != nil {
+			language = mapLanguage(language)
+		}
+		heartbeats = append(heartbeats, Heartbeat{
+			Time:     t,
+			Language: language,
+			Project:  item.Project,
+			Machine:  item.Machine,
+		})
+	}
+	SortHeartbeats(heartbeats)
+	return heartbeats
+}
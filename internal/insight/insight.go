@@ -0,0 +1,90 @@
+// Package insight はランキング・ロール付与・データ削除で共通のデータ型と DynamoDB の操作をまとめる
+package insight
+
+import (
+	"log/slog"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// DynamoDB のテーブル名
+const (
+	TableName             = "dev_insight"
+	GuildTableName        = "dev_insight_guilds"
+	UserSettingsTableName = "dev_insight_user_settings"
+	RollupTableName       = "dev_insight_rollups"
+	AuditTableName        = "dev_insight_audit"
+	RunsTableName         = "dev_insight_runs"
+	TokenTableName        = "dev_insight_tokens"
+)
+
+// AWS のセッションと DynamoDB クライアント。接続先は Configure で変更する
+var (
+	Session = session.Must(session.NewSession(&aws.Config{
+		Region: aws.String("ap-northeast-1"),
+	}))
+	DB = newDB(Session)
+)
+
+// AWS の接続先を変更する（devinsight CLI からローカルのテーブルを使う場合など）
+func Configure(config *aws.Config) {
+	Session = session.Must(session.NewSession(config))
+	DB = newDB(Session)
+}
+
+// DB の呼び出しは Retry（削除のバッチ書き込みは batchWrite）で再試行するため、
+// SDK の再試行を無効にして、再試行の回数と待ち時間が重ならないようにする
+func newDB(sess *session.Session) *dynamodb.DynamoDB {
+	return dynamodb.New(sess, &aws.Config{MaxRetries: aws.Int(0)})
+}
+
+// ハートビートのテーブルの timestamp（ソートキー）の形式。拡張機能の toISOString と同じミリ秒精度の UTC
+// 文字列の比較で範囲を指定するため、クエリ・削除の範囲もこの形式にする
+const TimestampLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// TimestampLayout の形式の UTC の文字列
+func FormatTimestamp(t time.Time) string {
+	return t.UTC().Format(TimestampLayout)
+}
+
+// ハートビートのテーブルのアイテム
+type InsightData struct {
+	DiscordID string `json:"discord_id"`
+	Timestamp string `json:"timestamp"`
+	Language  string `json:"language"`
+	Project   string `json:"project,omitempty"`
+	Branch    string `json:"branch,omitempty"`
+	Entity    string `json:"entity,omitempty"` // ファイルパスのハッシュ値
+	IsWrite   bool   `json:"is_write,omitempty"`
+	Editor    string `json:"editor,omitempty"`
+	Machine   string `json:"machine,omitempty"`
+	ExpiresAt int64  `json:"expires_at,omitempty"` // TTL（Unix 秒）。保持期間を過ぎると DynamoDB が削除する
+}
+
+// Discord のユーザーID (snowflake) は17〜20桁の数字
+var discordIDPattern = regexp.MustCompile(`^[0-9]{17,20}$`)
+
+func IsValidDiscordID(discordID string) bool {
+	return discordIDPattern.MatchString(discordID)
+}
+
+// 整数の環境変数。未設定の場合と、整数でないか min 未満の場合は fallback
+// 0 で無効にする設定は min を 0 に、0 を受け付けない設定は 1 にする
+func GetEnvInt(name string, fallback, min int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min {
+		slog.Warn(name+" が不正です", "value", value)
+		return fallback
+	}
+	return n
+}
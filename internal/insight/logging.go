@@ -0,0 +1,120 @@
+package insight
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/bwmarrin/discordgo"
+)
+
+// ログで値の代わりに出力する文字列
+const redacted = "[REDACTED]"
+
+// キーがこれらに一致する文字列などの属性は値を出力しない
+// 部分一致にすると "discord_token_set" や件数の "tokens" まで隠れてしまうため、完全一致で比べる
+var sensitiveKeys = []string{"token", "discord_token", "api_token", "authorization", "secret", "password"}
+
+// 値がログに含まれても出力しない環境変数
+var secretEnvs = []string{"DISCORD_TOKEN"}
+
+// Discord のセッションなどトークンを持つ型のパッケージ。この型の値は出力しない
+var redactedPackage = reflect.TypeOf((*discordgo.Session)(nil)).Elem().PkgPath()
+
+type runIDKey struct{}
+
+// 実行を開始する。実行IDを ctx に保存し、以降のログに run_id と action を付ける
+// Lambda は1つの実行環境で同時に1つの呼び出ししか処理しないため、既定のロガーを置き換える
+func StartRun(ctx context.Context, action string) context.Context {
+	runID := newRunID(ctx)
+	slog.SetDefault(NewLogger(os.Stderr).With("run_id", runID, "action", action))
+	return context.WithValue(ctx, runIDKey{}, runID)
+}
+
+// StartRun で保存した実行ID。StartRun していない場合は空
+func RunID(ctx context.Context) string {
+	runID, _ := ctx.Value(runIDKey{}).(string)
+	return runID
+}
+
+// Lambda のリクエストIDを実行IDにする。Lambda でない場合（devinsight）は時刻と乱数から作る
+func newRunID(ctx context.Context) string {
+	if lc, ok := lambdacontext.FromContext(ctx); ok && lc.AwsRequestID != "" {
+		return lc.AwsRequestID
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+	return "local-" + time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(b)
+}
+
+// LOG_LEVEL（debug, info, warn, error。省略時: info）以上のログを JSON で出力するロガー
+// LOG_FORMAT=text の場合はテキストで出力する（ローカルでの確認用）
+func NewLogger(w io.Writer) *slog.Logger {
+	options := &slog.HandlerOptions{Level: logLevel(), ReplaceAttr: redactAttr}
+	if os.Getenv("LOG_FORMAT") == "text" {
+		return slog.New(slog.NewTextHandler(w, options))
+	}
+	return slog.New(slog.NewJSONHandler(w, options))
+}
+
+func logLevel() slog.Level {
+	var level slog.Level
+	value := os.Getenv("LOG_LEVEL")
+	if value == "" {
+		return slog.LevelInfo
+	}
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		slog.Warn("LOG_LEVEL が不正です", "value", value)
+		return slog.LevelInfo
+	}
+	return level
+}
+
+// トークンなどの秘密の値と Discord のセッションの内部をログから取り除き、時間を読みやすい形式にする
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if kind := a.Value.Kind(); kind == slog.KindString || kind == slog.KindAny {
+		key := strings.ToLower(a.Key)
+		for _, sensitive := range sensitiveKeys {
+			if key == sensitive {
+				return slog.String(a.Key, redacted)
+			}
+		}
+	}
+	switch a.Value.Kind() {
+	case slog.KindDuration:
+		// ナノ秒の数値ではなく "1.5s" のように出力する
+		return slog.String(a.Key, a.Value.Duration().Round(time.Millisecond).String())
+	case slog.KindString:
+		return slog.String(a.Key, redactSecrets(a.Value.String()))
+	case slog.KindAny:
+		value := a.Value.Any()
+		if err, ok := value.(error); ok {
+			return slog.String(a.Key, redactSecrets(err.Error()))
+		}
+		t := reflect.TypeOf(value)
+		for t != nil && (t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice || t.Kind() == reflect.Map) {
+			t = t.Elem()
+		}
+		if t != nil && t.PkgPath() == redactedPackage {
+			return slog.String(a.Key, redacted)
+		}
+	}
+	return a
+}
+
+// 秘密の環境変数の値を文字列から取り除く
+func redactSecrets(s string) string {
+	for _, name := range secretEnvs {
+		if secret := os.Getenv(name); len(secret) >= 8 {
+			s = strings.ReplaceAll(s, secret, redacted)
+		}
+	}
+	return s
+}
@@ -0,0 +1,82 @@
+package insight
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestRedactAttr(t *testing.T) {
+	const token = "MTIzNDU2Nzg5.discord-bot-token"
+	t.Setenv("DISCORD_TOKEN", token)
+
+	tests := []struct {
+		name string
+		attr slog.Attr
+		want slog.Value
+	}{
+		{"token", slog.String("token", "waka_secret"), slog.StringValue(redacted)},
+		{"case insensitive", slog.String("Authorization", "Bearer waka_secret"), slog.StringValue(redacted)},
+		{"api token", slog.Any("api_token", []byte("waka_secret")), slog.StringValue(redacted)},
+		{"password", slog.String("password", "hunter2"), slog.StringValue(redacted)},
+		{"secret", slog.Any("secret", errors.New("value")), slog.StringValue(redacted)},
+		// 真偽値と件数は秘密の値ではない
+		{"token flag", slog.Bool("discord_token_set", true), slog.BoolValue(true)},
+		{"bool with a sensitive key", slog.Bool("token", true), slog.BoolValue(true)},
+		{"token count", slog.Int("tokens", 3), slog.IntValue(3)},
+		{"count with a sensitive key", slog.Int("secret", 3), slog.IntValue(3)},
+		{"key containing token", slog.String("token_source", "env"), slog.StringValue("env")},
+		{"token in a string", slog.String("message", "Bot "+token+" failed"), slog.StringValue("Bot " + redacted + " failed")},
+		{"token in an error", slog.Any("error", errors.New("401 for "+token)), slog.StringValue("401 for " + redacted)},
+		{"session", slog.Any("session", &discordgo.Session{Token: "Bot " + token}), slog.StringValue(redacted)},
+		{"sessions", slog.Any("sessions", []*discordgo.Session{{Token: "Bot " + token}}), slog.StringValue(redacted)},
+		{"duration", slog.Duration("elapsed", 1500*time.Millisecond+123*time.Microsecond), slog.StringValue("1.5s")},
+		{"plain string", slog.String("step", "ranking"), slog.StringValue("ranking")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := redactAttr(nil, tt.attr)
+			if got.Key != tt.attr.Key {
+				t.Errorf("key = %q, want %q", got.Key, tt.attr.Key)
+			}
+			if !got.Value.Equal(tt.want) {
+				t.Errorf("value = %v, want %v", got.Value, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactSecretsShortValue(t *testing.T) {
+	// 短い値は一般的な文字列と一致してしまうため置き換えない
+	t.Setenv("DISCORD_TOKEN", "abc")
+	if got := redactSecrets("abc def"); got != "abc def" {
+		t.Errorf("redactSecrets() = %q, want the string unchanged", got)
+	}
+	t.Setenv("DISCORD_TOKEN", "")
+	if got := redactSecrets("abc def"); got != "abc def" {
+		t.Errorf("redactSecrets() = %q, want the string unchanged", got)
+	}
+}
+
+func TestNewLoggerRedacts(t *testing.T) {
+	const token = "MTIzNDU2Nzg5.discord-bot-token"
+	t.Setenv("DISCORD_TOKEN", token)
+	for _, format := range []string{"", "text"} {
+		t.Run(format, func(t *testing.T) {
+			t.Setenv("LOG_FORMAT", format)
+			var buf bytes.Buffer
+			NewLogger(&buf).Info("投稿に失敗しました", "token", token, "error", errors.New("401 for "+token), "discord_token_set", true)
+			if strings.Contains(buf.String(), token) {
+				t.Errorf("log contains the token: %s", buf.String())
+			}
+			if !strings.Contains(buf.String(), "discord_token_set") || !strings.Contains(buf.String(), "true") {
+				t.Errorf("log lost the flag: %s", buf.String())
+			}
+		})
+	}
+}
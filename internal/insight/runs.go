@@ -0,0 +1,311 @@
+package insight
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// 処理を続けたまま記録した失敗
+type Failure struct {
+	Step      string    `json:"step"`             // aggregate, members, post, dm, roles など
+	Target    string    `json:"target,omitempty"` // 失敗したユーザー・サーバー・チャンネルのID
+	Kind      ErrorKind `json:"kind,omitempty"`
+	Retryable bool      `json:"retryable"` // 再試行しても解決しなかった一時的なエラー（再実行で成功する可能性がある）
+	Error     string    `json:"error"`
+}
+
+// 投稿したメッセージ
+type PostedMessage struct {
+	Kind      string `json:"kind"` // post, live, thread, moderator, dm
+	ChannelID string `json:"channel_id"`
+	MessageID string `json:"message_id"`
+}
+
+// サーバーごとに変更したロールの数
+type RoleChange struct {
+	GuildID  string `json:"guild_id"`
+	Assigned int    `json:"assigned"` // メンバーに付与したロール
+	Deleted  int    `json:"deleted"`  // 付け直す前に削除した bot のロール
+}
+
+// 実行の要約。投稿したメッセージ・変更したロールと、
+// 1人・1か所の失敗で処理を止めずに記録した失敗をまとめ、最後に報告する
+// nil の場合は記録しない
+type RunSummary struct {
+	mu       sync.Mutex
+	Failures []Failure       `json:"failures,omitempty"`
+	Skipped  []string        `json:"skipped,omitempty"` // 実行期限までに集計できなかったユーザー
+	Messages []PostedMessage `json:"messages,omitempty"`
+	Roles    []RoleChange    `json:"roles,omitempty"`
+}
+
+// 失敗を記録する
+func (s *RunSummary) Record(step, target string, err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Failures = append(s.Failures, Failure{
+		Step:      step,
+		Target:    target,
+		Kind:      KindOf(err),
+		Retryable: IsRetryable(err),
+		Error:     err.Error(),
+	})
+}
+
+// 投稿したメッセージを記録する
+func (s *RunSummary) RecordMessage(kind, channelID, messageID string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Messages = append(s.Messages, PostedMessage{Kind: kind, ChannelID: channelID, MessageID: messageID})
+}
+
+// サーバーで変更したロールの数を記録する
+func (s *RunSummary) RecordRoles(guildID string, assigned, deleted int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Roles = append(s.Roles, RoleChange{GuildID: guildID, Assigned: assigned, Deleted: deleted})
+}
+
+// 集計に失敗したユーザーと未集計のユーザーを記録する
+func (s *RunSummary) RecordAggregation(aggregation *Aggregation) {
+	if s == nil {
+		return
+	}
+	for _, failure := range aggregation.Failures {
+		s.Record("aggregate", failure.DiscordID, failure.Err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Skipped = append(s.Skipped, aggregation.Skipped...)
+}
+
+// 失敗した処理があるか
+func (s *RunSummary) Failed() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.Failures) > 0
+}
+
+// 失敗した処理をログに出力する
+func (s *RunSummary) Log() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.Skipped) > 0 {
+		slog.Warn("実行期限までに集計できなかったユーザーがいます", "step", "aggregate", "skipped", s.Skipped)
+	}
+	if len(s.Failures) == 0 {
+		slog.Info("失敗した処理はありません")
+		return
+	}
+	for _, failure := range s.Failures {
+		slog.Warn("失敗した処理", "step", failure.Step, "target", failure.Target, "kind", failure.Kind, "retryable", failure.Retryable, "error", failure.Error)
+	}
+	slog.Warn("失敗した処理があります", "failures", len(s.Failures))
+}
+
+// 実行履歴を保存する処理
+var RunActions = []string{"ranking", "roles", "combined"}
+
+// 実行履歴を action ごとに新しい順に取得するインデックス（パーティションキー: action、ソートキー: started_at）
+const RunsActionIndexName = "action-started_at-index"
+
+// 実行履歴に保存する失敗の上限。DynamoDB のアイテムの上限 (400KB) を超えないよう、残りは件数だけを保存する
+const maxRecordedFailures = 100
+
+// 実行履歴のテーブルのアイテム。ランキング・ロール付与の実行ごとに保存する
+type RunRecord struct {
+	RunID        string          `json:"run_id"`
+	Action       string          `json:"action"` // ranking, roles, combined
+	Period       string          `json:"period,omitempty"`
+	StartedAt    string          `json:"started_at"`
+	WindowFrom   string          `json:"window_from,omitempty"` // 集計した期間
+	WindowTo     string          `json:"window_to,omitempty"`
+	Users        int             `json:"users"`         // 集計したユーザー数
+	TotalMinutes int64           `json:"total_minutes"` // 集計したユーザーの作業時間の合計（分）
+	Messages     []PostedMessage `json:"messages,omitempty"`
+	Roles        []RoleChange    `json:"roles,omitempty"`
+	Failures     []Failure       `json:"failures,omitempty"`      // 最初の maxRecordedFailures 件
+	FailureCount int             `json:"failure_count,omitempty"` // 失敗の件数（保存しなかった分も含む）
+	Skipped      int             `json:"skipped,omitempty"`       // 実行期限までに集計できなかったユーザー数
+	Error        string          `json:"error,omitempty"`
+	DurationMs   int64           `json:"duration_ms"`
+}
+
+// 実行の結果から実行履歴を作る。集計前に失敗した場合、aggregation は nil
+func NewRunRecord(ctx context.Context, action, period string, started time.Time, aggregation *Aggregation, summary *RunSummary, err error) RunRecord {
+	runID := RunID(ctx)
+	if runID == "" {
+		runID = newRunID(ctx)
+	}
+	record := RunRecord{
+		RunID:      runID,
+		Action:     action,
+		Period:     period,
+		StartedAt:  started.UTC().Format(time.RFC3339),
+		DurationMs: time.Since(started).Milliseconds(),
+	}
+	if aggregation != nil {
+		record.WindowFrom = aggregation.From.Format(time.RFC3339)
+		record.WindowTo = aggregation.To.Format(time.RFC3339)
+		record.Users = len(aggregation.Data)
+		var total time.Duration
+		for _, entry := range aggregation.Data {
+			total += entry.TotalTime
+		}
+		record.TotalMinutes = int64(total / time.Minute)
+	}
+	if summary != nil {
+		summary.mu.Lock()
+		record.Messages = summary.Messages
+		record.Roles = summary.Roles
+		record.Failures = summary.Failures
+		record.FailureCount = len(summary.Failures)
+		if len(record.Failures) > maxRecordedFailures {
+			record.Failures = record.Failures[:maxRecordedFailures:maxRecordedFailures]
+		}
+		record.Skipped = len(summary.Skipped)
+		summary.mu.Unlock()
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	return record
+}
+
+// 実行履歴を保存する。保存に失敗しても実行の結果は変えない
+func SaveRun(ctx context.Context, svc *dynamodb.DynamoDB, record RunRecord) {
+	item, err := dynamodbattribute.MarshalMap(record)
+	if err != nil {
+		slog.Error("実行履歴のマーシャルに失敗", "error", err)
+		return
+	}
+	err = Retry(ctx, "put "+RunsTableName, func() error {
+		_, err := svc.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(RunsTableName),
+			Item:      item,
+		})
+		return err
+	})
+	if err != nil {
+		slog.Error("実行履歴の保存に失敗", "kind", KindStore, "error", err)
+		return
+	}
+	slog.Info("実行履歴を保存しました", "users", record.Users, "messages", len(record.Messages), "duration", time.Duration(record.DurationMs)*time.Millisecond)
+}
+
+// 失敗の件数。failure_count のない実行履歴は保存した失敗の数
+func (r *RunRecord) TotalFailures() int {
+	if r.FailureCount > 0 {
+		return r.FailureCount
+	}
+	return len(r.Failures)
+}
+
+// 実行履歴を新しい順に返す。action を指定した場合はその処理のみ（空の場合は RunActions のすべて）
+// limit が正の場合は、処理ごとに新しいものから limit 件まで取得する
+func ListRuns(ctx context.Context, svc *dynamodb.DynamoDB, action string, limit int) ([]RunRecord, error) {
+	actions := RunActions
+	if action != "" {
+		actions = []string{action}
+	}
+	var runs []RunRecord
+	for _, action := range actions {
+		page, err := queryRuns(ctx, svc, action, limit)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, page...)
+	}
+	// RFC3339（UTC）の文字列は時刻順に並ぶ
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].StartedAt > runs[j].StartedAt
+	})
+	return runs, nil
+}
+
+// action の実行履歴をインデックスから新しい順に取得する
+func queryRuns(ctx context.Context, svc *dynamodb.DynamoDB, action string, limit int) ([]RunRecord, error) {
+	var runs []RunRecord
+	var lastKey map[string]*dynamodb.AttributeValue
+	for {
+		input := &dynamodb.QueryInput{
+			TableName:              aws.String(RunsTableName),
+			IndexName:              aws.String(RunsActionIndexName),
+			KeyConditionExpression: aws.String("#action = :action"),
+			ExpressionAttributeNames: map[string]*string{
+				"#action": aws.String("action"),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":action": {S: aws.String(action)},
+			},
+			ScanIndexForward:  aws.Bool(false),
+			ExclusiveStartKey: lastKey,
+		}
+		if limit > 0 {
+			input.Limit = aws.Int64(int64(limit - len(runs)))
+		}
+		var result *dynamodb.QueryOutput
+		err := Retry(ctx, "query "+RunsTableName, func() error {
+			var err error
+			result, err = svc.QueryWithContext(ctx, input)
+			return err
+		})
+		if err != nil {
+			return nil, &AppError{Kind: KindStore, Message: "実行履歴の取得に失敗", Err: err}
+		}
+		var page []RunRecord
+		if err := dynamodbattribute.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return nil, &AppError{Kind: KindData, Message: "実行履歴のアンマーシャルに失敗", Err: err}
+		}
+		runs = append(runs, page...)
+		lastKey = result.LastEvaluatedKey
+		if lastKey == nil || (limit > 0 && len(runs) >= limit) {
+			return runs, nil
+		}
+	}
+}
+
+// 新しい順の実行履歴から、チャンネルに最後に投稿した kind のメッセージを探す。ない場合は nil
+func LatestMessage(runs []RunRecord, kind, channelID string) *PostedMessage {
+	for _, run := range runs {
+		for i := len(run.Messages) - 1; i >= 0; i-- {
+			if run.Messages[i].Kind == kind && run.Messages[i].ChannelID == channelID {
+				return &run.Messages[i]
+			}
+		}
+	}
+	return nil
+}
+
+// runs[i] より前の、同じ処理・期間の実行（週ごとの比較に使う）。ない場合は nil
+// runs は ListRuns と同じく新しい順
+func PreviousRun(runs []RunRecord, i int) *RunRecord {
+	for j := i + 1; j < len(runs); j++ {
+		if runs[j].Action == runs[i].Action && runs[j].Period == runs[i].Period && runs[j].Error == "" {
+			return &runs[j]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package insight
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestNewRunRecordFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		saved    int
+		count    int
+	}{
+		{"no failures", 0, 0, 0},
+		{"under the cap", 3, 3, 3},
+		{"at the cap", maxRecordedFailures, maxRecordedFailures, maxRecordedFailures},
+		{"over the cap", maxRecordedFailures + 50, maxRecordedFailures, maxRecordedFailures + 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			summary := &RunSummary{}
+			for i := 0; i < tt.failures; i++ {
+				summary.Record("dm", fmt.Sprint(i), errors.New("failed"))
+			}
+			record := NewRunRecord(context.Background(), "ranking", "", time.Now(), nil, summary, nil)
+			if len(record.Failures) != tt.saved {
+				t.Errorf("saved %d failures, want %d", len(record.Failures), tt.saved)
+			}
+			if record.TotalFailures() != tt.count {
+				t.Errorf("TotalFailures() = %d, want %d", record.TotalFailures(), tt.count)
+			}
+			// 実行の要約の失敗は切り詰めない
+			if len(summary.Failures) != tt.failures {
+				t.Errorf("summary has %d failures, want %d", len(summary.Failures), tt.failures)
+			}
+		})
+	}
+
+	// failure_count のない実行履歴
+	old := RunRecord{Failures: []Failure{{Step: "dm"}, {Step: "post"}}}
+	if old.TotalFailures() != 2 {
+		t.Errorf("TotalFailures() = %d, want 2", old.TotalFailures())
+	}
+}
+
+func TestLatestMessage(t *testing.T) {
+	// 新しい順
+	runs := []RunRecord{
+		{RunID: "3", Messages: []PostedMessage{{Kind: "post", ChannelID: "c1", MessageID: "m5"}}},
+		{RunID: "2", Messages: []PostedMessage{
+			{Kind: "live", ChannelID: "c1", MessageID: "m3"},
+			{Kind: "thread", ChannelID: "c1", MessageID: "m4"},
+		}},
+		{RunID: "1", Messages: []PostedMessage{
+			{Kind: "live", ChannelID: "c1", MessageID: "m1"},
+			{Kind: "live", ChannelID: "c2", MessageID: "m2"},
+		}},
+	}
+	tests := []struct {
+		kind, channelID string
+		want            string // 空の場合は nil
+	}{
+		{"live", "c1", "m3"},
+		{"live", "c2", "m2"},
+		{"live", "c3", ""},
+		{"post", "c1", "m5"},
+		{"dm", "c1", ""},
+	}
+	for _, tt := range tests {
+		got := LatestMessage(runs, tt.kind, tt.channelID)
+		switch {
+		case tt.want == "" && got != nil:
+			t.Errorf("LatestMessage(%s, %s) = %+v, want nil", tt.kind, tt.channelID, got)
+		case tt.want != "" && (got == nil || got.MessageID != tt.want):
+			t.Errorf("LatestMessage(%s, %s) = %+v, want %s", tt.kind, tt.channelID, got, tt.want)
+		}
+	}
+}
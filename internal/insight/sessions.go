@@ -0,0 +1,74 @@
+package insight
+
+import (
+	"sort"
+	"time"
+)
+
+// この間隔より空いたら別のセッションとして集計する
+const SessionGap = 5 * time.Minute
+
+// 集計に使うハートビート
+type Heartbeat struct {
+	Time     time.Time
+	Language string
+	Project  string
+	Machine  string
+}
+
+type SessionTime struct {
+	Start    time.Time
+	End      time.Time
+	Language string
+	Project  string
+}
+
+func SortHeartbeats(heartbeats []Heartbeat) {
+	sort.SliceStable(heartbeats, func(i, j int) bool {
+		return heartbeats[i].Time.Before(heartbeats[j].Time)
+	})
+}
+
+// セッションの言語とプロジェクトは、セッションの最初のハートビートのものとする（時刻順に並んでいること）
+func CalculateSessionTimes(heartbeats []Heartbeat) ([]SessionTime, map[string]time.Duration, map[string]time.Duration) {
+	var sessionTimes []SessionTime
+	if len(heartbeats) == 0 {
+		languageDurations, projectDurations := SummarizeSessions(sessionTimes)
+		return sessionTimes, languageDurations, projectDurations
+	}
+
+	first := heartbeats[0]
+	current := SessionTime{Start: first.Time, End: first.Time, Language: first.Language, Project: first.Project}
+	for _, heartbeat := range heartbeats[1:] {
+		if heartbeat.Time.Sub(current.End) > SessionGap {
+			sessionTimes = append(sessionTimes, current)
+			current = SessionTime{Start: heartbeat.Time, Language: heartbeat.Language, Project: heartbeat.Project}
+		}
+		current.End = heartbeat.Time
+	}
+	sessionTimes = append(sessionTimes, current)
+	languageDurations, projectDurations := SummarizeSessions(sessionTimes)
+	return sessionTimes, languageDurations, projectDurations
+}
+
+// セッションから言語ごと・プロジェクトごとの時間を集計する
+// プロジェクトが送信されていないハートビートはプロジェクト別の集計に含めない
+func SummarizeSessions(sessions []SessionTime) (map[string]time.Duration, map[string]time.Duration) {
+	languageDurations := make(map[string]time.Duration)
+	projectDurations := make(map[string]time.Duration)
+	for _, session := range sessions {
+		languageDurations[session.Language] += session.End.Sub(session.Start)
+		if session.Project != "" {
+			projectDurations[session.Project] += session.End.Sub(session.Start)
+		}
+	}
+	return languageDurations, projectDurations
+}
+
+func TotalWorkTime(sessionTimes []SessionTime) time.Duration {
+	var totalTime time.Duration
+	for _, session := range sessionTimes {
+		totalTime += session.End.Sub(session.Start)
+	}
+	return totalTime
+}
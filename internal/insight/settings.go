@@ -0,0 +1,93 @@
+package insight
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// ユーザーごとのプライバシー設定（dev_time_api の設定APIで更新する）
+type UserSettings struct {
+	DiscordID                   string   `json:"discord_id"`
+	HideProjectNames            bool     `json:"hide_project_names"`            // すべてのプロジェクト名を非公開にする
+	PrivateProjects             []string `json:"private_projects"`              // 名前を非公開にするプロジェクト
+	LeaderboardProjects         []string `json:"leaderboard_projects"`          // ランキングに含めるプロジェクト（空の場合はすべて）
+	LeaderboardExcludedProjects []string `json:"leaderboard_excluded_projects"` // ランキングに含めないプロジェクト
+	WeeklySummaryDM             bool     `json:"weekly_summary_dm"`             // 週間の集計を DM で受け取る
+	EntitySalt                  string   `json:"entity_salt,omitempty"`         // ファイルパスのハッシュに使うユーザーごとのソルト（APIでは返さない）
+	UpdatedAt                   string   `json:"updated_at,omitempty"`
+}
+
+// 非公開のプロジェクトをまとめる集計上のキー（表示時にロケールの表示名に置き換える）
+const PrivateProjectKey = "\x00private"
+
+// ランキングに含めるプロジェクトか
+func (s *UserSettings) isLeaderboardProject(project string) bool {
+	if len(s.LeaderboardProjects) > 0 && !containsString(s.LeaderboardProjects, project) {
+		return false
+	}
+	return !containsString(s.LeaderboardExcludedProjects, project)
+}
+
+// ランキングでのプロジェクトの表示名
+func (s *UserSettings) displayProject(project string) string {
+	if project != "" && (s.HideProjectNames || containsString(s.PrivateProjects, project)) {
+		return PrivateProjectKey
+	}
+	return project
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ユーザー設定を取得する。設定がない場合は既定値を返す
+func GetUserSettings(ctx context.Context, svc *dynamodb.DynamoDB, discordID string) (*UserSettings, error) {
+	var result *dynamodb.GetItemOutput
+	err := Retry(ctx, "get "+UserSettingsTableName, func() error {
+		var err error
+		result, err = svc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+			TableName: aws.String(UserSettingsTableName),
+			Key: map[string]*dynamodb.AttributeValue{
+				"discord_id": {S: aws.String(discordID)},
+			},
+		})
+		return err
+	})
+	if err != nil {
+		return nil, &AppError{Kind: KindStore, Message: "ユーザー設定の取得に失敗", Err: err}
+	}
+	settings := &UserSettings{DiscordID: discordID}
+	if result.Item == nil {
+		return settings, nil
+	}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, settings); err != nil {
+		return nil, &AppError{Kind: KindData, Message: "ユーザー設定のアンマーシャルに失敗", Err: err}
+	}
+	return settings, nil
+}
+
+// ランキングに含めないプロジェクトのハートビートを除き、非公開のプロジェクト名を隠す
+// 本人向けの集計（DiscordWorkTime の Personal*）は、この関数を適用する前のハートビートから集計する
+func ApplyUserSettings(settings *UserSettings, heartbeats []Heartbeat) []Heartbeat {
+	var filtered []Heartbeat
+	for _, heartbeat := range heartbeats {
+		if !settings.isLeaderboardProject(heartbeat.Project) {
+			continue
+		}
+		heartbeat.Project = settings.displayProject(heartbeat.Project)
+		filtered = append(filtered, heartbeat)
+	}
+	if excluded := len(heartbeats) - len(filtered); excluded > 0 {
+		slog.Debug("ランキングの設定でハートビートを除外しました", "discord_id", settings.DiscordID, "excluded", excluded)
+	}
+	return filtered
+}
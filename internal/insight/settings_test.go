@@ -0,0 +1,75 @@
+package insight
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyUserSettings(t *testing.T) {
+	// 送信されたハートビートのプロジェクト（"" はプロジェクトなし）
+	projects := []string{"devinsight", "secret", "side", ""}
+
+	tests := []struct {
+		name     string
+		settings UserSettings
+		want     []string // 残るハートビートのプロジェクト
+	}{
+		{"default", UserSettings{}, []string{"devinsight", "secret", "side", ""}},
+		{
+			"leaderboard projects",
+			UserSettings{LeaderboardProjects: []string{"devinsight", "side"}},
+			[]string{"devinsight", "side"},
+		},
+		{
+			"excluded projects",
+			UserSettings{LeaderboardExcludedProjects: []string{"side"}},
+			[]string{"devinsight", "secret", ""},
+		},
+		{
+			"excluded wins over leaderboard projects",
+			UserSettings{LeaderboardProjects: []string{"devinsight", "side"}, LeaderboardExcludedProjects: []string{"side"}},
+			[]string{"devinsight"},
+		},
+		{
+			"private projects",
+			UserSettings{PrivateProjects: []string{"secret"}},
+			[]string{"devinsight", PrivateProjectKey, "side", ""},
+		},
+		{
+			"hide project names",
+			UserSettings{HideProjectNames: true},
+			[]string{PrivateProjectKey, PrivateProjectKey, PrivateProjectKey, ""},
+		},
+		{
+			"private and excluded",
+			UserSettings{PrivateProjects: []string{"secret"}, LeaderboardExcludedProjects: []string{"devinsight"}},
+			[]string{PrivateProjectKey, "side", ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var heartbeats []Heartbeat
+			for i, project := range projects {
+				heartbeats = append(heartbeats, Heartbeat{Time: fairnessBase.Add(time.Duration(i) * time.Minute), Language: "go", Project: project})
+			}
+			got := ApplyUserSettings(&tt.settings, heartbeats)
+			var gotProjects []string
+			for _, heartbeat := range got {
+				gotProjects = append(gotProjects, heartbeat.Project)
+				if heartbeat.Language != "go" {
+					t.Errorf("language = %q, want go", heartbeat.Language)
+				}
+			}
+			if strings.Join(gotProjects, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("projects = %q, want %q", gotProjects, tt.want)
+			}
+			// 本人向けの集計に使う元のハートビートは変更しない
+			for i, heartbeat := range heartbeats {
+				if heartbeat.Project != projects[i] {
+					t.Errorf("heartbeats[%d].Project = %q, want %q", i, heartbeat.Project, projects[i])
+				}
+			}
+		})
+	}
+}
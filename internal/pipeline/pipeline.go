@@ -0,0 +1,241 @@
+// Package pipeline は1回の集計結果を、ランキングの投稿・ロール付与・DM・エクスポートで共有して実行する
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/kkaiki/DevInsight/internal/insight"
+	"github.com/kkaiki/DevInsight/internal/purge"
+	"github.com/kkaiki/DevInsight/internal/ranking"
+	"github.com/kkaiki/DevInsight/internal/roles"
+)
+
+// 集計結果を使う処理
+const (
+	ConsumerRanking = "ranking" // ランキングの投稿
+	ConsumerRoles   = "roles"   // 言語ロールの付与
+	ConsumerDM      = "dm"      // 週間の集計の DM
+	ConsumerExport  = "export"  // 集計結果のファイル出力
+)
+
+// 処理を指定しない場合はランキングとロール付与を実行する
+var defaultConsumers = []string{ConsumerRanking, ConsumerRoles}
+
+// EventBridge から渡されるイベント
+type Event struct {
+	Period    string   `json:"period"`    // "weekly" の場合は最終ランキングとして投稿
+	Consumers []string `json:"consumers"` // 実行する処理（省略時は ranking, roles）
+	Export    string   `json:"export"`    // export の保存先（ローカルディレクトリまたは s3://bucket/prefix）
+}
+
+// 実行時の設定（devinsight combined で変更する）
+type Options struct {
+	Apply   bool      // false の場合は投稿・ロールの変更・DM を行わず、Output に書き出す
+	GuildID string    // 指定した場合はこのサーバーのみを対象にする
+	Output  io.Writer // 実行しない場合の書き出し先
+}
+
+// 処理ごとの結果
+type ConsumerResult struct {
+	Name     string `json:"name"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+type Result struct {
+	Users        int                     `json:"users"`                   // 集計したユーザー数
+	SkippedUsers []string                `json:"skipped_users,omitempty"` // 実行期限までに集計できなかったユーザー
+	Failures     []insight.Failure       `json:"failures,omitempty"`      // 集計・各処理で失敗したユーザー・投稿先
+	Messages     []insight.PostedMessage `json:"messages,omitempty"`      // 投稿したメッセージ
+	Roles        []insight.RoleChange    `json:"roles,omitempty"`         // サーバーごとに変更したロールの数
+	Consumers    []ConsumerResult        `json:"consumers"`
+}
+
+// 集計を1回だけ行い、指定した処理を順に実行する
+// 1つの処理の失敗で他の処理を止めず、失敗した処理があればエラーを返す
+// 実行した場合（Apply）は結果を実行履歴に保存する
+func Run(ctx context.Context, event Event, options Options) (result *Result, err error) {
+	runStarted := time.Now()
+	consumers := event.Consumers
+	if len(consumers) == 0 {
+		consumers = defaultConsumers
+	}
+	for _, name := range consumers {
+		switch name {
+		case ConsumerRanking, ConsumerRoles, ConsumerDM:
+		case ConsumerExport:
+			if event.Export == "" {
+				return nil, fmt.Errorf("export を実行するには保存先 (export) を指定してください")
+			}
+		default:
+			return nil, fmt.Errorf("不明な処理です: %q（%s, %s, %s, %s のいずれかを指定してください）", name, ConsumerRanking, ConsumerRoles, ConsumerDM, ConsumerExport)
+		}
+	}
+
+	summary := &insight.RunSummary{}
+	var aggregation *insight.Aggregation
+	if options.Apply {
+		defer func() {
+			insight.SaveRun(ctx, insight.DB, insight.NewRunRecord(ctx, "combined", event.Period, runStarted, aggregation, summary, err))
+		}()
+	}
+
+	// 実行期限が近づいたら集計を打ち切り、残りの時間で各処理を実行する
+	startDate := insight.PeriodStart(time.Now())
+	aggregateCtx, cancel := insight.AggregateContext(ctx)
+	defer cancel()
+	aggregation, err = insight.Aggregate(aggregateCtx, insight.DB, startDate)
+	if err != nil {
+		return nil, fmt.Errorf("データの集計に失敗: %w", err)
+	}
+	// 空の集計でロールを付け直すと全員のロールが外れるため、どの処理も実行しない
+	if len(aggregation.Data) == 0 {
+		return nil, &insight.AppError{
+			Kind:    insight.KindData,
+			Message: fmt.Sprintf("対象期間内に集計可能なデータがありません（集計に失敗: %d人, 未集計: %d人）", len(aggregation.Failures), len(aggregation.Skipped)),
+		}
+	}
+	data := aggregation.Data
+	slog.Info("集計が完了しました", "step", "aggregate", "users", len(data), "consumers", consumers)
+
+	result = &Result{Users: len(data), SkippedUsers: aggregation.Skipped}
+	summary.RecordAggregation(aggregation)
+	var failed []string
+	for _, name := range consumers {
+		started := time.Now()
+		var err error
+		switch name {
+		case ConsumerRanking:
+			err = ranking.Deliver(ctx, ranking.RankingEvent{Period: event.Period}, ranking.Options{
+				Post:    options.Apply,
+				GuildID: options.GuildID,
+				Output:  options.Output,
+				Summary: summary,
+			}, aggregation)
+		case ConsumerRoles:
+			// 途中までの集計や集計に失敗したユーザーがいる集計でロールを付け直すと、集計できなかったユーザーのロールが外れる
+			if aggregation.Partial() {
+				err = &insight.AppError{
+					Kind:    insight.KindData,
+					Message: fmt.Sprintf("集計が実行期限で打ち切られたため、ロールを変更しませんでした（未集計: %d人）", len(aggregation.Skipped)),
+				}
+				break
+			}
+			if len(aggregation.Failures) > 0 {
+				err = &insight.AppError{
+					Kind:    insight.KindData,
+					Message: fmt.Sprintf("集計に失敗したユーザーがいるため、ロールを変更しませんでした（集計に失敗: %d人）", len(aggregation.Failures)),
+				}
+				break
+			}
+			err = roles.Assign(ctx, data, roles.Options{
+				Apply:   options.Apply,
+				GuildID: options.GuildID,
+				Output:  options.Output,
+				Summary: summary,
+			})
+		case ConsumerDM:
+			// ランキングに含めないユーザーにも本人向けの集計を送る
+			err = ranking.SendSummaries(ctx, append(data[:len(data):len(data)], aggregation.Personal...), ranking.Options{
+				Post:    options.Apply,
+				Output:  options.Output,
+				Summary: summary,
+			})
+		case ConsumerExport:
+			err = exportWorkTimes(ctx, event.Export, startDate, aggregation)
+		}
+
+		consumerResult := ConsumerResult{
+			Name:     name,
+			OK:       err == nil,
+			Duration: time.Since(started).Round(time.Millisecond).String(),
+		}
+		if err != nil {
+			slog.Error("処理に失敗", "step", name, "kind", insight.KindOf(err), "duration", time.Since(started), "error", err)
+			consumerResult.Error = err.Error()
+			summary.Record(name, "", err)
+			failed = append(failed, name)
+		} else {
+			slog.Info("処理を実行しました", "step", name, "duration", time.Since(started))
+		}
+		result.Consumers = append(result.Consumers, consumerResult)
+	}
+	summary.Log()
+	result.Failures = summary.Failures
+	result.Messages = summary.Messages
+	result.Roles = summary.Roles
+
+	if len(failed) > 0 {
+		return result, fmt.Errorf("%d/%d件の処理に失敗: %v", len(failed), len(consumers), failed)
+	}
+	return result, nil
+}
+
+// エクスポートするユーザーごとの集計（時間は分）
+type exportEntry struct {
+	DiscordID    string           `json:"discord_id"`
+	TotalMinutes int64            `json:"total_minutes"`
+	Languages    map[string]int64 `json:"languages"`
+	Projects     map[string]int64 `json:"projects"`
+	Anomalies    int              `json:"anomalies"` // 検出した不自然な作業記録の件数
+}
+
+type exportFile struct {
+	From    string        `json:"from"`
+	To      string        `json:"to"`
+	Users   []exportEntry `json:"users"`
+	Skipped []string      `json:"skipped,omitempty"` // 実行期限までに集計できなかったユーザー
+}
+
+// 集計結果を JSON で保存する。非公開のプロジェクトは "private" としてまとめる
+func exportWorkTimes(ctx context.Context, destination string, startDate time.Time, aggregation *insight.Aggregation) error {
+	store, err := purge.NewArchiveStore(insight.Session, destination)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	file := exportFile{
+		From:    startDate.Format(time.RFC3339),
+		To:      now.Format(time.RFC3339),
+		Users:   []exportEntry{},
+		Skipped: aggregation.Skipped,
+	}
+	for _, entry := range aggregation.Data {
+		exported := exportEntry{
+			DiscordID:    entry.DiscordID,
+			TotalMinutes: int64(entry.TotalTime / time.Minute),
+			Languages:    make(map[string]int64),
+			Projects:     make(map[string]int64),
+			Anomalies:    len(entry.Anomalies),
+		}
+		for language, d := range entry.Languages {
+			exported.Languages[language] += int64(d / time.Minute)
+		}
+		for project, d := range entry.Projects {
+			if project == insight.PrivateProjectKey {
+				project = "private"
+			}
+			exported.Projects[project] += int64(d / time.Minute)
+		}
+		file.Users = append(file.Users, exported)
+	}
+
+	body, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("集計結果のマーシャルに失敗: %w", err)
+	}
+	name := fmt.Sprintf("worktimes-%s.json", now.Format("20060102T150405Z"))
+	if err := store.Put(ctx, name, bytes.NewReader(body)); err != nil {
+		return fmt.Errorf("集計結果の保存に失敗: %w", err)
+	}
+	slog.Info("集計結果を保存しました", "step", ConsumerExport, "name", name, "users", len(file.Users))
+	return nil
+}
@@ -0,0 +1,1831 @@
+package purge
+
+import (
+    "bytes"
+    "compress/gzip"
+    "context"
+    "crypto/ed25519"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/csv"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "math/rand"
+    "os"
+    "path"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/aws/aws-lambda-go/events"
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/aws/awserr"
+    "github.com/aws/aws-sdk-go/aws/session"
+    "github.com/aws/aws-sdk-go/service/dynamodb"
+    "github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+    "github.com/aws/aws-sdk-go/service/dynamodb/expression"
+    "github.com/aws/aws-sdk-go/service/lambda"
+    "github.com/aws/aws-sdk-go/service/s3"
+    "github.com/bwmarrin/discordgo"
+
+    "github.com/kkaiki/DevInsight/internal/insight"
+)
+
+const (
+    tableName  = insight.TableName
+    batchSize  = 25
+    maxWorkers = 5
+    // UnprocessedItems の再試行回数と待機時間
+    maxRetries  = 8
+    baseBackoff = 100 * time.Millisecond
+    maxBackoff  = 5 * time.Second
+    // テーブル全体を削除する場合に confirm に指定する値
+    fullWipeConfirmation = "DELETE_ALL_DEV_INSIGHT"
+
+    // 保持期間の既定値
+    rollupTableName            = insight.RollupTableName
+    defaultRetentionDays       = 90
+    defaultRollupRetentionDays = 730
+    defaultExpiryWindowDays    = 7
+
+    // ユーザー単位のエクスポート・削除
+    auditTableName        = insight.AuditTableName
+    userSettingsTableName = insight.UserSettingsTableName
+    tokenTableName        = insight.TokenTableName
+    runsTableName         = insight.RunsTableName
+    slashCommandName      = "devinsight"
+    // 削除したユーザーの ID を実行履歴で置き換える値
+    erasedDiscordID = "[erased]"
+
+    // インタラクションの X-Signature-Timestamp と現在時刻の差の上限（署名済みのリクエストの再送を拒否する）
+    maxInteractionAge = 5 * time.Minute
+)
+
+// 削除対象の範囲。指定した条件はすべて満たす必要がある
+type PurgeScope struct {
+    From      string `json:"from"` // この日時以降（2006-01-02 または RFC3339）
+    To        string `json:"to"`   // この日時より前（2006-01-02 または RFC3339）
+    DiscordID string `json:"discord_id"`
+    Language  string `json:"language"`
+}
+
+type PurgeEvent struct {
+    Scopes    []PurgeScope     `json:"scopes"`
+    DryRun    bool             `json:"dry_run"`   // true の場合は削除せず件数のみ数える
+    Confirm   string           `json:"confirm"`   // 条件のないスコープ（全件削除）の確認用
+    Archive   string           `json:"archive"`   // 削除前のアーカイブの保存先（ローカルディレクトリまたは s3://bucket/prefix）
+    Restore   string           `json:"restore"`   // 指定したアーカイブIDを archive の保存先からテーブルに復元する
+    Retention *RetentionEvent  `json:"retention"` // 指定した場合は削除の代わりに保持期間（TTL）を適用する
+    Export    *UserDataRequest `json:"export"`    // ユーザーのハートビートを archive の保存先にエクスポートする
+    Erase     *UserDataRequest `json:"erase"`     // ユーザーのハートビートと日次集計を削除する
+    // スラッシュコマンドを登録する
+    RegisterCommands bool `json:"register_commands"`
+    // 関数 URL で受け取ったスラッシュコマンドの処理（handleInteraction が自身を非同期で呼び出す）
+    SlashCommand *SlashCommandJob `json:"slash_command"`
+}
+
+// 応答の期限（3秒）を過ぎても続けられるよう、非同期の呼び出しで実行するスラッシュコマンド
+type SlashCommandJob struct {
+    Command       string          `json:"command"` // export または erase
+    Request       UserDataRequest `json:"request"`
+    ApplicationID string          `json:"application_id"`
+    Token         string          `json:"token"` // 応答の編集に使うインタラクションのトークン（15分間有効）
+}
+
+type PurgeResult struct {
+    Summaries []PurgeSummary    `json:"summaries,omitempty"`
+    Restore   *RestoreSummary   `json:"restore,omitempty"`
+    Retention *RetentionSummary `json:"retention,omitempty"`
+    Export    *ExportSummary    `json:"export,omitempty"`
+    Erase     *EraseSummary     `json:"erase,omitempty"`
+}
+
+// スコープごとの実行結果
+type PurgeSummary struct {
+    Scope   PurgeScope `json:"scope"`
+    DryRun  bool       `json:"dry_run"`
+    Matched int        `json:"matched"`
+    Deleted int        `json:"deleted"`
+    Failed  int        `json:"failed"`            // 再試行しても削除できなかった件数
+    Archive string     `json:"archive,omitempty"` // 削除前に作成したアーカイブID
+    Partial bool       `json:"partial,omitempty"` // 実行期限のため途中で打ち切った（再実行すると残りを処理する）
+}
+
+// アーカイブの内容を記録するマニフェスト
+type ArchiveManifest struct {
+    ArchiveID string     `json:"archive_id"`
+    Table     string     `json:"table"`
+    Scope     PurgeScope `json:"scope"`
+    CreatedAt string     `json:"created_at"`
+    Format    string     `json:"format"`
+    DataFile  string     `json:"data_file"`
+    ItemCount int        `json:"item_count"`
+    SHA256    string     `json:"sha256"` // データファイルのチェックサム
+}
+
+type RestoreSummary struct {
+    ArchiveID string `json:"archive_id"`
+    Items     int    `json:"items"`
+    Restored  int    `json:"restored"`
+    Failed    int    `json:"failed"`
+    Partial   bool   `json:"partial,omitempty"` // 実行期限のため途中で打ち切った
+}
+
+func (s PurgeScope) isFullWipe() bool {
+    return s.From == "" && s.To == "" && s.DiscordID == "" && s.Language == ""
+}
+
+func (s PurgeScope) String() string {
+    if s.isFullWipe() {
+        return "全件"
+    }
+    var parts []string
+    if s.From != "" {
+        parts = append(parts, "from="+s.From)
+    }
+    if s.To != "" {
+        parts = append(parts, "to="+s.To)
+    }
+    if s.DiscordID != "" {
+        parts = append(parts, "discord_id="+s.DiscordID)
+    }
+    if s.Language != "" {
+        parts = append(parts, "language="+s.Language)
+    }
+    return strings.Join(parts, " ")
+}
+
+// 日付または日時を、保存されているタイムスタンプと比較できる形式 (insight.TimestampLayout) に変換
+func parseScopeTime(value string) (string, error) {
+    if value == "" {
+        return "", nil
+    }
+    if t, err := time.Parse("2006-01-02", value); err == nil {
+        return insight.FormatTimestamp(t), nil
+    }
+    t, err := time.Parse(time.RFC3339, value)
+    if err != nil {
+        return "", &insight.AppError{Kind: insight.KindConfig, Message: fmt.Sprintf("日時の形式が不正です: %s", value)}
+    }
+    return insight.FormatTimestamp(t), nil
+}
+
+func validateEvent(event PurgeEvent) error {
+    if event.Retention != nil || event.RegisterCommands {
+        return nil
+    }
+    if job := event.SlashCommand; job != nil {
+        if job.ApplicationID == "" || job.Token == "" {
+            return &insight.AppError{Kind: insight.KindConfig, Message: "スラッシュコマンドの application_id または token が指定されていません"}
+        }
+        return validateUserDataRequest(&job.Request, job.Command == "erase")
+    }
+    if event.Export != nil {
+        if event.Archive == "" {
+            return &insight.AppError{Kind: insight.KindConfig, Message: "エクスポートの保存先 archive が指定されていません"}
+        }
+        return validateUserDataRequest(event.Export, false)
+    }
+    if event.Erase != nil {
+        return validateUserDataRequest(event.Erase, true)
+    }
+    if event.Restore != "" {
+        if event.Archive == "" {
+            return &insight.AppError{Kind: insight.KindConfig, Message: "復元するアーカイブの保存先 archive が指定されていません"}
+        }
+        return nil
+    }
+    if len(event.Scopes) == 0 {
+        return &insight.AppError{Kind: insight.KindConfig, Message: "削除対象のスコープが指定されていません"}
+    }
+    for _, scope := range event.Scopes {
+        if _, err := parseScopeTime(scope.From); err != nil {
+            return err
+        }
+        if _, err := parseScopeTime(scope.To); err != nil {
+            return err
+        }
+        if scope.isFullWipe() && !event.DryRun && event.Confirm != fullWipeConfirmation {
+            return &insight.AppError{Kind: insight.KindConfig, Message: fmt.Sprintf("全件削除には confirm に %q を指定してください", fullWipeConfirmation)}
+        }
+    }
+    return nil
+}
+
+func HandleRequest(ctx context.Context, event PurgeEvent) (*PurgeResult, error) {
+    slog.Info("データ削除の処理を開始します")
+    if err := validateEvent(event); err != nil {
+        slog.Error("イベントが不正です", "error", err)
+        return nil, err
+    }
+
+    sess := insight.Session
+    svc := insight.DB
+
+    var store ArchiveStore
+    if event.Archive != "" {
+        var err error
+        store, err = NewArchiveStore(sess, event.Archive)
+        if err != nil {
+            slog.Error("アーカイブの保存先が不正です", "archive", event.Archive, "error", err)
+            return nil, err
+        }
+    }
+
+    if event.RegisterCommands {
+        return &PurgeResult{}, registerCommands(ctx)
+    }
+
+    if event.SlashCommand != nil {
+        // 非同期の呼び出しはエラーを返すと再実行されるため、結果は応答の編集とログで報告する
+        return runSlashCommand(ctx, svc, *event.SlashCommand), nil
+    }
+
+    if event.Export != nil {
+        summary, _, err := exportUserData(ctx, svc, store, *event.Export, "event")
+        if err != nil {
+            slog.Error("エクスポートに失敗しました", "step", "export", "discord_id", event.Export.DiscordID, "error", err)
+        }
+        return &PurgeResult{Export: &summary}, err
+    }
+
+    if event.Erase != nil {
+        summary, err := eraseUserData(ctx, svc, *event.Erase, "event")
+        if err != nil {
+            slog.Error("ユーザーのデータの削除に失敗しました", "step", "erase", "discord_id", event.Erase.DiscordID, "error", err)
+        }
+        return &PurgeResult{Erase: &summary}, err
+    }
+
+    if event.Retention != nil {
+        summary, err := applyRetention(ctx, svc, *event.Retention)
+        if err != nil {
+            slog.Error("保持期間の適用に失敗しました", "step", "retention", "error", err)
+        }
+        return &PurgeResult{Retention: &summary}, err
+    }
+
+    // 実行期限が近づいたら処理を打ち切り、それまでの結果を返す
+    workCtx, cancel := insight.AggregateContext(ctx)
+    defer cancel()
+
+    if event.Restore != "" {
+        summary, err := restoreArchive(workCtx, svc, store, event.Restore)
+        if err != nil {
+            slog.Error("アーカイブの復元に失敗しました", "step", "restore", "archive_id", event.Restore, "error", err)
+        }
+        return &PurgeResult{Restore: &summary}, err
+    }
+
+    result := &PurgeResult{}
+    now := time.Now().UTC()
+    for i, scope := range event.Scopes {
+        if workCtx.Err() != nil {
+            slog.Warn("実行期限のため残りのスコープを処理しません", "step", "purge", "remaining", len(event.Scopes)-i)
+            result.Summaries = append(result.Summaries, PurgeSummary{Scope: scope, DryRun: event.DryRun, Partial: true})
+            continue
+        }
+        var summary PurgeSummary
+        var err error
+        if store != nil && !event.DryRun {
+            archiveID := fmt.Sprintf("%s-%s-%d", tableName, now.Format("20060102T150405Z"), i+1)
+            summary, err = archiveAndPurgeScope(workCtx, svc, store, scope, archiveID)
+        } else {
+            summary, err = purgeScope(workCtx, svc, scope, event.DryRun)
+        }
+        result.Summaries = append(result.Summaries, summary)
+        if err != nil {
+            slog.Error("削除を中断しました", "step", "purge", "scope", scope.String(), "error", err)
+            logSummaries(result.Summaries)
+            return result, err
+        }
+    }
+
+    logSummaries(result.Summaries)
+    if workCtx.Err() != nil {
+        return result, errDeadline
+    }
+    return result, nil
+}
+
+// 実行期限のため途中で打ち切った場合のエラー。結果は途中までの件数（partial）を返す
+var errDeadline error = &insight.AppError{
+    Kind:    insight.KindStore,
+    Message: "実行期限のため途中で打ち切りました（再実行すると残りを処理します）",
+    Err:     context.DeadlineExceeded,
+}
+
+// アーカイブに保存できたアイテムのみを削除する
+func archiveAndPurgeScope(ctx context.Context, svc *dynamodb.DynamoDB, store ArchiveStore, scope PurgeScope, archiveID string) (PurgeSummary, error) {
+    summary := PurgeSummary{Scope: scope}
+    keys, err := archiveScope(ctx, svc, store, scope, archiveID)
+    if err != nil {
+        summary.Partial = ctx.Err() != nil
+        return summary, fmt.Errorf("アーカイブの作成に失敗したため削除しません: %w", err)
+    }
+    summary.Archive = archiveID
+    summary.Matched = len(keys)
+    summary.Deleted, summary.Failed = deleteKeys(ctx, svc, tableName, keys)
+    summary.Partial = summary.Deleted+summary.Failed < summary.Matched
+    return summary, nil
+}
+
+func logSummaries(summaries []PurgeSummary) {
+    for _, summary := range summaries {
+        if summary.DryRun {
+            slog.Info("dry-run: 削除の対象件数", "step", "purge", "scope", summary.Scope.String(), "matched", summary.Matched)
+        } else {
+            slog.Info("削除しました", "step", "purge", "scope", summary.Scope.String(), "matched", summary.Matched, "deleted", summary.Deleted, "failed", summary.Failed, "archive_id", summary.Archive, "partial", summary.Partial)
+        }
+    }
+}
+
+// スコープの条件に一致するアイテムをページごとに取得する
+// discord_id が指定されている場合はクエリ、それ以外はスキャンのセグメントを使用
+// keysOnly が true の場合はキーのみを取得する
+func fetchScopePage(ctx context.Context, svc *dynamodb.DynamoDB, scope PurgeScope, segment, totalSegments int, keysOnly bool, lastKey map[string]*dynamodb.AttributeValue) ([]map[string]*dynamodb.AttributeValue, map[string]*dynamodb.AttributeValue, error) {
+    from, _ := parseScopeTime(scope.From)
+    to, _ := parseScopeTime(scope.To)
+
+    var conditions []expression.ConditionBuilder
+    if scope.DiscordID == "" && from != "" {
+        conditions = append(conditions, expression.Name("timestamp").GreaterThanEqual(expression.Value(from)))
+    }
+    if to != "" {
+        conditions = append(conditions, expression.Name("timestamp").LessThan(expression.Value(to)))
+    }
+    if scope.Language != "" {
+        conditions = append(conditions, expression.Name("language").Equal(expression.Value(scope.Language)))
+    }
+
+    builder := expression.NewBuilder()
+    if keysOnly {
+        builder = builder.WithProjection(expression.NamesList(
+            expression.Name("discord_id"),
+            expression.Name("timestamp"),
+        ))
+    }
+    if len(conditions) == 1 {
+        builder = builder.WithFilter(conditions[0])
+    } else if len(conditions) > 1 {
+        builder = builder.WithFilter(expression.And(conditions[0], conditions[1], conditions[2:]...))
+    }
+
+    if scope.DiscordID != "" {
+        keyCond := expression.Key("discord_id").Equal(expression.Value(scope.DiscordID))
+        if from != "" {
+            keyCond = keyCond.And(expression.Key("timestamp").GreaterThanEqual(expression.Value(from)))
+        }
+        expr, err := builder.WithKeyCondition(keyCond).Build()
+        if err != nil {
+            return nil, nil, &insight.AppError{Kind: insight.KindData, Message: "クエリ式の構築に失敗", Err: err}
+        }
+        var result *dynamodb.QueryOutput
+        err = insight.Retry(ctx, "query "+tableName, func() error {
+            var err error
+            result, err = svc.QueryWithContext(ctx, &dynamodb.QueryInput{
+                TableName:                 aws.String(tableName),
+                KeyConditionExpression:    expr.KeyCondition(),
+                FilterExpression:          expr.Filter(),
+                ProjectionExpression:      expr.Projection(),
+                ExpressionAttributeNames:  expr.Names(),
+                ExpressionAttributeValues: expr.Values(),
+                Limit:                     aws.Int64(batchSize),
+                ExclusiveStartKey:         lastKey,
+            })
+            return err
+        })
+        if err != nil {
+            return nil, nil, &insight.AppError{Kind: insight.KindStore, Message: "クエリの実行に失敗", Err: err}
+        }
+        return result.Items, result.LastEvaluatedKey, nil
+    }
+
+    expr, err := builder.Build()
+    if err != nil {
+        return nil, nil, &insight.AppError{Kind: insight.KindData, Message: "スキャン式の構築に失敗", Err: err}
+    }
+    var result *dynamodb.ScanOutput
+    err = insight.Retry(ctx, "scan "+tableName, func() error {
+        var err error
+        result, err = svc.ScanWithContext(ctx, &dynamodb.ScanInput{
+            TableName:                 aws.String(tableName),
+            FilterExpression:          expr.Filter(),
+            ProjectionExpression:      expr.Projection(),
+            ExpressionAttributeNames:  expr.Names(),
+            ExpressionAttributeValues: expr.Values(),
+            Limit:                     aws.Int64(batchSize),
+            ExclusiveStartKey:         lastKey,
+            Segment:                   aws.Int64(int64(segment)),
+            TotalSegments:             aws.Int64(int64(totalSegments)),
+        })
+        return err
+    })
+    if err != nil {
+        return nil, nil, &insight.AppError{Kind: insight.KindStore, Message: "スキャンに失敗", Err: err}
+    }
+    return result.Items, result.LastEvaluatedKey, nil
+}
+
+// スコープを最大 maxWorkers 個の並列スキャンセグメントに分けて削除する
+// ctx が期限切れになった場合は、それまでの件数を Partial として返す
+func purgeScope(ctx context.Context, svc *dynamodb.DynamoDB, scope PurgeScope, dryRun bool) (PurgeSummary, error) {
+    slog.Info("削除を開始します", "step", "purge", "scope", scope.String(), "dry_run", dryRun)
+    summary := PurgeSummary{Scope: scope, DryRun: dryRun}
+
+    // クエリはセグメントに分割できないため1ワーカーで処理
+    totalSegments := maxWorkers
+    if scope.DiscordID != "" {
+        totalSegments = 1
+    }
+
+    var mu sync.Mutex
+    var wg sync.WaitGroup
+    var errs []error
+    for segment := 0; segment < totalSegments; segment++ {
+        wg.Add(1)
+        go func(segment int) {
+            defer wg.Done()
+            result, err := purgeSegment(ctx, svc, scope, dryRun, segment, totalSegments)
+            mu.Lock()
+            defer mu.Unlock()
+            summary.Matched += result.Matched
+            summary.Deleted += result.Deleted
+            summary.Failed += result.Failed
+            if err != nil {
+                errs = append(errs, err)
+            }
+        }(segment)
+    }
+    wg.Wait()
+
+    if ctx.Err() != nil {
+        summary.Partial = true
+        slog.Warn("実行期限のため削除を打ち切りました", "step", "purge", "scope", scope.String(), "matched", summary.Matched, "deleted", summary.Deleted)
+        return summary, nil
+    }
+    return summary, errors.Join(errs...)
+}
+
+func purgeSegment(ctx context.Context, svc *dynamodb.DynamoDB, scope PurgeScope, dryRun bool, segment, totalSegments int) (PurgeSummary, error) {
+    var result PurgeSummary
+    var lastKey map[string]*dynamodb.AttributeValue
+    for ctx.Err() == nil {
+        items, nextKey, err := fetchScopePage(ctx, svc, scope, segment, totalSegments, true, lastKey)
+        if ctx.Err() != nil {
+            break
+        }
+        if err != nil {
+            slog.Error("スキャンに失敗", "step", "purge", "scope", scope.String(), "segment", segment, "error", err)
+            return result, err
+        }
+        result.Matched += len(items)
+
+        if len(items) > 0 && !dryRun {
+            var writeRequests []*dynamodb.WriteRequest
+            for _, item := range items {
+                writeRequests = append(writeRequests, &dynamodb.WriteRequest{
+                    DeleteRequest: &dynamodb.DeleteRequest{
+                        Key: map[string]*dynamodb.AttributeValue{
+                            "discord_id": item["discord_id"],
+                            "timestamp":  item["timestamp"],
+                        },
+                    },
+                })
+            }
+
+            deleted, failed := batchWrite(ctx, svc, tableName, writeRequests)
+            result.Deleted += deleted
+            result.Failed += failed
+            slog.Debug("アイテムを削除しました", "step", "purge", "scope", scope.String(), "segment", segment, "deleted", deleted, "failed", failed)
+        }
+
+        lastKey = nextKey
+        if lastKey == nil {
+            break
+        }
+    }
+    return result, nil
+}
+
+// バッチ書き込み（削除・復元）を実行し、UnprocessedItems を指数バックオフで再試行する
+// 戻り値は処理できた件数と、再試行しても（ctx の期限までに）処理できなかった件数
+func batchWrite(ctx context.Context, svc *dynamodb.DynamoDB, table string, writeRequests []*dynamodb.WriteRequest) (int, int) {
+    pending := writeRequests
+    for attempt := 0; ; attempt++ {
+        output, err := svc.BatchWriteItemWithContext(ctx, &dynamodb.BatchWriteItemInput{
+            RequestItems: map[string][]*dynamodb.WriteRequest{
+                table: pending,
+            },
+        })
+        if err != nil && !insight.IsRetryable(err) {
+            slog.Error("バッチ書き込みに失敗しました", "table", table, "kind", insight.KindStore, "failed", len(pending), "error", err)
+            return len(writeRequests) - len(pending), len(pending)
+        }
+        if err != nil {
+            slog.Warn("バッチ書き込みエラー", "table", table, "attempt", attempt+1, "error", err)
+        } else {
+            pending = output.UnprocessedItems[table]
+            if len(pending) == 0 {
+                return len(writeRequests), 0
+            }
+            slog.Warn("未処理のアイテムがあります", "table", table, "pending", len(pending), "attempt", attempt+1)
+        }
+
+        if attempt >= maxRetries {
+            slog.Error("再試行の上限に達したため書き込みに失敗しました", "table", table, "failed", len(pending))
+            return len(writeRequests) - len(pending), len(pending)
+        }
+        timer := time.NewTimer(backoff(attempt))
+        select {
+        case <-ctx.Done():
+            timer.Stop()
+            slog.Error("実行期限のため書き込みを打ち切りました", "table", table, "failed", len(pending))
+            return len(writeRequests) - len(pending), len(pending)
+        case <-timer.C:
+        }
+    }
+}
+
+// アーカイブの保存先（ローカルディレクトリまたは S3 互換ストレージ）
+type ArchiveStore interface {
+    Put(ctx context.Context, name string, body io.ReadSeeker) error
+    Get(ctx context.Context, name string) (io.ReadCloser, error)
+}
+
+type localArchiveStore struct {
+    dir string
+}
+
+func (s *localArchiveStore) Put(ctx context.Context, name string, body io.ReadSeeker) error {
+    if err := os.MkdirAll(s.dir, 0o755); err != nil {
+        return err
+    }
+    file, err := os.Create(filepath.Join(s.dir, name))
+    if err != nil {
+        return err
+    }
+    if _, err := io.Copy(file, body); err != nil {
+        file.Close()
+        return err
+    }
+    return file.Close()
+}
+
+func (s *localArchiveStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+    return os.Open(filepath.Join(s.dir, name))
+}
+
+type s3ArchiveStore struct {
+    client *s3.S3
+    bucket string
+    prefix string
+}
+
+func (s *s3ArchiveStore) Put(ctx context.Context, name string, body io.ReadSeeker) error {
+    _, err := s.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+        Bucket: aws.String(s.bucket),
+        Key:    aws.String(path.Join(s.prefix, name)),
+        Body:   body,
+    })
+    return err
+}
+
+func (s *s3ArchiveStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+    output, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+        Bucket: aws.String(s.bucket),
+        Key:    aws.String(path.Join(s.prefix, name)),
+    })
+    if err != nil {
+        return nil, err
+    }
+    return output.Body, nil
+}
+
+// s3://bucket/prefix の場合は S3、それ以外はローカルディレクトリに保存する
+// ARCHIVE_S3_ENDPOINT を指定すると MinIO などの S3 互換ストレージを使用
+func NewArchiveStore(sess *session.Session, destination string) (ArchiveStore, error) {
+    if !strings.HasPrefix(destination, "s3://") {
+        return &localArchiveStore{dir: destination}, nil
+    }
+    bucket, prefix, _ := strings.Cut(strings.TrimPrefix(destination, "s3://"), "/")
+    if bucket == "" {
+        return nil, &insight.AppError{Kind: insight.KindConfig, Message: fmt.Sprintf("アーカイブの保存先のバケット名が指定されていません: %s", destination)}
+    }
+    cfg := &aws.Config{}
+    if endpoint := os.Getenv("ARCHIVE_S3_ENDPOINT"); endpoint != "" {
+        cfg.Endpoint = aws.String(endpoint)
+        cfg.S3ForcePathStyle = aws.Bool(true)
+    }
+    return &s3ArchiveStore{client: s3.New(sess, cfg), bucket: bucket, prefix: prefix}, nil
+}
+
+func manifestName(archiveID string) string {
+    return archiveID + ".manifest.json"
+}
+
+// スコープに一致するアイテムを gzip 圧縮した JSON Lines に書き出し、マニフェストとともに保存する
+// 戻り値はアーカイブしたアイテムのキー
+func archiveScope(ctx context.Context, svc *dynamodb.DynamoDB, store ArchiveStore, scope PurgeScope, archiveID string) ([]map[string]*dynamodb.AttributeValue, error) {
+    slog.Info("アーカイブを作成します", "step", "archive", "scope", scope.String(), "archive_id", archiveID)
+    file, err := os.CreateTemp("", archiveID+"-*.jsonl.gz")
+    if err != nil {
+        return nil, &insight.AppError{Kind: insight.KindStore, Message: "一時ファイルの作成に失敗", Err: err}
+    }
+    defer os.Remove(file.Name())
+    defer file.Close()
+
+    hasher := sha256.New()
+    gz := gzip.NewWriter(io.MultiWriter(file, hasher))
+    encoder := json.NewEncoder(gz)
+
+    // クエリはセグメントに分割できないため1ワーカーで処理
+    totalSegments := maxWorkers
+    if scope.DiscordID != "" {
+        totalSegments = 1
+    }
+
+    var mu sync.Mutex
+    var wg sync.WaitGroup
+    var errs []error
+    var keys []map[string]*dynamodb.AttributeValue
+    for segment := 0; segment < totalSegments; segment++ {
+        wg.Add(1)
+        go func(segment int) {
+            defer wg.Done()
+            var lastKey map[string]*dynamodb.AttributeValue
+            for {
+                items, nextKey, err := fetchScopePage(ctx, svc, scope, segment, totalSegments, false, lastKey)
+                if err != nil {
+                    mu.Lock()
+                    errs = append(errs, err)
+                    mu.Unlock()
+                    return
+                }
+                for _, item := range items {
+                    var record map[string]interface{}
+                    if err := dynamodbattribute.UnmarshalMap(item, &record); err != nil {
+                        mu.Lock()
+                        errs = append(errs, &insight.AppError{Kind: insight.KindData, Message: "アイテムのアンマーシャルに失敗", Err: err})
+                        mu.Unlock()
+                        return
+                    }
+                    mu.Lock()
+                    err := encoder.Encode(record)
+                    if err == nil {
+                        keys = append(keys, map[string]*dynamodb.AttributeValue{
+                            "discord_id": item["discord_id"],
+                            "timestamp":  item["timestamp"],
+                        })
+                    } else {
+                        errs = append(errs, &insight.AppError{Kind: insight.KindStore, Message: "アーカイブの書き込みに失敗", Err: err})
+                    }
+                    mu.Unlock()
+                    if err != nil {
+                        return
+                    }
+                }
+                lastKey = nextKey
+                if lastKey == nil {
+                    return
+                }
+            }
+        }(segment)
+    }
+    wg.Wait()
+    if err := errors.Join(errs...); err != nil {
+        return nil, err
+    }
+
+    if err := gz.Close(); err != nil {
+        return nil, &insight.AppError{Kind: insight.KindStore, Message: "アーカイブの圧縮に失敗", Err: err}
+    }
+    if _, err := file.Seek(0, io.SeekStart); err != nil {
+        return nil, &insight.AppError{Kind: insight.KindStore, Message: "一時ファイルの読み込みに失敗", Err: err}
+    }
+
+    manifest := ArchiveManifest{
+        ArchiveID: archiveID,
+        Table:     tableName,
+        Scope:     scope,
+        CreatedAt: time.Now().UTC().Format(time.RFC3339),
+        Format:    "jsonl.gz",
+        DataFile:  archiveID + ".jsonl.gz",
+        ItemCount: len(keys),
+        SHA256:    hex.EncodeToString(hasher.Sum(nil)),
+    }
+    if err := store.Put(ctx, manifest.DataFile, file); err != nil {
+        return nil, &insight.AppError{Kind: insight.KindStore, Message: "アーカイブの保存に失敗", Err: err}
+    }
+    manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+    if err != nil {
+        return nil, &insight.AppError{Kind: insight.KindData, Message: "マニフェストの作成に失敗", Err: err}
+    }
+    if err := store.Put(ctx, manifestName(archiveID), bytes.NewReader(manifestJSON)); err != nil {
+        return nil, &insight.AppError{Kind: insight.KindStore, Message: "マニフェストの保存に失敗", Err: err}
+    }
+
+    slog.Info("アーカイブを保存しました", "step", "archive", "scope", scope.String(), "archive_id", archiveID, "items", manifest.ItemCount, "sha256", manifest.SHA256)
+    return keys, nil
+}
+
+// 指定したキーのアイテムを maxWorkers 個のワーカーで削除する
+// ctx が期限切れになった場合は残りのキーを削除しない（削除・失敗のどちらにも数えない）
+func deleteKeys(ctx context.Context, svc *dynamodb.DynamoDB, table string, keys []map[string]*dynamodb.AttributeValue) (int, int) {
+    batches := make(chan []*dynamodb.WriteRequest)
+    var mu sync.Mutex
+    var wg sync.WaitGroup
+    deleted, failed := 0, 0
+    for i := 0; i < maxWorkers; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for writeRequests := range batches {
+                d, f := batchWrite(ctx, svc, table, writeRequests)
+                mu.Lock()
+                deleted += d
+                failed += f
+                mu.Unlock()
+            }
+        }()
+    }
+
+    for start := 0; start < len(keys) && ctx.Err() == nil; start += batchSize {
+        end := start + batchSize
+        if end > len(keys) {
+            end = len(keys)
+        }
+        var writeRequests []*dynamodb.WriteRequest
+        for _, key := range keys[start:end] {
+            writeRequests = append(writeRequests, &dynamodb.WriteRequest{
+                DeleteRequest: &dynamodb.DeleteRequest{Key: key},
+            })
+        }
+        select {
+        case batches <- writeRequests:
+        case <-ctx.Done():
+        }
+    }
+    close(batches)
+    wg.Wait()
+    return deleted, failed
+}
+
+// アーカイブを読み込み、チェックサムを確認してからテーブルに書き戻す
+// ctx が期限切れになった場合は、それまでに書き戻した件数を Partial として返す（再実行すると上書きして続ける）
+func restoreArchive(ctx context.Context, svc *dynamodb.DynamoDB, store ArchiveStore, archiveID string) (RestoreSummary, error) {
+    slog.Info("アーカイブを復元します", "step", "restore", "archive_id", archiveID)
+    summary := RestoreSummary{ArchiveID: archiveID}
+
+    manifestReader, err := store.Get(ctx, manifestName(archiveID))
+    if err != nil {
+        return summary, &insight.AppError{Kind: insight.KindStore, Message: "マニフェストの取得に失敗", Err: err}
+    }
+    var manifest ArchiveManifest
+    err = json.NewDecoder(manifestReader).Decode(&manifest)
+    manifestReader.Close()
+    if err != nil {
+        return summary, &insight.AppError{Kind: insight.KindData, Message: "マニフェストの読み込みに失敗", Err: err}
+    }
+    if manifest.Table != tableName {
+        return summary, &insight.AppError{Kind: insight.KindData, Message: fmt.Sprintf("アーカイブのテーブル %s は %s と一致しません", manifest.Table, tableName)}
+    }
+
+    // チェックサムを確認するため一時ファイルにダウンロードする
+    dataReader, err := store.Get(ctx, manifest.DataFile)
+    if err != nil {
+        return summary, &insight.AppError{Kind: insight.KindStore, Message: "アーカイブの取得に失敗", Err: err}
+    }
+    file, err := os.CreateTemp("", archiveID+"-*.jsonl.gz")
+    if err != nil {
+        dataReader.Close()
+        return summary, &insight.AppError{Kind: insight.KindStore, Message: "一時ファイルの作成に失敗", Err: err}
+    }
+    defer os.Remove(file.Name())
+    defer file.Close()
+
+    hasher := sha256.New()
+    _, err = io.Copy(io.MultiWriter(file, hasher), dataReader)
+    dataReader.Close()
+    if err != nil {
+        return summary, &insight.AppError{Kind: insight.KindStore, Message: "アーカイブのダウンロードに失敗", Err: err}
+    }
+    if checksum := hex.EncodeToString(hasher.Sum(nil)); checksum != manifest.SHA256 {
+        return summary, &insight.AppError{Kind: insight.KindData, Message: fmt.Sprintf("チェックサムが一致しません (manifest: %s, data: %s)", manifest.SHA256, checksum)}
+    }
+    if _, err := file.Seek(0, io.SeekStart); err != nil {
+        return summary, &insight.AppError{Kind: insight.KindStore, Message: "一時ファイルの読み込みに失敗", Err: err}
+    }
+
+    gz, err := gzip.NewReader(file)
+    if err != nil {
+        return summary, &insight.AppError{Kind: insight.KindData, Message: "アーカイブの展開に失敗", Err: err}
+    }
+    defer gz.Close()
+
+    decoder := json.NewDecoder(gz)
+    var writeRequests []*dynamodb.WriteRequest
+    flush := func() {
+        if len(writeRequests) == 0 {
+            return
+        }
+        restored, failed := batchWrite(ctx, svc, tableName, writeRequests)
+        summary.Restored += restored
+        summary.Failed += failed
+        writeRequests = nil
+    }
+    for {
+        if ctx.Err() != nil {
+            summary.Partial = true
+            slog.Warn("実行期限のため復元を打ち切りました", "step", "restore", "archive_id", archiveID, "restored", summary.Restored)
+            return summary, errDeadline
+        }
+        var record map[string]interface{}
+        if err := decoder.Decode(&record); err == io.EOF {
+            break
+        } else if err != nil {
+            flush()
+            return summary, &insight.AppError{Kind: insight.KindData, Message: "アーカイブの読み込みに失敗", Err: err}
+        }
+        item, err := dynamodbattribute.MarshalMap(record)
+        if err != nil {
+            flush()
+            return summary, &insight.AppError{Kind: insight.KindData, Message: "アイテムのマーシャルに失敗", Err: err}
+        }
+        summary.Items++
+        writeRequests = append(writeRequests, &dynamodb.WriteRequest{
+            PutRequest: &dynamodb.PutRequest{Item: item},
+        })
+        if len(writeRequests) == batchSize {
+            flush()
+        }
+    }
+    flush()
+
+    if summary.Items != manifest.ItemCount {
+        slog.Warn("アーカイブの件数がマニフェストの件数と一致しません", "step", "restore", "archive_id", archiveID, "items", summary.Items, "manifest_items", manifest.ItemCount)
+    }
+    slog.Info("アーカイブを復元しました", "step", "restore", "archive_id", archiveID, "restored", summary.Restored, "failed", summary.Failed)
+    return summary, nil
+}
+
+// ハートビートの保持期間と日次集計の設定
+type RetentionEvent struct {
+    Days       int `json:"days"`        // ハートビートの保持日数
+    RollupDays int `json:"rollup_days"` // 日次集計の保持日数
+    WindowDays int `json:"window_days"` // 期限切れ予定として集計する日数
+}
+
+type RetentionSummary struct {
+    Scanned      int    `json:"scanned"`
+    Backfilled   int    `json:"backfilled"` // expires_at を設定した件数
+    Failed       int    `json:"failed"`
+    ExpiringSoon int    `json:"expiring_soon"` // window_days 以内に期限切れになる件数
+    WindowEnd    string `json:"window_end"`
+    Rollups      int    `json:"rollups"`           // 新たに作成した日次集計の件数
+    Partial      bool   `json:"partial,omitempty"` // 実行期限のため途中で打ち切った
+}
+
+// ハートビートの保持期間の計算に必要な属性
+type heartbeatRecord struct {
+    DiscordID string `json:"discord_id"`
+    Timestamp string `json:"timestamp"`
+    Language  string `json:"language"`
+    Project   string `json:"project"`
+    ExpiresAt int64  `json:"expires_at"`
+}
+
+// ユーザーごとの日次の作業時間
+type Rollup struct {
+    DiscordID    string           `json:"discord_id"`
+    Date         string           `json:"date"`
+    TotalSeconds int64            `json:"total_seconds"`
+    Languages    map[string]int64 `json:"languages"`          // 言語ごとの秒数
+    Projects     map[string]int64 `json:"projects,omitempty"` // プロジェクトごとの秒数
+    ExpiresAt    int64            `json:"expires_at"`
+}
+
+func (r *RetentionEvent) applyDefaults() {
+    if r.Days <= 0 {
+        r.Days = defaultRetentionDays
+    }
+    if r.RollupDays <= 0 {
+        r.RollupDays = defaultRollupRetentionDays
+    }
+    if r.WindowDays <= 0 {
+        r.WindowDays = defaultExpiryWindowDays
+    }
+}
+
+// expires_at のないハートビートに TTL を設定し、期限切れが近いハートビートを日次集計として残す
+// 実行期限が近づいた場合は、それまでの件数を Partial として返す
+func applyRetention(ctx context.Context, svc *dynamodb.DynamoDB, retention RetentionEvent) (RetentionSummary, error) {
+    ctx, cancel := insight.AggregateContext(ctx)
+    defer cancel()
+    retention.applyDefaults()
+    slog.Info("保持期間を適用します", "step", "retention", "days", retention.Days, "rollup_days", retention.RollupDays, "window_days", retention.WindowDays)
+
+    windowEnd := time.Now().UTC().AddDate(0, 0, retention.WindowDays)
+    summary := RetentionSummary{WindowEnd: windowEnd.Format(time.RFC3339)}
+
+    projection := expression.NamesList(
+        expression.Name("discord_id"),
+        expression.Name("timestamp"),
+        expression.Name("language"),
+        expression.Name("expires_at"),
+    )
+    expr, err := expression.NewBuilder().WithProjection(projection).Build()
+    if err != nil {
+        return summary, &insight.AppError{Kind: insight.KindData, Message: "スキャン式の構築に失敗", Err: err}
+    }
+
+    var mu sync.Mutex
+    var wg sync.WaitGroup
+    var errs []error
+    // 日次集計を作成するユーザーと日付
+    rollupDates := make(map[string]map[string]bool)
+    for segment := 0; segment < maxWorkers; segment++ {
+        wg.Add(1)
+        go func(segment int) {
+            defer wg.Done()
+            var lastKey map[string]*dynamodb.AttributeValue
+            for ctx.Err() == nil {
+                var result *dynamodb.ScanOutput
+                err := insight.Retry(ctx, "scan "+tableName, func() error {
+                    var err error
+                    result, err = svc.ScanWithContext(ctx, &dynamodb.ScanInput{
+                        TableName:                aws.String(tableName),
+                        ProjectionExpression:     expr.Projection(),
+                        ExpressionAttributeNames: expr.Names(),
+                        ExclusiveStartKey:        lastKey,
+                        Segment:                  aws.Int64(int64(segment)),
+                        TotalSegments:            aws.Int64(maxWorkers),
+                    })
+                    return err
+                })
+                if ctx.Err() != nil {
+                    return
+                }
+                if err != nil {
+                    mu.Lock()
+                    errs = append(errs, &insight.AppError{Kind: insight.KindStore, Message: "スキャンに失敗", Err: err})
+                    mu.Unlock()
+                    return
+                }
+
+                var records []heartbeatRecord
+                if err := dynamodbattribute.UnmarshalListOfMaps(result.Items, &records); err != nil {
+                    mu.Lock()
+                    errs = append(errs, &insight.AppError{Kind: insight.KindData, Message: "データのアンマーシャルに失敗", Err: err})
+                    mu.Unlock()
+                    return
+                }
+
+                for _, record := range records {
+                    backfilled, failed := false, false
+                    timestamp, err := time.Parse(time.RFC3339, record.Timestamp)
+                    if err != nil {
+                        slog.Error("タイムスタンプの解析に失敗", "step", "retention", "discord_id", record.DiscordID, "error", err)
+                        failed = true
+                    } else if record.ExpiresAt == 0 {
+                        record.ExpiresAt = timestamp.AddDate(0, 0, retention.Days).Unix()
+                        if err := setExpiresAt(ctx, svc, record); err != nil {
+                            slog.Error("expires_at の設定に失敗", "step", "retention", "discord_id", record.DiscordID, "timestamp", record.Timestamp, "error", err)
+                            failed = true
+                        } else {
+                            backfilled = true
+                        }
+                    }
+
+                    mu.Lock()
+                    summary.Scanned++
+                    if backfilled {
+                        summary.Backfilled++
+                    }
+                    if failed {
+                        summary.Failed++
+                    }
+                    if !failed && record.ExpiresAt <= windowEnd.Unix() {
+                        summary.ExpiringSoon++
+                        if rollupDates[record.DiscordID] == nil {
+                            rollupDates[record.DiscordID] = make(map[string]bool)
+                        }
+                        rollupDates[record.DiscordID][timestamp.UTC().Format("2006-01-02")] = true
+                    }
+                    mu.Unlock()
+                }
+
+                lastKey = result.LastEvaluatedKey
+                if lastKey == nil {
+                    return
+                }
+            }
+        }(segment)
+    }
+    wg.Wait()
+    if err := errors.Join(errs...); err != nil {
+        return summary, err
+    }
+
+    for discordID, dates := range rollupDates {
+        for date := range dates {
+            if ctx.Err() != nil {
+                break
+            }
+            created, err := writeRollup(ctx, svc, discordID, date, retention.RollupDays)
+            if err != nil {
+                slog.Error("日次集計の作成に失敗", "step", "retention", "discord_id", discordID, "date", date, "error", err)
+                summary.Failed++
+                continue
+            }
+            if created {
+                summary.Rollups++
+            }
+        }
+    }
+
+    if ctx.Err() != nil {
+        summary.Partial = true
+        slog.Warn("実行期限のため保持期間の適用を打ち切りました", "step", "retention", "scanned", summary.Scanned, "backfilled", summary.Backfilled, "rollups", summary.Rollups)
+        return summary, errDeadline
+    }
+    slog.Info("保持期間の適用が完了しました", "step", "retention", "scanned", summary.Scanned, "backfilled", summary.Backfilled, "failed", summary.Failed,
+        "window_end", summary.WindowEnd, "expiring_soon", summary.ExpiringSoon, "rollups", summary.Rollups)
+    return summary, nil
+}
+
+func setExpiresAt(ctx context.Context, svc *dynamodb.DynamoDB, record heartbeatRecord) error {
+    // 削除済みのアイテムを作り直さないよう、存在する場合のみ更新する
+    expr, err := expression.NewBuilder().
+        WithUpdate(expression.Set(expression.Name("expires_at"), expression.Value(record.ExpiresAt))).
+        WithCondition(expression.Name("discord_id").AttributeExists()).
+        Build()
+    if err != nil {
+        return &insight.AppError{Kind: insight.KindData, Message: "更新式の構築に失敗", Err: err}
+    }
+    err = insight.Retry(ctx, "update "+tableName, func() error {
+        _, err := svc.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+            TableName: aws.String(tableName),
+            Key: map[string]*dynamodb.AttributeValue{
+                "discord_id": {S: aws.String(record.DiscordID)},
+                "timestamp":  {S: aws.String(record.Timestamp)},
+            },
+            UpdateExpression:          expr.Update(),
+            ConditionExpression:       expr.Condition(),
+            ExpressionAttributeNames:  expr.Names(),
+            ExpressionAttributeValues: expr.Values(),
+        })
+        return err
+    })
+    if err != nil {
+        return &insight.AppError{Kind: insight.KindStore, Message: "expires_at の更新に失敗", Err: err}
+    }
+    return nil
+}
+
+// 1日分のハートビートから日次集計を作成する
+// 既に集計がある場合は、一部が期限切れになった後のデータで上書きしないよう作成しない
+func writeRollup(ctx context.Context, svc *dynamodb.DynamoDB, discordID, date string, rollupDays int) (bool, error) {
+    dayStart, err := time.Parse("2006-01-02", date)
+    if err != nil {
+        return false, &insight.AppError{Kind: insight.KindData, Message: "日付の形式が不正です", Err: err}
+    }
+    dayEnd := dayStart.AddDate(0, 0, 1)
+
+    items, err := insight.QueryHeartbeats(ctx, svc, discordID, dayStart, dayEnd)
+    if err != nil {
+        return false, err
+    }
+    heartbeats := insight.ToHeartbeats(items, nil)
+
+    sessions, languageDurations, projectDurations := insight.CalculateSessionTimes(heartbeats)
+    total := insight.TotalWorkTime(sessions)
+    rollup := Rollup{
+        DiscordID:    discordID,
+        Date:         date,
+        TotalSeconds: int64(total / time.Second),
+        Languages:    make(map[string]int64),
+        ExpiresAt:    dayStart.AddDate(0, 0, rollupDays).Unix(),
+    }
+    for language, duration := range languageDurations {
+        rollup.Languages[language] = int64(duration / time.Second)
+    }
+    if len(projectDurations) > 0 {
+        rollup.Projects = make(map[string]int64)
+        for project, duration := range projectDurations {
+            rollup.Projects[project] = int64(duration / time.Second)
+        }
+    }
+
+    item, err := dynamodbattribute.MarshalMap(rollup)
+    if err != nil {
+        return false, &insight.AppError{Kind: insight.KindData, Message: "日次集計のマーシャルに失敗", Err: err}
+    }
+    condExpr, err := expression.NewBuilder().
+        WithCondition(expression.Name("discord_id").AttributeNotExists()).
+        Build()
+    if err != nil {
+        return false, &insight.AppError{Kind: insight.KindData, Message: "条件式の構築に失敗", Err: err}
+    }
+    err = insight.Retry(ctx, "put "+rollupTableName, func() error {
+        _, err := svc.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+            TableName:                aws.String(rollupTableName),
+            Item:                     item,
+            ConditionExpression:      condExpr.Condition(),
+            ExpressionAttributeNames: condExpr.Names(),
+        })
+        return err
+    })
+    if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+        return false, nil
+    }
+    if err != nil {
+        return false, &insight.AppError{Kind: insight.KindStore, Message: "日次集計の保存に失敗", Err: err}
+    }
+    return true, nil
+}
+
+// 指数バックオフの待機時間（ジッター付き）
+func backoff(attempt int) time.Duration {
+    delay := baseBackoff << uint(attempt)
+    if delay > maxBackoff {
+        delay = maxBackoff
+    }
+    return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// ユーザー単位のデータのエクスポート・削除の依頼
+type UserDataRequest struct {
+    DiscordID   string `json:"discord_id"`
+    Format      string `json:"format"`       // エクスポートの形式（json または csv）
+    Confirm     string `json:"confirm"`      // 削除の確認用。discord_id と同じ値を指定する
+    RequestedBy string `json:"requested_by"` // 監査記録に残す依頼者
+}
+
+type ExportSummary struct {
+    DiscordID string `json:"discord_id"`
+    Format    string `json:"format"`
+    File      string `json:"file"`
+    Items     int    `json:"items"`
+}
+
+type EraseSummary struct {
+    DiscordID  string `json:"discord_id"`
+    Heartbeats int    `json:"heartbeats"`
+    Rollups    int    `json:"rollups"`
+    Settings   int    `json:"settings"` // ユーザー設定（ファイルパスのソルトを含む）
+    Tokens     int    `json:"tokens"`   // 無効にした API トークン
+    Runs       int    `json:"runs"`     // Discord ID を消した実行履歴
+    Failed     int    `json:"failed"`
+}
+
+// エクスポート・削除の監査記録。データの内容は記録しない
+type AuditRecord struct {
+    AuditID     string `json:"audit_id"`
+    Action      string `json:"action"`
+    DiscordID   string `json:"discord_id"`
+    RequestedBy string `json:"requested_by"`
+    Source      string `json:"source"` // event または slash_command
+    RequestedAt string `json:"requested_at"`
+    Items       int    `json:"items"`
+    Failed      int    `json:"failed"`
+    Error       string `json:"error,omitempty"`
+}
+
+func validateUserDataRequest(request *UserDataRequest, erase bool) error {
+    if !insight.IsValidDiscordID(request.DiscordID) {
+        return &insight.AppError{Kind: insight.KindConfig, Message: fmt.Sprintf("discord_id が不正です: %q", request.DiscordID)}
+    }
+    if erase && request.Confirm != request.DiscordID {
+        return &insight.AppError{Kind: insight.KindConfig, Message: "削除するには confirm に discord_id と同じ値を指定してください"}
+    }
+    if !erase && request.Format != "" && request.Format != "json" && request.Format != "csv" {
+        return &insight.AppError{Kind: insight.KindConfig, Message: fmt.Sprintf("エクスポートの形式は json または csv を指定してください: %s", request.Format)}
+    }
+    return nil
+}
+
+// ユーザーのアイテムをすべて取得する
+func queryUserItems(ctx context.Context, svc *dynamodb.DynamoDB, table, discordID string) ([]map[string]*dynamodb.AttributeValue, error) {
+    keyCond := expression.Key("discord_id").Equal(expression.Value(discordID))
+    expr, err := expression.NewBuilder().WithKeyCondition(keyCond).Build()
+    if err != nil {
+        return nil, &insight.AppError{Kind: insight.KindData, Message: "クエリ式の構築に失敗", Err: err}
+    }
+
+    var items []map[string]*dynamodb.AttributeValue
+    var lastKey map[string]*dynamodb.AttributeValue
+    for {
+        var result *dynamodb.QueryOutput
+        err := insight.Retry(ctx, "query "+table, func() error {
+            var err error
+            result, err = svc.QueryWithContext(ctx, &dynamodb.QueryInput{
+                TableName:                 aws.String(table),
+                KeyConditionExpression:    expr.KeyCondition(),
+                ExpressionAttributeNames:  expr.Names(),
+                ExpressionAttributeValues: expr.Values(),
+                ExclusiveStartKey:         lastKey,
+            })
+            return err
+        })
+        if err != nil {
+            return nil, &insight.AppError{Kind: insight.KindStore, Message: fmt.Sprintf("クエリの実行に失敗 (%s)", table), Err: err}
+        }
+        items = append(items, result.Items...)
+        lastKey = result.LastEvaluatedKey
+        if lastKey == nil {
+            return items, nil
+        }
+    }
+}
+
+// ユーザーのハートビートを JSON または CSV に変換する
+func encodeUserExport(items []map[string]*dynamodb.AttributeValue, format string) ([]byte, error) {
+    var records []map[string]interface{}
+    if err := dynamodbattribute.UnmarshalListOfMaps(items, &records); err != nil {
+        return nil, &insight.AppError{Kind: insight.KindData, Message: "データのアンマーシャルに失敗", Err: err}
+    }
+    if records == nil {
+        records = []map[string]interface{}{}
+    }
+
+    if format != "csv" {
+        return json.MarshalIndent(records, "", "  ")
+    }
+
+    // discord_id と timestamp を先頭にして、すべての属性を列にする
+    columns := []string{"discord_id", "timestamp"}
+    seen := map[string]bool{"discord_id": true, "timestamp": true}
+    var others []string
+    for _, record := range records {
+        for name := range record {
+            if !seen[name] {
+                seen[name] = true
+                others = append(others, name)
+            }
+        }
+    }
+    sort.Strings(others)
+    columns = append(columns, others...)
+
+    var buf bytes.Buffer
+    writer := csv.NewWriter(&buf)
+    if err := writer.Write(columns); err != nil {
+        return nil, err
+    }
+    for _, record := range records {
+        row := make([]string, len(columns))
+        for i, column := range columns {
+            if value, ok := record[column]; ok && value != nil {
+                row[i] = fmt.Sprint(value)
+            }
+        }
+        if err := writer.Write(row); err != nil {
+            return nil, err
+        }
+    }
+    writer.Flush()
+    return buf.Bytes(), writer.Error()
+}
+
+func exportFileName(discordID, format string, now time.Time) string {
+    return fmt.Sprintf("export-%s-%s.%s", discordID, now.Format("20060102T150405Z"), format)
+}
+
+// ユーザーのハートビートをエクスポートし、保存先に書き出す
+// 実行期限が近づいた場合は打ち切り、監査記録には失敗として残す
+func exportUserData(ctx context.Context, svc *dynamodb.DynamoDB, store ArchiveStore, request UserDataRequest, source string) (ExportSummary, []byte, error) {
+    workCtx, cancel := insight.AggregateContext(ctx)
+    defer cancel()
+    if request.Format == "" {
+        request.Format = "json"
+    }
+    summary := ExportSummary{DiscordID: request.DiscordID, Format: request.Format}
+    slog.Info("ユーザーのデータをエクスポートします", "step", "export", "discord_id", request.DiscordID, "format", request.Format)
+
+    items, err := queryUserItems(workCtx, svc, tableName, request.DiscordID)
+    var data []byte
+    if err == nil {
+        summary.Items = len(items)
+        data, err = encodeUserExport(items, request.Format)
+    }
+    if err == nil && store != nil {
+        summary.File = exportFileName(request.DiscordID, request.Format, time.Now().UTC())
+        if putErr := store.Put(workCtx, summary.File, bytes.NewReader(data)); putErr != nil {
+            err = &insight.AppError{Kind: insight.KindStore, Message: "エクスポートの保存に失敗", Err: putErr}
+        }
+    }
+
+    writeAudit(ctx, svc, "export", request, source, summary.Items, 0, err)
+    if err != nil {
+        return summary, nil, err
+    }
+    slog.Info("ユーザーのデータをエクスポートしました", "step", "export", "discord_id", request.DiscordID, "items", summary.Items)
+    return summary, data, nil
+}
+
+// ユーザーのハートビートと日次集計をすべて削除する
+// 実行期限が近づいた場合は打ち切ってエラーを返す（再実行すると残りを削除する）
+func eraseUserData(ctx context.Context, svc *dynamodb.DynamoDB, request UserDataRequest, source string) (EraseSummary, error) {
+    workCtx, cancel := insight.AggregateContext(ctx)
+    defer cancel()
+    summary := EraseSummary{DiscordID: request.DiscordID}
+    slog.Info("ユーザーのデータを削除します", "step", "erase", "discord_id", request.DiscordID)
+
+    heartbeats, err := purgeScope(workCtx, svc, PurgeScope{DiscordID: request.DiscordID}, false)
+    summary.Heartbeats = heartbeats.Deleted
+    summary.Failed += heartbeats.Failed
+    if err == nil && heartbeats.Partial {
+        err = errDeadline
+    }
+
+    if err == nil {
+        var rollups []map[string]*dynamodb.AttributeValue
+        rollups, err = queryUserItems(workCtx, svc, rollupTableName, request.DiscordID)
+        if err == nil {
+            keys := make([]map[string]*dynamodb.AttributeValue, len(rollups))
+            for i, item := range rollups {
+                keys[i] = map[string]*dynamodb.AttributeValue{
+                    "discord_id": item["discord_id"],
+                    "date":       item["date"],
+                }
+            }
+            deleted, failed := deleteKeys(workCtx, svc, rollupTableName, keys)
+            summary.Rollups = deleted
+            summary.Failed += failed
+        }
+    }
+    if err == nil {
+        deleted, failed := deleteKeys(workCtx, svc, userSettingsTableName, []map[string]*dynamodb.AttributeValue{
+            {"discord_id": {S: aws.String(request.DiscordID)}},
+        })
+        summary.Settings = deleted
+        summary.Failed += failed
+    }
+    // トークンが残っていると、拡張機能が削除後もハートビートを送り続けるため削除する
+    if err == nil {
+        var keys []map[string]*dynamodb.AttributeValue
+        keys, err = userTokenKeys(workCtx, svc, request.DiscordID)
+        if err == nil {
+            deleted, failed := deleteKeys(workCtx, svc, tokenTableName, keys)
+            summary.Tokens = deleted
+            summary.Failed += failed
+        }
+    }
+    // 実行履歴の失敗の記録にも Discord ID が残るため、置き換える
+    if err == nil {
+        var failed int
+        summary.Runs, failed, err = scrubRuns(workCtx, svc, request.DiscordID)
+        summary.Failed += failed
+    }
+    if err == nil && workCtx.Err() != nil {
+        err = errDeadline
+    }
+    if err == nil && summary.Failed > 0 {
+        err = &insight.AppError{Kind: insight.KindStore, Message: fmt.Sprintf("%d件のアイテムを削除できませんでした", summary.Failed)}
+    }
+
+    writeAudit(ctx, svc, "erase", request, source, summary.Heartbeats+summary.Rollups+summary.Settings+summary.Tokens+summary.Runs, summary.Failed, err)
+    if err != nil {
+        return summary, err
+    }
+    slog.Info("ユーザーのハートビート・日次集計・ユーザー設定・API トークンを削除しました", "step", "erase", "discord_id", request.DiscordID, "heartbeats", summary.Heartbeats, "rollups", summary.Rollups, "tokens", summary.Tokens, "runs", summary.Runs)
+    return summary, nil
+}
+
+// 実行履歴の失敗の記録から Discord ID を消す。消した実行履歴と、更新できなかった実行履歴の数を返す
+func scrubRuns(ctx context.Context, svc *dynamodb.DynamoDB, discordID string) (int, int, error) {
+    runs, err := insight.ListRuns(ctx, svc, "", 0)
+    if err != nil {
+        return 0, 0, err
+    }
+    scrubbed, failed := 0, 0
+    for _, run := range runs {
+        failures, changed := scrubFailures(run.Failures, discordID)
+        if !changed {
+            continue
+        }
+        update := expression.Set(expression.Name("failures"), expression.Value(failures))
+        expr, err := expression.NewBuilder().WithUpdate(update).Build()
+        if err != nil {
+            return scrubbed, failed, &insight.AppError{Kind: insight.KindData, Message: "更新式の構築に失敗", Err: err}
+        }
+        err = insight.Retry(ctx, "update "+runsTableName, func() error {
+            _, err := svc.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+                TableName: aws.String(runsTableName),
+                Key: map[string]*dynamodb.AttributeValue{
+                    "run_id": {S: aws.String(run.RunID)},
+                },
+                UpdateExpression:          expr.Update(),
+                ExpressionAttributeNames:  expr.Names(),
+                ExpressionAttributeValues: expr.Values(),
+            })
+            return err
+        })
+        if err != nil {
+            slog.Error("実行履歴の更新に失敗", "step", "erase", "run_id", run.RunID, "error", err)
+            failed++
+            continue
+        }
+        scrubbed++
+    }
+    return scrubbed, failed, nil
+}
+
+// 失敗の対象とエラーの文字列に含まれる Discord ID を置き換える。置き換えた場合は changed が true
+func scrubFailures(failures []insight.Failure, discordID string) (scrubbed []insight.Failure, changed bool) {
+    scrubbed = make([]insight.Failure, len(failures))
+    for i, failure := range failures {
+        if failure.Target == discordID {
+            failure.Target = erasedDiscordID
+            changed = true
+        }
+        if strings.Contains(failure.Error, discordID) {
+            failure.Error = strings.ReplaceAll(failure.Error, discordID, erasedDiscordID)
+            changed = true
+        }
+        scrubbed[i] = failure
+    }
+    return scrubbed, changed
+}
+
+// ユーザーの API トークンのキー。トークンのテーブルはハッシュ値がキーのため、スキャンして探す
+func userTokenKeys(ctx context.Context, svc *dynamodb.DynamoDB, discordID string) ([]map[string]*dynamodb.AttributeValue, error) {
+    expr, err := expression.NewBuilder().
+        WithFilter(expression.Name("discord_id").Equal(expression.Value(discordID))).
+        WithProjection(expression.NamesList(expression.Name("token_hash"))).
+        Build()
+    if err != nil {
+        return nil, &insight.AppError{Kind: insight.KindData, Message: "スキャン式の構築に失敗", Err: err}
+    }
+
+    var keys []map[string]*dynamodb.AttributeValue
+    var lastKey map[string]*dynamodb.AttributeValue
+    for {
+        var result *dynamodb.ScanOutput
+        err := insight.Retry(ctx, "scan "+tokenTableName, func() error {
+            var err error
+            result, err = svc.ScanWithContext(ctx, &dynamodb.ScanInput{
+                TableName:                 aws.String(tokenTableName),
+                FilterExpression:          expr.Filter(),
+                ProjectionExpression:      expr.Projection(),
+                ExpressionAttributeNames:  expr.Names(),
+                ExpressionAttributeValues: expr.Values(),
+                ExclusiveStartKey:         lastKey,
+            })
+            return err
+        })
+        if err != nil {
+            return nil, &insight.AppError{Kind: insight.KindStore, Message: "API トークンのスキャンに失敗", Err: err}
+        }
+        keys = append(keys, result.Items...)
+        lastKey = result.LastEvaluatedKey
+        if lastKey == nil {
+            return keys, nil
+        }
+    }
+}
+
+// 監査記録を保存する。保存に失敗しても依頼の処理結果は変えない
+// 処理を打ち切った場合も記録を残すため、ctx は処理に使う期限付きのものではなく呼び出し元のものを渡す
+func writeAudit(ctx context.Context, svc *dynamodb.DynamoDB, action string, request UserDataRequest, source string, items, failed int, err error) {
+    now := time.Now().UTC()
+    record := AuditRecord{
+        AuditID:     fmt.Sprintf("%s-%s-%d", action, request.DiscordID, now.UnixNano()),
+        Action:      action,
+        DiscordID:   request.DiscordID,
+        RequestedBy: request.RequestedBy,
+        Source:      source,
+        RequestedAt: now.Format(time.RFC3339),
+        Items:       items,
+        Failed:      failed,
+    }
+    if err != nil {
+        record.Error = err.Error()
+    }
+    item, marshalErr := dynamodbattribute.MarshalMap(record)
+    if marshalErr != nil {
+        slog.Error("監査記録のマーシャルに失敗", "error", marshalErr)
+        return
+    }
+    putErr := insight.Retry(ctx, "put "+auditTableName, func() error {
+        _, err := svc.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+            TableName: aws.String(auditTableName),
+            Item:      item,
+        })
+        return err
+    })
+    if putErr != nil {
+        slog.Error("監査記録の保存に失敗", "audit_id", record.AuditID, "error", putErr)
+        return
+    }
+    slog.Info("監査記録を保存しました", "audit_id", record.AuditID)
+}
+
+// Lambda 関数 URL で受け取った Discord のスラッシュコマンドを処理する
+func handleInteraction(ctx context.Context, svc *dynamodb.DynamoDB, request events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
+    body := request.Body
+    if request.IsBase64Encoded {
+        decoded, err := base64.StdEncoding.DecodeString(body)
+        if err != nil {
+            return events.LambdaFunctionURLResponse{StatusCode: 400}, nil
+        }
+        body = string(decoded)
+    }
+    if !verifyInteraction(request.Headers, body, time.Now()) {
+        slog.Warn("インタラクションの署名が不正です")
+        return events.LambdaFunctionURLResponse{StatusCode: 401, Body: "invalid request signature"}, nil
+    }
+
+    var interaction discordgo.Interaction
+    if err := json.Unmarshal([]byte(body), &interaction); err != nil {
+        return events.LambdaFunctionURLResponse{StatusCode: 400}, nil
+    }
+    if interaction.Type == discordgo.InteractionPing {
+        return interactionResponse(&discordgo.InteractionResponse{Type: discordgo.InteractionResponsePong})
+    }
+    if interaction.Type != discordgo.InteractionApplicationCommand {
+        return events.LambdaFunctionURLResponse{StatusCode: 400}, nil
+    }
+
+    // 本人のデータのみを対象にする
+    var user *discordgo.User
+    if interaction.Member != nil {
+        user = interaction.Member.User
+    } else {
+        user = interaction.User
+    }
+    if user == nil {
+        return events.LambdaFunctionURLResponse{StatusCode: 400}, nil
+    }
+    userRequest := UserDataRequest{DiscordID: user.ID, RequestedBy: user.ID}
+
+    data := interaction.ApplicationCommandData()
+    if data.Name != slashCommandName || len(data.Options) == 0 {
+        return ephemeralResponse("不明なコマンドです。")
+    }
+    subcommand := data.Options[0]
+    for _, option := range subcommand.Options {
+        switch option.Name {
+        case "format":
+            userRequest.Format = option.StringValue()
+        case "confirm":
+            if option.BoolValue() {
+                userRequest.Confirm = user.ID
+            }
+        }
+    }
+
+    switch subcommand.Name {
+    case "export", "erase":
+        if subcommand.Name == "erase" && userRequest.Confirm == "" {
+            return ephemeralResponse("データを削除するには `confirm` に True を指定してください。削除したデータは元に戻せません。")
+        }
+        // Discord は3秒以内の応答を求めるため、処理は非同期の呼び出しで行い、ここでは応答を保留する
+        job := SlashCommandJob{Command: subcommand.Name, Request: userRequest, ApplicationID: interaction.AppID, Token: interaction.Token}
+        if err := invokeSlashCommand(ctx, job); err != nil {
+            slog.Error("スラッシュコマンドの呼び出しに失敗しました", "step", subcommand.Name, "discord_id", user.ID, "kind", insight.KindOf(err), "error", err)
+            return ephemeralResponse("処理を開始できませんでした。時間をおいて再度お試しください。")
+        }
+        return interactionResponse(&discordgo.InteractionResponse{
+            Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+            Data: &discordgo.InteractionResponseData{Flags: discordgo.MessageFlagsEphemeral},
+        })
+    }
+    return ephemeralResponse("不明なコマンドです。")
+}
+
+// 実行中の Lambda 関数を、スラッシュコマンドのイベントで非同期に呼び出す
+func invokeSlashCommand(ctx context.Context, job SlashCommandJob) error {
+    functionName := os.Getenv("AWS_LAMBDA_FUNCTION_NAME")
+    if functionName == "" {
+        return &insight.AppError{Kind: insight.KindConfig, Message: "AWS_LAMBDA_FUNCTION_NAME が設定されていません（スラッシュコマンドは Lambda でのみ実行できます）"}
+    }
+    // action は dispatch.ActionPurge
+    payload, err := json.Marshal(map[string]interface{}{"action": "purge", "slash_command": job})
+    if err != nil {
+        return &insight.AppError{Kind: insight.KindData, Message: "イベントのマーシャルに失敗", Err: err}
+    }
+    _, err = lambda.New(insight.Session).InvokeWithContext(ctx, &lambda.InvokeInput{
+        FunctionName:   aws.String(functionName),
+        InvocationType: aws.String(lambda.InvocationTypeEvent),
+        Payload:        payload,
+    })
+    if err != nil {
+        return &insight.AppError{Kind: insight.KindDelivery, Message: "Lambda の非同期呼び出しに失敗", Err: err}
+    }
+    return nil
+}
+
+// 非同期で呼び出されたスラッシュコマンドを実行し、保留していた応答を結果で編集する
+func runSlashCommand(ctx context.Context, svc *dynamodb.DynamoDB, job SlashCommandJob) *PurgeResult {
+    result := &PurgeResult{}
+    discordID := job.Request.DiscordID
+    var content string
+    var err error
+    switch job.Command {
+    case "export":
+        var summary ExportSummary
+        var file []byte
+        summary, file, err = exportUserData(ctx, svc, nil, job.Request, "slash_command")
+        result.Export = &summary
+        if err != nil {
+            content = "エクスポートに失敗しました。時間をおいて再度お試しください。"
+        } else if err = sendExportDM(ctx, discordID, summary, file); err != nil {
+            content = "DMを送信できませんでした。サーバーメンバーからのDMを許可してください。"
+        } else {
+            content = fmt.Sprintf("ハートビート%d件をDMで送信しました。", summary.Items)
+        }
+    case "erase":
+        var summary EraseSummary
+        summary, err = eraseUserData(ctx, svc, job.Request, "slash_command")
+        result.Erase = &summary
+        switch {
+        case errors.Is(err, context.DeadlineExceeded):
+            content = fmt.Sprintf("ハートビート%d件を削除しましたが、時間内に終わりませんでした。もう一度実行すると残りを削除します。", summary.Heartbeats)
+        case err != nil:
+            content = "削除に失敗しました。時間をおいて再度お試しください。"
+        default:
+            content = fmt.Sprintf("ハートビート%d件と日次集計%d件を削除し、APIトークン%d件を無効にしました。", summary.Heartbeats, summary.Rollups, summary.Tokens)
+        }
+    default:
+        err = &insight.AppError{Kind: insight.KindConfig, Message: fmt.Sprintf("不明なスラッシュコマンドです: %q", job.Command)}
+        content = "不明なコマンドです。"
+    }
+    if err != nil {
+        slog.Error("スラッシュコマンドの実行に失敗しました", "step", job.Command, "discord_id", discordID, "kind", insight.KindOf(err), "error", err)
+    }
+    if err := editInteractionResponse(ctx, job, content); err != nil {
+        slog.Error("スラッシュコマンドの応答の編集に失敗しました", "step", job.Command, "discord_id", discordID, "kind", insight.KindOf(err), "error", err)
+    }
+    return result
+}
+
+// 保留していたスラッシュコマンドの応答を編集する
+func editInteractionResponse(ctx context.Context, job SlashCommandJob, content string) error {
+    dg, err := discordgo.New("Bot " + os.Getenv("DISCORD_TOKEN"))
+    if err != nil {
+        return &insight.AppError{Kind: insight.KindDelivery, Message: "Discordセッションの作成に失敗", Err: err}
+    }
+    err = insight.Retry(ctx, "InteractionResponseEdit", func() error {
+        _, err := dg.InteractionResponseEdit(&discordgo.Interaction{AppID: job.ApplicationID, Token: job.Token}, &discordgo.WebhookEdit{
+            Content: &content,
+        }, discordgo.WithContext(ctx))
+        return err
+    })
+    if err != nil {
+        return &insight.AppError{Kind: insight.KindDelivery, Message: "スラッシュコマンドの応答の編集に失敗", Err: err}
+    }
+    return nil
+}
+
+// Discord の公開鍵でインタラクションの署名を検証する
+// 署名が正しくても、タイムスタンプが now から maxInteractionAge 以上離れている場合は再送として拒否する
+func verifyInteraction(headers map[string]string, body string, now time.Time) bool {
+    publicKey, err := hex.DecodeString(os.Getenv("DISCORD_PUBLIC_KEY"))
+    if err != nil || len(publicKey) != ed25519.PublicKeySize {
+        slog.Error("DISCORD_PUBLIC_KEY が設定されていないか不正です")
+        return false
+    }
+    signature, err := hex.DecodeString(headers["x-signature-ed25519"])
+    if err != nil || len(signature) != ed25519.SignatureSize {
+        return false
+    }
+    timestamp := headers["x-signature-timestamp"]
+    seconds, err := strconv.ParseInt(timestamp, 10, 64)
+    if err != nil {
+        return false
+    }
+    if age := now.Sub(time.Unix(seconds, 0)); age > maxInteractionAge || age < -maxInteractionAge {
+        slog.Warn("インタラクションのタイムスタンプが古すぎるか未来です", "timestamp", timestamp)
+        return false
+    }
+    return ed25519.Verify(publicKey, []byte(timestamp+body), signature)
+}
+
+func interactionResponse(response *discordgo.InteractionResponse) (events.LambdaFunctionURLResponse, error) {
+    body, err := json.Marshal(response)
+    if err != nil {
+        return events.LambdaFunctionURLResponse{StatusCode: 500}, err
+    }
+    return events.LambdaFunctionURLResponse{
+        StatusCode: 200,
+        Headers:    map[string]string{"Content-Type": "application/json"},
+        Body:       string(body),
+    }, nil
+}
+
+// 実行したユーザーにのみ表示されるメッセージで応答する
+func ephemeralResponse(content string) (events.LambdaFunctionURLResponse, error) {
+    return interactionResponse(&discordgo.InteractionResponse{
+        Type: discordgo.InteractionResponseChannelMessageWithSource,
+        Data: &discordgo.InteractionResponseData{
+            Content: content,
+            Flags:   discordgo.MessageFlagsEphemeral,
+        },
+    })
+}
+
+func sendExportDM(ctx context.Context, discordID string, summary ExportSummary, file []byte) error {
+    dg, err := discordgo.New("Bot " + os.Getenv("DISCORD_TOKEN"))
+    if err != nil {
+        return &insight.AppError{Kind: insight.KindDelivery, Message: "Discordセッションの作成に失敗", Err: err}
+    }
+    err = insight.Retry(ctx, "DM", func() error {
+        channel, err := dg.UserChannelCreate(discordID, discordgo.WithContext(ctx))
+        if err != nil {
+            return err
+        }
+        // 再試行でも最初から送信するよう、ファイルは毎回読み込み直す
+        _, err = dg.ChannelMessageSendComplex(channel.ID, &discordgo.MessageSend{
+            Content: fmt.Sprintf("DevInsight に保存されているハートビート%d件のエクスポートです。", summary.Items),
+            Files: []*discordgo.File{{
+                Name:   exportFileName(discordID, summary.Format, time.Now().UTC()),
+                Reader: bytes.NewReader(file),
+            }},
+        }, discordgo.WithContext(ctx))
+        return err
+    })
+    if err != nil {
+        return &insight.AppError{Kind: insight.KindDelivery, Message: "エクスポートの DM の送信に失敗", Err: err}
+    }
+    return nil
+}
+
+// スラッシュコマンドを登録する
+func registerCommands(ctx context.Context) error {
+    appID := os.Getenv("DISCORD_APPLICATION_ID")
+    if appID == "" {
+        return &insight.AppError{Kind: insight.KindConfig, Message: "DISCORD_APPLICATION_ID が設定されていません"}
+    }
+    dg, err := discordgo.New("Bot " + os.Getenv("DISCORD_TOKEN"))
+    if err != nil {
+        return &insight.AppError{Kind: insight.KindDelivery, Message: "Discordセッションの作成に失敗", Err: err}
+    }
+    err = insight.Retry(ctx, "ApplicationCommandCreate", func() error {
+        _, err := dg.ApplicationCommandCreate(appID, os.Getenv("DISCORD_GUILD_ID"), &discordgo.ApplicationCommand{
+            Name:        slashCommandName,
+            Description: "DevInsight に保存されている自分のデータを管理します",
+            Options: []*discordgo.ApplicationCommandOption{
+                {
+                    Type:        discordgo.ApplicationCommandOptionSubCommand,
+                    Name:        "export",
+                    Description: "自分のハートビートをDMで受け取ります",
+                    Options: []*discordgo.ApplicationCommandOption{{
+                        Type:        discordgo.ApplicationCommandOptionString,
+                        Name:        "format",
+                        Description: "ファイルの形式",
+                        Choices: []*discordgo.ApplicationCommandOptionChoice{
+                            {Name: "JSON", Value: "json"},
+                            {Name: "CSV", Value: "csv"},
+                        },
+                    }},
+                },
+                {
+                    Type:        discordgo.ApplicationCommandOptionSubCommand,
+                    Name:        "erase",
+                    Description: "自分のハートビートと集計をすべて削除します",
+                    Options: []*discordgo.ApplicationCommandOption{{
+                        Type:        discordgo.ApplicationCommandOptionBoolean,
+                        Name:        "confirm",
+                        Description: "削除したデータは元に戻せません",
+                        Required:    true,
+                    }},
+                },
+            },
+        }, discordgo.WithContext(ctx))
+        return err
+    })
+    if err != nil {
+        return &insight.AppError{Kind: insight.KindDelivery, Message: "スラッシュコマンドの登録に失敗", Err: err}
+    }
+    slog.Info("スラッシュコマンドを登録しました", "command", slashCommandName)
+    return nil
+}
+
+// 関数 URL からのリクエスト（スラッシュコマンド）とイベントによる呼び出しを振り分ける
+func HandleInvoke(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+    var probe struct {
+        RequestContext json.RawMessage `json:"requestContext"`
+    }
+    if err := json.Unmarshal(payload, &probe); err == nil && probe.RequestContext != nil {
+        var request events.LambdaFunctionURLRequest
+        if err := json.Unmarshal(payload, &request); err != nil {
+            return nil, err
+        }
+        return handleInteraction(ctx, insight.DB, request)
+    }
+
+    var event PurgeEvent
+    if err := json.Unmarshal(payload, &event); err != nil {
+        return nil, &insight.AppError{Kind: insight.KindConfig, Message: "イベントの形式が不正です", Err: err}
+    }
+    return HandleRequest(ctx, event)
+}
\ No newline at end of file
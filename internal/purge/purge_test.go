@@ -0,0 +1,134 @@
+package purge
+
+import (
+    "crypto/ed25519"
+    "encoding/hex"
+    "fmt"
+    "testing"
+    "time"
+
+    "github.com/kkaiki/DevInsight/internal/insight"
+)
+
+func TestValidateEventFullWipe(t *testing.T) {
+    tests := []struct {
+        name    string
+        event   PurgeEvent
+        wantErr bool
+    }{
+        {"full wipe without confirm", PurgeEvent{Scopes: []PurgeScope{{}}}, true},
+        {"full wipe with a wrong confirm", PurgeEvent{Scopes: []PurgeScope{{}}, Confirm: "yes"}, true},
+        {"full wipe with confirm", PurgeEvent{Scopes: []PurgeScope{{}}, Confirm: fullWipeConfirmation}, false},
+        {"full wipe dry run", PurgeEvent{Scopes: []PurgeScope{{}}, DryRun: true}, false},
+        {"full wipe after a scoped one", PurgeEvent{Scopes: []PurgeScope{{Language: "go"}, {}}}, true},
+        {"scoped by user", PurgeEvent{Scopes: []PurgeScope{{DiscordID: "123456789012345678"}}}, false},
+        {"scoped by date", PurgeEvent{Scopes: []PurgeScope{{To: "2024-01-01"}}}, false},
+        {"invalid date", PurgeEvent{Scopes: []PurgeScope{{From: "2024/01/01"}}}, true},
+        {"no scopes", PurgeEvent{}, true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            err := validateEvent(tt.event)
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("validateEvent() error = %v, want error: %v", err, tt.wantErr)
+            }
+            if err != nil && insight.KindOf(err) != insight.KindConfig {
+                t.Errorf("KindOf = %s, want %s", insight.KindOf(err), insight.KindConfig)
+            }
+        })
+    }
+}
+
+func TestVerifyInteraction(t *testing.T) {
+    publicKey, privateKey, err := ed25519.GenerateKey(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Setenv("DISCORD_PUBLIC_KEY", hex.EncodeToString(publicKey))
+
+    now := time.Unix(1700000000, 0)
+    body := `{"type":1}`
+    headers := func(timestamp string, signed string) map[string]string {
+        signature := ed25519.Sign(privateKey, []byte(timestamp+signed))
+        return map[string]string{
+            "x-signature-ed25519":   hex.EncodeToString(signature),
+            "x-signature-timestamp": timestamp,
+        }
+    }
+    at := func(d time.Duration) string {
+        return fmt.Sprint(now.Add(d).Unix())
+    }
+
+    tests := []struct {
+        name    string
+        headers map[string]string
+        want    bool
+    }{
+        {"valid", headers(at(0), body), true},
+        {"a little old", headers(at(-4*time.Minute), body), true},
+        {"stale", headers(at(-6*time.Minute), body), false},
+        {"future", headers(at(6*time.Minute), body), false},
+        {"not a number", headers("yesterday", body), false},
+        {"signed another body", headers(at(0), `{"type":2}`), false},
+        {"no signature", map[string]string{"x-signature-timestamp": at(0)}, false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := verifyInteraction(tt.headers, body, now); got != tt.want {
+                t.Errorf("verifyInteraction() = %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestScrubFailures(t *testing.T) {
+    const discordID = "123456789012345678"
+    tests := []struct {
+        name     string
+        failures []insight.Failure
+        want     []insight.Failure
+        changed  bool
+    }{
+        {"no failures", nil, []insight.Failure{}, false},
+        {
+            "other users",
+            []insight.Failure{{Step: "dm", Target: "876543210987654321", Error: "876543210987654321: failed"}},
+            []insight.Failure{{Step: "dm", Target: "876543210987654321", Error: "876543210987654321: failed"}},
+            false,
+        },
+        {
+            "target and error",
+            []insight.Failure{
+                {Step: "aggregate", Target: discordID, Error: discordID + ": 言語データの取得失敗"},
+                {Step: "post", Target: "channel", Error: "failed"},
+            },
+            []insight.Failure{
+                {Step: "aggregate", Target: erasedDiscordID, Error: erasedDiscordID + ": 言語データの取得失敗"},
+                {Step: "post", Target: "channel", Error: "failed"},
+            },
+            true,
+        },
+        {
+            "mention in an error",
+            []insight.Failure{{Step: "post", Target: "channel", Error: "<@" + discordID + "> not found"}},
+            []insight.Failure{{Step: "post", Target: "channel", Error: "<@" + erasedDiscordID + "> not found"}},
+            true,
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, changed := scrubFailures(tt.failures, discordID)
+            if changed != tt.changed {
+                t.Errorf("changed = %v, want %v", changed, tt.changed)
+            }
+            if len(got) != len(tt.want) {
+                t.Fatalf("got %+v, want %+v", got, tt.want)
+            }
+            for i := range tt.want {
+                if got[i] != tt.want[i] {
+                    t.Errorf("failures[%d] = %+v, want %+v", i, got[i], tt.want[i])
+                }
+            }
+        })
+    }
+}
\ No newline at end of file
@@ -0,0 +1,1037 @@
+package ranking
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	_ "time/tzdata" // Lambda の実行環境にタイムゾーンのデータがない場合に備える
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+
+	"github.com/kkaiki/DevInsight/internal/insight"
+)
+
+// 週間の最終ランキングを投稿するイベントの period
+const periodWeekly = "weekly"
+
+// EventBridge から渡されるイベント
+type RankingEvent struct {
+	Period string `json:"period"` // "weekly" の場合は最終ランキングとして投稿
+}
+
+// 実行時の設定（devinsight report で変更する）
+type Options struct {
+	Post    bool                // false の場合は Discord に投稿せず、Output にメッセージを書き出す
+	GuildID string              // 指定した場合はこのサーバーのみを対象にする
+	Output  io.Writer           // 投稿しない場合の書き出し先
+	Summary *insight.RunSummary // 失敗したユーザー・投稿先の記録先（nil の場合は Run で作成する）
+}
+
+// ライブランキングのメッセージIDを探す実行履歴の件数（処理ごと）
+const liveRunLookback = 20
+
+// ランキングに表示する最低作業時間の既定値
+const defaultMinRankingTime = time.Hour
+
+// 最低作業時間に満たないユーザーを表示する上限。超えた分は人数だけ表示する
+const maxOthers = 20
+
+// Discord のメッセージの最大文字数
+const maxMessageLength = 2000
+
+// ライブランキングの最終更新日時の書式
+const liveUpdatedLayout = "2006/01/02 15:04"
+
+// ランキング対象外となったユーザーの集計
+type MemberReport struct {
+	Departed  []string // サーバーに存在しない（退出済み・未参加）ユーザー
+	Malformed []string // Discord IDとして不正な値
+	Skipped   int      // 実行期限までに集計できなかったユーザー数
+}
+
+// ギルドのメンバーのみを残し、対象外のユーザーを報告する
+// メンバー情報を取得できなかったユーザーは summary に記録する
+func filterGuildMembers(ctx context.Context, dg *discordgo.Session, guildID string, data []insight.DiscordWorkTime, summary *insight.RunSummary) ([]insight.DiscordWorkTime, *MemberReport) {
+	report := &MemberReport{}
+	var members []insight.DiscordWorkTime
+	for _, entry := range data {
+		if !insight.IsValidDiscordID(entry.DiscordID) {
+			slog.Warn("不正なDiscord ID", "step", "members", "discord_id", entry.DiscordID)
+			report.Malformed = append(report.Malformed, entry.DiscordID)
+			continue
+		}
+		// Discord に接続していない場合（トークンなしのローカル実行）も確認しない
+		if guildID == "" || dg == nil {
+			members = append(members, entry)
+			continue
+		}
+		err := insight.Retry(ctx, "GuildMember", func() error {
+			_, err := dg.GuildMember(guildID, entry.DiscordID, discordgo.WithContext(ctx))
+			return err
+		})
+		if err != nil {
+			if insight.IsUnknownMemberError(err) {
+				slog.Warn("サーバーに存在しないユーザー", "step", "members", "guild_id", guildID, "discord_id", entry.DiscordID)
+				report.Departed = append(report.Departed, entry.DiscordID)
+				continue
+			}
+			// 一時的なエラーではランキングから除外しない
+			slog.Error("メンバー情報の取得に失敗", "step", "members", "guild_id", guildID, "discord_id", entry.DiscordID, "error", err)
+			summary.Record("members", entry.DiscordID, &insight.AppError{Kind: insight.KindDelivery, Message: "メンバー情報の取得に失敗", Err: err})
+		}
+		members = append(members, entry)
+	}
+	slog.Info("メンバーを確認しました", "step", "members", "guild_id", guildID, "members", len(members), "departed", len(report.Departed), "malformed", len(report.Malformed))
+	return members, report
+}
+
+// 投稿しない場合は DISCORD_TOKEN を必須にしない
+func validateEnv(requireToken bool) error {
+	discordToken := os.Getenv("DISCORD_TOKEN")
+	otherLanguages := os.Getenv("OTHER_LANGUAGES")
+	mergeLanguages := os.Getenv("MERGE_LANGUAGES")
+
+	slog.Debug("環境変数", "discord_token_set", discordToken != "", "other_languages", otherLanguages, "merge_languages", mergeLanguages)
+
+	if discordToken == "" && requireToken {
+		return &insight.AppError{
+			Kind:    insight.KindConfig,
+			Message: "DISCORD_TOKEN が設定されていません",
+		}
+	}
+	if otherLanguages == "" {
+		return &insight.AppError{
+			Kind:    insight.KindConfig,
+			Message: "OTHER_LANGUAGES が設定されていません",
+		}
+	}
+	if mergeLanguages == "" {
+		return &insight.AppError{
+			Kind:    insight.KindConfig,
+			Message: "MERGE_LANGUAGES が設定されていません",
+		}
+	}
+	return nil
+}
+
+// サーバー登録テーブルから投稿先を読み込む
+// 登録がない場合は DISCORD_GUILD_ID / DISCORD_CHANNEL_ID を使用する
+func loadGuildRegistry(ctx context.Context) ([]insight.GuildConfig, error) {
+	guilds, err := insight.ScanGuildRegistry(ctx, insight.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	var registered []insight.GuildConfig
+	for _, guild := range guilds {
+		if len(guild.ChannelIDs) == 0 {
+			slog.Warn("投稿先チャンネルが登録されていません", "guild_id", guild.GuildID)
+			continue
+		}
+		registered = append(registered, guild)
+	}
+	if len(registered) > 0 {
+		slog.Info("登録済みのサーバーを読み込みました", "guilds", len(registered))
+		return registered, nil
+	}
+
+	channelID := os.Getenv("DISCORD_CHANNEL_ID")
+	if channelID == "" {
+		return nil, &insight.AppError{
+			Kind:    insight.KindConfig,
+			Message: "サーバーが登録されておらず、DISCORD_CHANNEL_ID も設定されていません",
+		}
+	}
+	slog.Info("環境変数の投稿先を使用します", "channel_id", channelID)
+	return []insight.GuildConfig{{
+		GuildID:            os.Getenv("DISCORD_GUILD_ID"),
+		ChannelIDs:         []string{channelID},
+		LiveLeaderboard:    os.Getenv("LIVE_LEADERBOARD") == "true",
+		Locale:             os.Getenv("REPORT_LOCALE"),
+		MinRankingMinutes:  getMinRankingMinutesEnv(),
+		ModeratorChannelID: os.Getenv("MODERATOR_CHANNEL_ID"),
+	}}, nil
+}
+
+// MIN_RANKING_MINUTES が未設定・不正な場合は nil（既定値を使用）
+func getMinRankingMinutesEnv() *int {
+	value := os.Getenv("MIN_RANKING_MINUTES")
+	if value == "" {
+		return nil
+	}
+	minutes, err := strconv.Atoi(value)
+	if err != nil || minutes < 0 {
+		slog.Warn("MIN_RANKING_MINUTES が不正です", "value", value)
+		return nil
+	}
+	return &minutes
+}
+
+// エラーを種類とともに出力する
+func logError(err error) {
+	slog.Error("処理に失敗", "kind", insight.KindOf(err), "error", err)
+}
+
+// レポートの言語ごとの文言とテンプレート
+type Locale struct {
+	Header         string // ヘッダーのテンプレート
+	Entries        string // ランキング本体のテンプレート
+	Footer         string // フッターのテンプレート
+	NoData         string
+	LastUpdated    string // fmt形式: 更新日時
+	ThreadName     string // fmt形式: 開始日, 終了日
+	HourMinute     string // fmt形式: 時間, 分
+	PrivateProject string // 非公開にしたプロジェクトの表示名
+	// フッターに表示する集計ルール
+	RuleMaxDaily   string // fmt形式: 時間
+	RuleMaxSession string // fmt形式: 時間
+	RuleQuietHours string // fmt形式: 開始時刻, 終了時刻, タイムゾーン
+	// モデレーターへの通知
+	ModeratorAlert      string // fmt形式: 対応
+	ActionMark          string
+	ActionCap           string
+	AnomalyLongSession  string // fmt形式: 時間, 開始日時
+	AnomalyPeriodic     string // fmt形式: 回数, 開始日時
+	AnomalyMultiMachine string // fmt形式: 時間, 開始日時
+	// 週間の集計の DM
+	Summary string // fmt形式: 開始日, 合計時間
+}
+
+const defaultLocale = "ja"
+
+const downloadURL = "https://marketplace.visualstudio.com/items?itemName=DevInsights.vscode-DevInsights"
+
+var locales = map[string]Locale{
+	"ja": {
+		Header: "作業時間ランキング ({{.StartDate}} から)\n" +
+			"========================\n",
+		Entries: "{{range .Entries}}{{.Prefix}}{{.Mention}}{{if .Flagged}} ⚠️{{end}} {{duration .TotalTime}}\n" +
+			"{{range .Languages}}  - {{.Name}}: {{duration .Time}}\n{{end}}" +
+			"{{if .Projects}}  📁 {{range $i, $p := .Projects}}{{if $i}}, {{end}}{{$p.Name}} ({{duration $p.Time}}){{end}}\n{{end}}" +
+			"{{end}}" +
+			"{{if .MoreEntries}}ほか{{.MoreEntries}}人\n{{end}}" +
+			"{{if or .Others .MoreOthers}}今週コーディングしたメンバー: " +
+			"{{range $i, $e := .Others}}{{if $i}}, {{end}}{{$e.Mention}} ({{duration $e.TotalTime}}){{end}}" +
+			"{{if .MoreOthers}}{{if .Others}} {{end}}ほか{{.MoreOthers}}人{{end}}\n{{end}}",
+		Footer: "========================\n" +
+			"{{if .Rules}}※ 集計ルール: {{join .Rules \" / \"}}\n{{end}}" +
+			"{{if .Flagged}}⚠️ 不自然な作業記録が検出されたユーザーを確認中です\n{{end}}" +
+			"{{if .Skipped}}⚠️ 時間内に集計できなかった {{.Skipped}}人 を除いた途中経過です\n{{end}}" +
+			"{{if .Departed}}※ サーバーに参加していないユーザー {{len .Departed}}人 を除外しました\n{{end}}" +
+			"{{if .Malformed}}※ 不正なDiscord IDを除外しました: {{codeList .Malformed}}\n" +
+			"Discord IDは17〜20桁の数字です（ユーザー名ではありません）\n{{end}}" +
+			"[\n\nダウンロード]({{.DownloadURL}})\n",
+		NoData:              "データがありません。",
+		LastUpdated:         "最終更新: %s (UTC)\n",
+		ThreadName:          "作業時間ランキング %s〜%s",
+		HourMinute:          "%d時間%d分",
+		PrivateProject:      "非公開プロジェクト",
+		RuleMaxDaily:        "1日最大%s",
+		RuleMaxSession:      "1セッション最大%s",
+		RuleQuietHours:      "%s〜%s (%s) は集計外",
+		ModeratorAlert:      "⚠️ 不自然な作業記録を検出しました（%s）\n",
+		ActionMark:          "ランキングに印を付けました",
+		ActionCap:           "該当する時間を集計から除きました",
+		AnomalyLongSession:  "%sの連続したセッション（%s〜）",
+		AnomalyPeriodic:     "一定間隔のハートビートが%d回連続（%s〜）",
+		AnomalyMultiMachine: "複数のマシンで別の言語を同時に%s作業（%s〜）",
+		Summary:             "📊 %s からの作業時間: %s\n",
+	},
+	"en": {
+		Header: "Coding Time Ranking (since {{.StartDate}})\n" +
+			"========================\n",
+		Entries: "{{range .Entries}}{{.Prefix}}{{.Mention}}{{if .Flagged}} ⚠️{{end}} {{duration .TotalTime}}\n" +
+			"{{range .Languages}}  - {{.Name}}: {{duration .Time}}\n{{end}}" +
+			"{{if .Projects}}  📁 {{range $i, $p := .Projects}}{{if $i}}, {{end}}{{$p.Name}} ({{duration $p.Time}}){{end}}\n{{end}}" +
+			"{{end}}" +
+			"{{if .MoreEntries}}+{{.MoreEntries}} more\n{{end}}" +
+			"{{if or .Others .MoreOthers}}Also coded this week: " +
+			"{{range $i, $e := .Others}}{{if $i}}, {{end}}{{$e.Mention}} ({{duration $e.TotalTime}}){{end}}" +
+			"{{if .MoreOthers}}{{if .Others}} {{end}}+{{.MoreOthers}} more{{end}}\n{{end}}",
+		Footer: "========================\n" +
+			"{{if .Rules}}* Rules: {{join .Rules \", \"}}\n{{end}}" +
+			"{{if .Flagged}}⚠️ Unusual activity was detected and is under review\n{{end}}" +
+			"{{if .Skipped}}⚠️ Partial results: {{.Skipped}} user(s) could not be counted in time\n{{end}}" +
+			"{{if .Departed}}* Excluded {{len .Departed}} user(s) who are not members of this server\n{{end}}" +
+			"{{if .Malformed}}* Excluded invalid Discord IDs: {{codeList .Malformed}}\n" +
+			"A Discord ID is a 17-20 digit number (not your username)\n{{end}}" +
+			"[\n\nDownload]({{.DownloadURL}})\n",
+		NoData:              "No data available.",
+		LastUpdated:         "Last updated: %s (UTC)\n",
+		ThreadName:          "Coding Time Ranking %s - %s",
+		HourMinute:          "%dh %dm",
+		PrivateProject:      "private project",
+		RuleMaxDaily:        "max %s per day",
+		RuleMaxSession:      "max %s per session",
+		RuleQuietHours:      "%s-%s (%s) not counted",
+		ModeratorAlert:      "⚠️ Unusual activity detected (%s)\n",
+		ActionMark:          "marked in the ranking",
+		ActionCap:           "excluded from the credited time",
+		AnomalyLongSession:  "continuous session of %s (from %s)",
+		AnomalyPeriodic:     "%d perfectly periodic heartbeats in a row (from %s)",
+		AnomalyMultiMachine: "%s of different languages on multiple machines at once (from %s)",
+		Summary:             "📊 Your coding time since %s: %s\n",
+	},
+}
+
+// テンプレートに渡すレポートの内容
+type ReportData struct {
+	StartDate   string
+	Entries     []ReportEntry
+	MoreEntries int           // メッセージの長さの上限のため Entries に含めなかったユーザー数
+	Others      []ReportEntry // 最低作業時間に満たないユーザー（maxOthers 人まで）
+	MoreOthers  int           // Others に含めなかったユーザー数（上限を超えた分と、メッセージの長さのため除いた分）
+	Departed    []string
+	Malformed   []string
+	Skipped     int      // 実行期限までに集計できず、含めていないユーザー数
+	Flagged     int      // 不自然な作業記録を検出したユーザー数
+	Rules       []string // 集計ルール
+	DownloadURL string
+}
+
+type ReportEntry struct {
+	Rank      int    // 同じ作業時間のユーザーは同順位
+	Prefix    string // 上位3位のメダルと見出し
+	Mention   string
+	TotalTime time.Duration
+	Languages []LanguageTime // 上位3言語
+	Projects  []LanguageTime // 上位3プロジェクト
+	Flagged   bool           // 不自然な作業記録を検出（確認中）
+}
+
+func getLocale(name string) Locale {
+	if locale, ok := locales[name]; ok {
+		return locale
+	}
+	if name != "" {
+		slog.Warn("未対応のロケールのため既定のロケールを使用します", "locale", name, "default", defaultLocale)
+	}
+	return locales[defaultLocale]
+}
+
+func formatDuration(locale Locale, d time.Duration) string {
+	return fmt.Sprintf(locale.HourMinute, int(d.Hours()), int(d.Minutes())%60)
+}
+
+func executeTemplate(locale Locale, name, text string, data ReportData) (string, error) {
+	tmpl, err := template.New(name).Funcs(template.FuncMap{
+		"duration": func(d time.Duration) string {
+			return formatDuration(locale, d)
+		},
+		// メンションにならないようコード表記で表示
+		"codeList": func(values []string) string {
+			codes := make([]string, len(values))
+			for i, value := range values {
+				codes[i] = "`" + strings.ReplaceAll(value, "`", "") + "`"
+			}
+			return strings.Join(codes, ", ")
+		},
+		"join": func(values []string, sep string) string {
+			return strings.Join(values, sep)
+		},
+	}).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// レポートの各セクションを描画する
+// ユーザー定義のテンプレートが不正な場合はロケールの標準テンプレートを使用
+func renderSection(guild insight.GuildConfig, locale Locale, name, fallback string, data ReportData) string {
+	if override := guild.Templates[name]; override != "" {
+		out, err := executeTemplate(locale, name, override, data)
+		if err == nil {
+			return out
+		}
+		slog.Warn("サーバーのテンプレートの描画に失敗", "guild_id", guild.GuildID, "template", name, "error", err)
+	}
+	out, err := executeTemplate(locale, name, fallback, data)
+	if err != nil {
+		slog.Error("テンプレートの描画に失敗", "template", name, "error", err)
+	}
+	return out
+}
+
+// limit はメッセージの最大文字数。ヘッダーとフッターは常にすべて表示し、収まらない分はランキングの末尾から人数だけの表示にする
+func formatMessage(dg *discordgo.Session, guild insight.GuildConfig, data []insight.DiscordWorkTime, report *MemberReport, limit int) string {
+	locale := getLocale(guild.Locale)
+	if len(data) == 0 {
+		return locale.NoData
+	}
+
+	startDate := insight.PeriodStart(time.Now())
+
+	reportData := ReportData{
+		StartDate:   startDate.Format("2006/01/02"),
+		DownloadURL: downloadURL,
+	}
+	if report != nil {
+		reportData.Departed = report.Departed
+		reportData.Malformed = report.Malformed
+		reportData.Skipped = report.Skipped
+	}
+
+	minTime := defaultMinRankingTime
+	if guild.MinRankingMinutes != nil {
+		minTime = time.Duration(*guild.MinRankingMinutes) * time.Minute
+	}
+
+	markAnomalies := insight.GetAntiCheatConfig().Action == insight.AntiCheatMark
+	reportData.Rules = describeRules(insight.GetFairnessRules(), locale)
+
+	// 表示上の順位でメダルを付ける。表示は分単位のため、分単位で同じ時間なら同順位
+	rank := 0
+	var prevTime time.Duration
+	for _, entry := range data {
+		if entry.TotalTime < minTime {
+			if len(reportData.Others) >= maxOthers {
+				reportData.MoreOthers++
+				continue
+			}
+			reportData.Others = append(reportData.Others, ReportEntry{
+				Mention:   fmt.Sprintf("<@%s>", entry.DiscordID),
+				TotalTime: entry.TotalTime,
+			})
+			continue
+		}
+
+		displayedTime := entry.TotalTime.Truncate(time.Minute)
+		if len(reportData.Entries) == 0 || displayedTime != prevTime {
+			rank = len(reportData.Entries) + 1
+			prevTime = displayedTime
+		}
+		slog.Debug("ランキング", "rank", rank, "discord_id", entry.DiscordID, "total_time", entry.TotalTime)
+
+		var rankPrefix string
+		switch rank {
+		case 1:
+			rankPrefix = "# 🥇 "
+		case 2:
+			rankPrefix = "## 🥈 "
+		case 3:
+			rankPrefix = "### 🥉 "
+		default:
+			rankPrefix = ""
+		}
+
+		// トップ3の言語とその使用時間を追加
+		sortedLanguages := sortLanguagesByTime(entry.Languages)
+		if len(sortedLanguages) > 3 {
+			sortedLanguages = sortedLanguages[:3]
+		}
+
+		sortedProjects := sortLanguagesByTime(entry.Projects)
+		if len(sortedProjects) > 3 {
+			sortedProjects = sortedProjects[:3]
+		}
+		for i := range sortedProjects {
+			if sortedProjects[i].Name == insight.PrivateProjectKey {
+				sortedProjects[i].Name = locale.PrivateProject
+			}
+		}
+
+		reportData.Entries = append(reportData.Entries, ReportEntry{
+			Rank:      rank,
+			Prefix:    rankPrefix,
+			Mention:   fmt.Sprintf("<@%s>", entry.DiscordID),
+			TotalTime: entry.TotalTime,
+			Languages: sortedLanguages,
+			Projects:  sortedProjects,
+			Flagged:   markAnomalies && len(entry.Anomalies) > 0,
+		})
+		if reportData.Entries[len(reportData.Entries)-1].Flagged {
+			reportData.Flagged++
+		}
+	}
+
+	header := renderSection(guild, locale, "header", locale.Header, reportData)
+	footer := renderSection(guild, locale, "footer", locale.Footer, reportData)
+	entries := renderSection(guild, locale, "entries", locale.Entries, reportData)
+	// 最低作業時間に満たないユーザー、ランキングの順に末尾から除く
+	for messageLength(header+entries+footer) > limit && len(reportData.Entries)+len(reportData.Others) > 0 {
+		if n := len(reportData.Others); n > 0 {
+			reportData.Others = reportData.Others[:n-1]
+			reportData.MoreOthers++
+		} else {
+			reportData.Entries = reportData.Entries[:len(reportData.Entries)-1]
+			reportData.MoreEntries++
+		}
+		entries = renderSection(guild, locale, "entries", locale.Entries, reportData)
+	}
+	// サーバー独自のヘッダー・フッターだけで上限を超える場合
+	return truncateMessage(header+entries+footer, limit)
+}
+
+// Discord のメッセージの長さ（文字数）
+func messageLength(message string) int {
+	return utf8.RuneCountInString(message)
+}
+
+// 上限を超えるメッセージを、上限に収まる最後の行までで切り詰める
+func truncateMessage(message string, limit int) string {
+	if messageLength(message) <= limit {
+		return message
+	}
+	message = string([]rune(message)[:limit])
+	if i := strings.LastIndex(message, "\n"); i > 0 {
+		return message[:i]
+	}
+	return message
+}
+
+// Lambda のハンドラー。集計したランキングを登録された全サーバーに投稿する
+func HandleRequest(ctx context.Context, event RankingEvent) error {
+	return Run(ctx, event, Options{Post: true})
+}
+
+func Run(ctx context.Context, event RankingEvent, options Options) (err error) {
+	started := time.Now()
+	if options.Summary == nil {
+		options.Summary = &insight.RunSummary{}
+		defer options.Summary.Log()
+	}
+	var aggregation *insight.Aggregation
+	if options.Post {
+		// 投稿した場合のみ実行履歴を保存する（ライブランキングの編集・週ごとの比較に使う）
+		defer func() {
+			insight.SaveRun(ctx, insight.DB, insight.NewRunRecord(ctx, "ranking", event.Period, started, aggregation, options.Summary, err))
+		}()
+	}
+	if err := validateEnv(options.Post); err != nil {
+		logError(err)
+		return err
+	}
+
+	// 実行期限が近づいたら集計を打ち切り、集計できたユーザーだけで投稿する
+	aggregateCtx, cancel := insight.AggregateContext(ctx)
+	defer cancel()
+	aggregation, err = insight.Aggregate(aggregateCtx, insight.DB, insight.PeriodStart(time.Now()))
+	if err != nil {
+		logError(err)
+		return err
+	}
+	options.Summary.RecordAggregation(aggregation)
+	return deliver(ctx, event, options, aggregation)
+}
+
+// 集計済みのデータでランキングを投稿する（集計をロール付与などと共有する場合）
+// 集計の失敗は呼び出し元で options.Summary に記録する
+func Deliver(ctx context.Context, event RankingEvent, options Options, aggregation *insight.Aggregation) error {
+	if err := validateEnv(options.Post); err != nil {
+		logError(err)
+		return err
+	}
+	return deliver(ctx, event, options, aggregation)
+}
+
+func deliver(ctx context.Context, event RankingEvent, options Options, aggregation *insight.Aggregation) error {
+	started := time.Now()
+	if len(aggregation.Data) == 0 {
+		err := &insight.AppError{
+			Kind:    insight.KindData,
+			Message: fmt.Sprintf("集計可能なデータがありません（集計に失敗: %d人, 未集計: %d人）", len(aggregation.Failures), len(aggregation.Skipped)),
+		}
+		logError(err)
+		return err
+	}
+	if aggregation.Partial() {
+		slog.Warn("集計が実行期限で打ち切られたため、途中経過として投稿します", "step", "post", "skipped", len(aggregation.Skipped))
+	}
+
+	guilds, err := loadGuildRegistry(ctx)
+	if err != nil {
+		logError(err)
+		return err
+	}
+	if options.GuildID != "" {
+		guilds = insight.SelectGuild(guilds, options.GuildID)
+		if len(guilds) == 0 {
+			return &insight.AppError{
+				Kind:    insight.KindConfig,
+				Message: fmt.Sprintf("サーバー %s は登録されていません", options.GuildID),
+			}
+		}
+	}
+
+	discordToken := os.Getenv("DISCORD_TOKEN")
+	dg, err := openDiscordSession(discordToken, options.Post, len(guilds))
+	if err != nil {
+		logError(err)
+		return err
+	}
+	if dg != nil {
+		defer dg.Close()
+	}
+
+	// 1つのサーバーの失敗で他のサーバーへの投稿を止めない
+	var failedGuilds []string
+	for _, guild := range guilds {
+		if err := postGuildRanking(ctx, dg, guild, aggregation, event, options); err != nil {
+			logError(err)
+			failedGuilds = append(failedGuilds, guild.GuildID)
+		}
+	}
+	if len(failedGuilds) > 0 {
+		return &insight.AppError{
+			Kind:    insight.KindDelivery,
+			Message: fmt.Sprintf("%d/%d件のサーバーへの投稿に失敗: %v", len(failedGuilds), len(guilds), failedGuilds),
+		}
+	}
+
+	slog.Info("ランキングを投稿しました", "step", "post", "period", event.Period, "guilds", len(guilds), "duration", time.Since(started))
+	return nil
+}
+
+// Discord のセッションを作成する。投稿する場合のみ接続を開き、
+// 投稿せずトークンもない場合は nil を返す（メンバーの確認をスキップする）
+func openDiscordSession(discordToken string, post bool, guildCount int) (*discordgo.Session, error) {
+	if discordToken == "" && !post {
+		slog.Warn("DISCORD_TOKEN が設定されていないため、メンバーの確認をスキップします")
+		return nil, nil
+	}
+
+	slog.Debug("Discordのセッションを作成します", "guilds", guildCount)
+	dg, err := discordgo.New("Bot " + discordToken)
+	if err != nil {
+		return nil, &insight.AppError{
+			Kind:    insight.KindDelivery,
+			Message: "Discordセッションの作成に失敗",
+			Err:     err,
+		}
+	}
+	if !post {
+		// メンバーとチャンネルの確認は REST API のみで行う
+		return dg, nil
+	}
+
+	err = dg.Open()
+	if err != nil {
+		return nil, &insight.AppError{
+			Kind:    insight.KindDelivery,
+			Message: "Discordセッションのオープンに失敗",
+			Err:     err,
+		}
+	}
+	slog.Debug("Discordのセッションを開きました")
+	return dg, nil
+}
+
+// サーバーごとにメンバーのみのランキングを作成し、登録された全チャンネルに投稿する
+func postGuildRanking(ctx context.Context, dg *discordgo.Session, guild insight.GuildConfig, aggregation *insight.Aggregation, event RankingEvent, options Options) error {
+	guildID := guild.GuildID
+	for _, channelID := range guild.ChannelIDs {
+		if dg == nil {
+			break
+		}
+		// チャンネル情報取得で権限や存在確認
+		ch, chErr := dg.State.Channel(channelID)
+		if chErr != nil || ch == nil {
+			// APIからも取得を試みる
+			chErr = insight.Retry(ctx, "Channel", func() error {
+				var err error
+				ch, err = dg.Channel(channelID, discordgo.WithContext(ctx))
+				return err
+			})
+			if chErr != nil {
+				slog.Error("チャンネル情報の取得に失敗", "step", "channel", "channel_id", channelID, "error", chErr)
+				options.Summary.Record("channel", channelID, &insight.AppError{Kind: insight.KindDelivery, Message: "チャンネル情報の取得に失敗", Err: chErr})
+				continue
+			}
+		}
+		slog.Debug("チャンネルを確認しました", "step", "channel", "channel_id", ch.ID, "guild_id", ch.GuildID)
+		// サーバーIDが未登録の場合はチャンネルの所属サーバーを使用
+		if guildID == "" {
+			guildID = ch.GuildID
+		}
+		if ch.GuildID != guildID {
+			slog.Warn("チャンネルが登録されたサーバーに属していません", "step", "channel", "channel_id", channelID, "guild_id", guildID)
+		}
+	}
+	if guildID == "" {
+		slog.Warn("サーバーIDが特定できないため、メンバー確認をスキップします", "channel_ids", guild.ChannelIDs)
+	}
+
+	members, memberReport := filterGuildMembers(ctx, dg, guildID, aggregation.Data, options.Summary)
+	memberReport.Skipped = len(aggregation.Skipped)
+
+	locale := getLocale(guild.Locale)
+	message := formatMessage(dg, guild, members, memberReport, messageLimit(guild, locale))
+
+	// ライブランキングの更新ごとに通知しないよう、最終ランキングの投稿時のみ通知する
+	var alert string
+	if guild.ModeratorChannelID != "" && (!guild.LiveLeaderboard || event.Period == periodWeekly) {
+		alert = formatModeratorAlert(locale, members)
+	}
+
+	if !options.Post {
+		fmt.Fprintf(options.Output, "===== guild: %s, channels: %v =====\n%s", guild.GuildID, guild.ChannelIDs, message)
+		if alert != "" {
+			fmt.Fprintf(options.Output, "===== moderator: %s =====\n%s\n", guild.ModeratorChannelID, alert)
+		}
+		return nil
+	}
+
+	if alert != "" {
+		msg, err := notifyModerators(ctx, dg, guild.ModeratorChannelID, alert)
+		if err != nil {
+			logError(err)
+			options.Summary.Record("moderator", guild.ModeratorChannelID, err)
+		}
+		recordMessage(options.Summary, "moderator", msg)
+	}
+
+	var sendErr error
+	for _, channelID := range guild.ChannelIDs {
+		if !guild.LiveLeaderboard {
+			slog.Debug("ランキングを投稿します", "step", "post", "channel_id", channelID)
+			msg, err := sendDiscordMessage(ctx, dg, channelID, message)
+			if err != nil {
+				logError(err)
+				options.Summary.Record("post", channelID, err)
+				sendErr = err
+			}
+			recordMessage(options.Summary, "post", msg)
+			continue
+		}
+
+		slog.Debug("ライブランキングを更新します", "step", "live", "channel_id", channelID)
+		msg, err := updateLiveLeaderboard(ctx, dg, locale, channelID, message)
+		if err != nil {
+			logError(err)
+			options.Summary.Record("live", channelID, err)
+			sendErr = err
+		}
+		recordMessage(options.Summary, "live", msg)
+		if event.Period == periodWeekly {
+			slog.Debug("最終ランキングのスレッドを作成します", "step", "thread", "channel_id", channelID)
+			msg, err := postRankingThread(ctx, dg, locale, channelID, message)
+			if err != nil {
+				logError(err)
+				options.Summary.Record("thread", channelID, err)
+				sendErr = err
+			}
+			recordMessage(options.Summary, "thread", msg)
+		}
+	}
+	return sendErr
+}
+
+// 投稿したメッセージを実行履歴に残す。投稿できなかった場合（nil）は何もしない
+func recordMessage(summary *insight.RunSummary, kind string, msg *discordgo.Message) {
+	if msg != nil {
+		summary.RecordMessage(kind, msg.ChannelID, msg.ID)
+	}
+}
+
+// ピン留めしたライブランキングを編集する。未作成・削除済みの場合は新規投稿してピン留めする
+// 編集・投稿したメッセージは実行履歴に残り、次の実行で編集するメッセージになる
+func updateLiveLeaderboard(ctx context.Context, dg *discordgo.Session, locale Locale, channelID, message string) (*discordgo.Message, error) {
+	now := time.Now().UTC()
+	content := message + liveUpdatedSuffix(locale, now)
+
+	messageID, err := getLiveMessageID(ctx, channelID)
+	if err != nil {
+		return nil, err
+	}
+	if messageID != "" {
+		var edited *discordgo.Message
+		err := insight.Retry(ctx, "ChannelMessageEdit", func() error {
+			var err error
+			edited, err = dg.ChannelMessageEdit(channelID, messageID, content, discordgo.WithContext(ctx))
+			return err
+		})
+		if err == nil {
+			return edited, nil
+		}
+		var restErr *discordgo.RESTError
+		if !errors.As(err, &restErr) || restErr.Message == nil || restErr.Message.Code != discordgo.ErrCodeUnknownMessage {
+			return nil, &insight.AppError{
+				Kind:    insight.KindDelivery,
+				Message: "ライブランキングの編集に失敗",
+				Err:     err,
+			}
+		}
+		slog.Warn("ライブランキングのメッセージが削除されているため再投稿します", "step", "live", "channel_id", channelID, "message_id", messageID)
+	}
+
+	var msg *discordgo.Message
+	err = insight.Retry(ctx, "ChannelMessageSend", func() error {
+		var err error
+		msg, err = dg.ChannelMessageSend(channelID, content, discordgo.WithContext(ctx))
+		return err
+	})
+	if err != nil {
+		return nil, &insight.AppError{
+			Kind:    insight.KindDelivery,
+			Message: "ライブランキングの投稿に失敗",
+			Err:     err,
+		}
+	}
+	if err := dg.ChannelMessagePin(channelID, msg.ID, discordgo.WithContext(ctx)); err != nil {
+		// ピン留めできなくても編集は続けられる
+		slog.Warn("ライブランキングのピン留めに失敗", "step", "live", "channel_id", channelID, "message_id", msg.ID, "error", err)
+	}
+	return msg, nil
+}
+
+// ランキングのメッセージの最大文字数。ライブランキングは最終更新日時を付けるため、その分を空けておく
+func messageLimit(guild insight.GuildConfig, locale Locale) int {
+	if !guild.LiveLeaderboard {
+		return maxMessageLength
+	}
+	return maxMessageLength - messageLength(liveUpdatedSuffix(locale, time.Now()))
+}
+
+// ライブランキングの末尾に付ける最終更新日時
+func liveUpdatedSuffix(locale Locale, now time.Time) string {
+	return fmt.Sprintf(locale.LastUpdated, now.UTC().Format(liveUpdatedLayout))
+}
+
+// 週間の最終ランキングをスレッドを作成して投稿する
+func postRankingThread(ctx context.Context, dg *discordgo.Session, locale Locale, channelID, message string) (*discordgo.Message, error) {
+	now := time.Now().UTC()
+	sevenDaysAgo := now.AddDate(0, 0, -7)
+	name := fmt.Sprintf(locale.ThreadName, sevenDaysAgo.Format("2006/01/02"), now.Format("2006/01/02"))
+
+	// アーカイブまでの時間は1週間（分）
+	var thread *discordgo.Channel
+	err := insight.Retry(ctx, "ThreadStart", func() error {
+		var err error
+		thread, err = dg.ThreadStart(channelID, name, discordgo.ChannelTypeGuildPublicThread, 10080, discordgo.WithContext(ctx))
+		return err
+	})
+	if err != nil {
+		return nil, &insight.AppError{
+			Kind:    insight.KindDelivery,
+			Message: "ランキングのスレッド作成に失敗",
+			Err:     err,
+		}
+	}
+	return sendDiscordMessage(ctx, dg, thread.ID, message)
+}
+
+// 実行履歴から、チャンネルに最後に投稿・編集したライブランキングのメッセージIDを探す。ない場合は空
+func getLiveMessageID(ctx context.Context, channelID string) (string, error) {
+	runs, err := insight.ListRuns(ctx, insight.DB, "", liveRunLookback)
+	if err != nil {
+		return "", err
+	}
+	if live := insight.LatestMessage(runs, "live", channelID); live != nil {
+		return live.MessageID, nil
+	}
+	return "", nil
+}
+
+type LanguageTime struct {
+	Name string
+	Time time.Duration
+}
+
+func sortLanguagesByTime(languages map[string]time.Duration) []LanguageTime {
+	var langTimes []LanguageTime
+	for name, time := range languages {
+		langTimes = append(langTimes, LanguageTime{Name: name, Time: time})
+	}
+	sort.Slice(langTimes, func(i, j int) bool {
+		return langTimes[i].Time > langTimes[j].Time
+	})
+	return langTimes
+}
+
+func sendDiscordMessage(ctx context.Context, dg *discordgo.Session, channelID, message string) (*discordgo.Message, error) {
+	var msg *discordgo.Message
+	err := insight.Retry(ctx, "ChannelMessageSend", func() error {
+		var err error
+		msg, err = dg.ChannelMessageSend(channelID, message, discordgo.WithContext(ctx))
+		return err
+	})
+	if err != nil {
+		return nil, &insight.AppError{
+			Kind:    insight.KindDelivery,
+			Message: "メッセージの送信に失敗",
+			Err:     err,
+		}
+	}
+	return msg, nil
+}
+
+// モデレーターへの通知。不自然な作業記録がない場合は空
+func formatModeratorAlert(locale Locale, data []insight.DiscordWorkTime) string {
+	config := insight.GetAntiCheatConfig()
+	action := locale.ActionMark
+	if config.Action == insight.AntiCheatCap {
+		action = locale.ActionCap
+	}
+
+	var lines []string
+	for _, entry := range data {
+		for _, anomaly := range entry.Anomalies {
+			start := anomaly.Start.UTC().Format("2006/01/02 15:04")
+			var detail string
+			switch anomaly.Kind {
+			case insight.AnomalyLongSession:
+				detail = fmt.Sprintf(locale.AnomalyLongSession, formatDuration(locale, anomaly.Duration), start)
+			case insight.AnomalyPeriodic:
+				detail = fmt.Sprintf(locale.AnomalyPeriodic, anomaly.Count, start)
+			case insight.AnomalyMultiMachine:
+				detail = fmt.Sprintf(locale.AnomalyMultiMachine, formatDuration(locale, anomaly.Duration), start)
+			}
+			lines = append(lines, fmt.Sprintf("- <@%s>: %s", entry.DiscordID, detail))
+		}
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+
+	return truncateMessage(fmt.Sprintf(locale.ModeratorAlert, action)+strings.Join(lines, "\n"), maxMessageLength)
+}
+
+// 不自然な作業記録を検出したメンバーをモデレーターに通知する（メンションで本人に通知しない）
+func notifyModerators(ctx context.Context, dg *discordgo.Session, channelID, message string) (*discordgo.Message, error) {
+	var msg *discordgo.Message
+	err := insight.Retry(ctx, "ChannelMessageSendComplex", func() error {
+		var err error
+		msg, err = dg.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+			Content:         message,
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+		}, discordgo.WithContext(ctx))
+		return err
+	})
+	if err != nil {
+		return nil, &insight.AppError{
+			Kind:    insight.KindDelivery,
+			Message: "モデレーターへの通知に失敗",
+			Err:     err,
+		}
+	}
+	slog.Info("モデレーターに不自然な作業記録を通知しました", "step", "moderator", "channel_id", channelID)
+	return msg, nil
+}
+
+// 週間の集計を DM で受け取る設定のユーザーに、本人の集計を送る
+// 投稿しない場合は Output に書き出す。1人への送信の失敗で他のユーザーへの送信を止めない
+func SendSummaries(ctx context.Context, data []insight.DiscordWorkTime, options Options) error {
+	started := time.Now()
+	var recipients []insight.DiscordWorkTime
+	for _, entry := range data {
+		if entry.Settings != nil && entry.Settings.WeeklySummaryDM {
+			recipients = append(recipients, entry)
+		}
+	}
+	if len(recipients) == 0 {
+		slog.Info("DM を受け取るユーザーがいません", "step", "dm")
+		return nil
+	}
+
+	locale := getLocale(os.Getenv("REPORT_LOCALE"))
+	startDate := insight.PeriodStart(time.Now())
+	if !options.Post {
+		for _, entry := range recipients {
+			fmt.Fprintf(options.Output, "===== dm: %s =====\n%s", entry.DiscordID, formatSummary(locale, startDate, entry))
+		}
+		return nil
+	}
+
+	discordToken := os.Getenv("DISCORD_TOKEN")
+	if discordToken == "" {
+		return &insight.AppError{
+			Kind:    insight.KindConfig,
+			Message: "DISCORD_TOKEN が設定されていません",
+		}
+	}
+	dg, err := discordgo.New("Bot " + discordToken)
+	if err != nil {
+		return &insight.AppError{
+			Kind:    insight.KindDelivery,
+			Message: "Discordセッションの作成に失敗",
+			Err:     err,
+		}
+	}
+
+	var failed []string
+	for _, entry := range recipients {
+		var msg *discordgo.Message
+		err := insight.Retry(ctx, "DM", func() error {
+			channel, err := dg.UserChannelCreate(entry.DiscordID, discordgo.WithContext(ctx))
+			if err != nil {
+				return err
+			}
+			msg, err = dg.ChannelMessageSend(channel.ID, formatSummary(locale, startDate, entry), discordgo.WithContext(ctx))
+			return err
+		})
+		recordMessage(options.Summary, "dm", msg)
+		if err != nil {
+			// DM を受け付けない設定のユーザーもいるため、失敗として記録して続ける
+			slog.Error("DM の送信に失敗", "step", "dm", "discord_id", entry.DiscordID, "error", err)
+			options.Summary.Record("dm", entry.DiscordID, &insight.AppError{Kind: insight.KindDelivery, Message: "DM の送信に失敗", Err: err})
+			failed = append(failed, entry.DiscordID)
+		}
+	}
+	slog.Info("DM を送信しました", "step", "dm", "sent", len(recipients)-len(failed), "recipients", len(recipients), "duration", time.Since(started))
+	if len(failed) > 0 {
+		return &insight.AppError{
+			Kind:    insight.KindDelivery,
+			Message: fmt.Sprintf("%d/%d人への DM の送信に失敗: %v", len(failed), len(recipients), failed),
+		}
+	}
+	return nil
+}
+
+// 本人向けの集計。上位3言語・上位3プロジェクトを表示する
+// ランキングに含めないプロジェクト・非公開のプロジェクトも本人には名前を表示する
+func formatSummary(locale Locale, startDate time.Time, entry insight.DiscordWorkTime) string {
+	message := fmt.Sprintf(locale.Summary, startDate.Format("2006/01/02"), formatDuration(locale, entry.PersonalTotalTime))
+	languages := sortLanguagesByTime(entry.PersonalLanguages)
+	if len(languages) > 3 {
+		languages = languages[:3]
+	}
+	for _, language := range languages {
+		message += fmt.Sprintf("  - %s: %s\n", language.Name, formatDuration(locale, language.Time))
+	}
+	projects := sortLanguagesByTime(entry.PersonalProjects)
+	if len(projects) > 3 {
+		projects = projects[:3]
+	}
+	for i, project := range projects {
+		name := project.Name
+		if i == 0 {
+			message += "  📁 "
+		} else {
+			message += ", "
+		}
+		message += fmt.Sprintf("%s (%s)", name, formatDuration(locale, project.Time))
+	}
+	if len(projects) > 0 {
+		message += "\n"
+	}
+	return message
+}
+
+// フッターに表示するルールの説明
+func describeRules(r insight.FairnessRules, locale Locale) []string {
+	var rules []string
+	if r.MaxDaily > 0 {
+		rules = append(rules, fmt.Sprintf(locale.RuleMaxDaily, formatDuration(locale, r.MaxDaily)))
+	}
+	if r.MaxSession > 0 {
+		rules = append(rules, fmt.Sprintf(locale.RuleMaxSession, formatDuration(locale, r.MaxSession)))
+	}
+	if r.QuietHours {
+		rules = append(rules, fmt.Sprintf(locale.RuleQuietHours, insight.FormatClock(r.QuietStart), insight.FormatClock(r.QuietEnd), r.Location))
+	}
+	return rules
+}
@@ -0,0 +1,185 @@
+package ranking
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kkaiki/DevInsight/internal/insight"
+)
+
+func testDiscordID(i int) string {
+	return fmt.Sprintf("1000000000000%05d", i)
+}
+
+// 作業時間の多い順に並んだユーザー
+func workTimes(times ...time.Duration) []insight.DiscordWorkTime {
+	var data []insight.DiscordWorkTime
+	for i, total := range times {
+		data = append(data, insight.DiscordWorkTime{
+			DiscordID: testDiscordID(i),
+			TotalTime: total,
+			Languages: map[string]time.Duration{"go": total / 2, "typescript": total / 4, "python": total / 4},
+			Projects:  map[string]time.Duration{"devinsight": total / 2, "website": total / 2},
+		})
+	}
+	return data
+}
+
+func repeat(total time.Duration, n int) []time.Duration {
+	times := make([]time.Duration, n)
+	for i := range times {
+		times[i] = total - time.Duration(i)*time.Minute
+	}
+	return times
+}
+
+func TestFormatMessageRanks(t *testing.T) {
+	tests := []struct {
+		name     string
+		times    []time.Duration
+		prefixes []string
+	}{
+		{
+			name:     "distinct times",
+			times:    []time.Duration{3 * time.Hour, 2 * time.Hour, 90 * time.Minute, 70 * time.Minute},
+			prefixes: []string{"# 🥇 ", "## 🥈 ", "### 🥉 ", ""},
+		},
+		{
+			name:     "tie for first",
+			times:    []time.Duration{3 * time.Hour, 3 * time.Hour, 2 * time.Hour},
+			prefixes: []string{"# 🥇 ", "# 🥇 ", "### 🥉 "},
+		},
+		{
+			name:     "same displayed minute",
+			times:    []time.Duration{2*time.Hour + 50*time.Second, 2*time.Hour + 10*time.Second, time.Hour},
+			prefixes: []string{"# 🥇 ", "# 🥇 ", "### 🥉 "},
+		},
+		{
+			name:     "one minute apart",
+			times:    []time.Duration{2*time.Hour + time.Minute, 2*time.Hour + 59*time.Second},
+			prefixes: []string{"# 🥇 ", "## 🥈 "},
+		},
+		{
+			name:     "tie for third",
+			times:    []time.Duration{3 * time.Hour, 2 * time.Hour, time.Hour, time.Hour, 59 * time.Minute},
+			prefixes: []string{"# 🥇 ", "## 🥈 ", "### 🥉 ", "### 🥉 "},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := formatMessage(nil, insight.GuildConfig{}, workTimes(tt.times...), nil, maxMessageLength)
+			lines := strings.Split(message, "\n")
+			for i, prefix := range tt.prefixes {
+				want := prefix + "<@" + testDiscordID(i) + ">"
+				found := false
+				for _, line := range lines {
+					if strings.HasPrefix(line, want+" ") {
+						found = true
+						break
+					}
+				}
+				if !found {
+					t.Errorf("no line starting with %q in\n%s", want, message)
+				}
+			}
+		})
+	}
+}
+
+func TestFormatMessageLength(t *testing.T) {
+	report := &MemberReport{Departed: []string{testDiscordID(9999)}, Malformed: []string{"someone"}, Skipped: 2}
+
+	tests := []struct {
+		name        string
+		data        []insight.DiscordWorkTime
+		limit       int
+		moreEntries string // 空の場合は含まないこと
+		moreOthers  string
+	}{
+		{
+			name:  "fits",
+			data:  workTimes(3*time.Hour, 2*time.Hour, 30*time.Minute),
+			limit: maxMessageLength,
+		},
+		{
+			name:       "others over the cap",
+			data:       workTimes(append([]time.Duration{3 * time.Hour}, repeat(50*time.Minute, 30)...)...),
+			limit:      maxMessageLength,
+			moreOthers: "ほか10人",
+		},
+		{
+			name:        "long ranking drops trailing entries and all others",
+			data:        workTimes(append(repeat(40*time.Hour, 60), repeat(50*time.Minute, 5)...)...),
+			limit:       maxMessageLength,
+			moreEntries: "ほか",
+			moreOthers:  "ほか5人",
+		},
+		{
+			name:        "reserved room",
+			data:        workTimes(repeat(40*time.Hour, 10)...),
+			limit:       800,
+			moreEntries: "ほか",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := formatMessage(nil, insight.GuildConfig{}, tt.data, report, tt.limit)
+			if n := messageLength(message); n > tt.limit {
+				t.Fatalf("message length = %d, want at most %d", n, tt.limit)
+			}
+			// ヘッダーとフッターは常にすべて表示する
+			for _, want := range []string{"作業時間ランキング", "2人 を除いた途中経過", "1人 を除外しました", "`someone`", "ダウンロード](" + downloadURL + ")"} {
+				if !strings.Contains(message, want) {
+					t.Errorf("message does not contain %q:\n%s", want, message)
+				}
+			}
+			if tt.moreEntries == "" && strings.Contains(message, "\nほか") {
+				t.Errorf("unexpected remaining entries:\n%s", message)
+			}
+			if tt.moreEntries != "" && !strings.Contains(message, "\n"+tt.moreEntries) {
+				t.Errorf("message does not contain %q:\n%s", tt.moreEntries, message)
+			}
+			if tt.moreOthers == "" && strings.Contains(message, " ほか") {
+				t.Errorf("unexpected remaining others:\n%s", message)
+			}
+			if tt.moreOthers != "" && !strings.Contains(message, tt.moreOthers) {
+				t.Errorf("message does not contain %q:\n%s", tt.moreOthers, message)
+			}
+		})
+	}
+}
+
+func TestTruncateMessage(t *testing.T) {
+	tests := []struct {
+		message string
+		limit   int
+		want    string
+	}{
+		{"abc\ndef", 10, "abc\ndef"},
+		{"abc\ndef", 5, "abc"},
+		{"作業時間\nランキング", 7, "作業時間"},
+		{"abcdef", 3, "abc"},
+	}
+	for _, tt := range tests {
+		if got := truncateMessage(tt.message, tt.limit); got != tt.want {
+			t.Errorf("truncateMessage(%q, %d) = %q, want %q", tt.message, tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestLiveLeaderboardFitsWithLastUpdated(t *testing.T) {
+	data := workTimes(repeat(40*time.Hour, 60)...)
+	for _, name := range []string{"ja", "en"} {
+		guild := insight.GuildConfig{Locale: name, LiveLeaderboard: true}
+		locale := getLocale(name)
+		message := formatMessage(nil, guild, data, nil, messageLimit(guild, locale))
+		content := message + liveUpdatedSuffix(locale, time.Now())
+		if n := messageLength(content); n > maxMessageLength {
+			t.Errorf("%s: live leaderboard length = %d, want at most %d", name, n, maxMessageLength)
+		}
+	}
+}
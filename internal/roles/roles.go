@@ -0,0 +1,353 @@
+package roles
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "log/slog"
+    "os"
+    "time"
+
+    "github.com/bwmarrin/discordgo"
+
+    "github.com/kkaiki/DevInsight/internal/insight"
+)
+
+// Run options, changed by devinsight roles
+type Options struct {
+    Apply   bool                // When false, print the planned roles to Output instead of changing them
+    GuildID string              // Only run for this guild when set
+    Output  io.Writer           // Where the plan is printed when not applying
+    Summary *insight.RunSummary // Where failed users and guilds are recorded, created by Run when nil
+}
+
+func Run(ctx context.Context, options Options) (err error) {
+    started := time.Now()
+    if options.Summary == nil {
+        options.Summary = &insight.RunSummary{}
+        defer options.Summary.Log()
+    }
+    var aggregation *insight.Aggregation
+    if options.Apply {
+        // Only applied runs are kept in the run history
+        defer func() {
+            insight.SaveRun(ctx, insight.DB, insight.NewRunRecord(ctx, "roles", "", started, aggregation, options.Summary, err))
+        }()
+    }
+    aggregateCtx, cancel := insight.AggregateContext(ctx)
+    defer cancel()
+    aggregation, err = insight.Aggregate(aggregateCtx, insight.DB, insight.PeriodStart(time.Now()))
+    if err != nil {
+        return fmt.Errorf("failed to aggregate work time: %w", err)
+    }
+    options.Summary.RecordAggregation(aggregation)
+    // Reassigning from a partial aggregation would strip the roles of every skipped user
+    if aggregation.Partial() {
+        return &insight.AppError{
+            Kind:    insight.KindData,
+            Message: fmt.Sprintf("aggregation stopped before the deadline with %d users left, keeping the current roles", len(aggregation.Skipped)),
+        }
+    }
+    // Likewise, the roles of users whose aggregation failed would be removed by the reconcile
+    if len(aggregation.Failures) > 0 {
+        return &insight.AppError{
+            Kind:    insight.KindData,
+            Message: fmt.Sprintf("failed to aggregate %d users, keeping the current roles", len(aggregation.Failures)),
+        }
+    }
+    if len(aggregation.Data) == 0 {
+        return nil
+    }
+    return Assign(ctx, aggregation.Data, options)
+}
+
+// Prefix to identify roles created by the bot
+const rolePrefix = ""
+const roleSuffix = "勉強中🔥"
+
+// Default minimum time in a language before its role is assigned
+const defaultRoleThreshold = 60 * time.Minute
+
+// List of languages to exclude from role assignment
+var excludedLanguages = []string{"json", "markdown"} // Replace with actual languages to exclude
+
+// Load registered guilds, falling back to DISCORD_GUILD_ID when the registry is empty
+func loadGuildRegistry(ctx context.Context) ([]insight.GuildConfig, error) {
+    guilds, err := insight.ScanGuildRegistry(ctx, insight.DB)
+    if err != nil {
+        return nil, err
+    }
+    if len(guilds) > 0 {
+        return guilds, nil
+    }
+
+    guildID := os.Getenv("DISCORD_GUILD_ID")
+    if guildID == "" {
+        return nil, &insight.AppError{Kind: insight.KindConfig, Message: "no guilds registered and DISCORD_GUILD_ID environment variable is not set"}
+    }
+    return []insight.GuildConfig{{GuildID: guildID, RolesEnabled: true}}, nil
+}
+
+// Reconcile language roles from already aggregated work time, so a combined job
+// can share one aggregation with the ranking
+func Assign(ctx context.Context, sortedData []insight.DiscordWorkTime, options Options) error {
+    discordToken := os.Getenv("DISCORD_TOKEN")
+    if discordToken == "" && options.Apply {
+        return &insight.AppError{Kind: insight.KindConfig, Message: "DISCORD_TOKEN environment variable is not set"}
+    }
+
+    guilds, err := loadGuildRegistry(ctx)
+    if err != nil {
+        return err
+    }
+    if options.GuildID != "" {
+        guilds = insight.SelectGuild(guilds, options.GuildID)
+        if len(guilds) == 0 {
+            return &insight.AppError{Kind: insight.KindConfig, Message: fmt.Sprintf("guild %s is not registered", options.GuildID)}
+        }
+    }
+
+    // Without a token the plan is printed without checking guild membership
+    var dg *discordgo.Session
+    if discordToken != "" {
+        dg, err = discordgo.New("Bot " + discordToken)
+        if err != nil {
+            return &insight.AppError{Kind: insight.KindDelivery, Message: "error creating Discord session", Err: err}
+        }
+        defer dg.Close()
+    } else {
+        slog.Warn("DISCORD_TOKEN is not set, skipping guild membership checks")
+    }
+
+    if options.Apply {
+        err = dg.Open()
+        if err != nil {
+            return &insight.AppError{Kind: insight.KindDelivery, Message: "error opening connection", Err: err}
+        }
+    }
+
+    // A failure in one guild should not stop the others
+    var failedGuilds []string
+    for _, guild := range guilds {
+        if !guild.RolesEnabled {
+            slog.Info("Roles disabled for guild, skipping", "guild_id", guild.GuildID)
+            continue
+        }
+        if !options.Apply {
+            printGuildRoles(ctx, options.Output, dg, guild, sortedData, options.Summary)
+            continue
+        }
+        if err := assignGuildRoles(ctx, dg, guild, sortedData, options.Summary); err != nil {
+            slog.Error("Failed to assign roles in guild", "step", "roles", "guild_id", guild.GuildID, "error", err)
+            options.Summary.Record("roles", guild.GuildID, err)
+            failedGuilds = append(failedGuilds, guild.GuildID)
+        }
+    }
+    if len(failedGuilds) > 0 {
+        return &insight.AppError{
+            Kind:    insight.KindDelivery,
+            Message: fmt.Sprintf("failed to assign roles in %d of %d guilds: %v", len(failedGuilds), len(guilds), failedGuilds),
+        }
+    }
+
+    return nil
+}
+
+// Resolve the role settings of a guild, falling back to the defaults
+func guildRoleSettings(guild insight.GuildConfig) (string, time.Duration, []string) {
+    suffix := guild.RoleSuffix
+    if suffix == "" {
+        suffix = roleSuffix
+    }
+    threshold := defaultRoleThreshold
+    if guild.RoleThresholdMinutes > 0 {
+        threshold = time.Duration(guild.RoleThresholdMinutes) * time.Minute
+    }
+    excluded := excludedLanguages
+    if guild.ExcludedLanguages != nil {
+        excluded = guild.ExcludedLanguages
+    }
+    return suffix, threshold, excluded
+}
+
+// Print the roles a run would assign in a guild without changing anything
+func printGuildRoles(ctx context.Context, w io.Writer, dg *discordgo.Session, guild insight.GuildConfig, sortedData []insight.DiscordWorkTime, summary *insight.RunSummary) {
+    suffix, threshold, excluded := guildRoleSettings(guild)
+    fmt.Fprintf(w, "===== guild: %s =====\n", guild.GuildID)
+    for _, entry := range filterGuildMembers(ctx, dg, guild.GuildID, sortedData, summary) {
+        for language, duration := range entry.Languages {
+            if isExcludedLanguage(excluded, language) || duration <= threshold {
+                continue
+            }
+            fmt.Fprintf(w, "%s\t%s\t%v\n", entry.DiscordID, rolePrefix+language+suffix, duration.Truncate(time.Minute))
+        }
+    }
+}
+
+// Assign language roles to the members of a single guild using its settings.
+// The number of changed roles and the users whose roles could not be changed are recorded in summary
+func assignGuildRoles(ctx context.Context, dg *discordgo.Session, guild insight.GuildConfig, sortedData []insight.DiscordWorkTime, summary *insight.RunSummary) error {
+    guildID := guild.GuildID
+    if guildID == "" {
+        return &insight.AppError{Kind: insight.KindConfig, Message: "guild registry entry has no guild_id"}
+    }
+    suffix, threshold, excluded := guildRoleSettings(guild)
+
+    // Delete existing roles created by the bot
+    deleted, err := deleteBotCreatedRoles(ctx, dg, guildID, suffix)
+    if err != nil {
+        slog.Error("Failed to delete existing roles", "step", "roles", "guild_id", guildID, "error", err)
+        summary.Record("roles", guildID, err)
+    }
+
+    assigned := 0
+
+    for _, entry := range filterGuildMembers(ctx, dg, guildID, sortedData, summary) {
+        for language, duration := range entry.Languages {
+            if isExcludedLanguage(excluded, language) {
+                continue
+            }
+            if duration > threshold {
+                roleID, err := ensureRoleExists(ctx, dg, guildID, language, suffix)
+                if err != nil {
+                    slog.Error("Failed to ensure role exists", "step", "roles", "guild_id", guildID, "discord_id", entry.DiscordID, "language", language, "error", err)
+                    summary.Record("roles", entry.DiscordID, err)
+                    continue
+                }
+                err = insight.Retry(ctx, "GuildMemberRoleAdd", func() error {
+                    return dg.GuildMemberRoleAdd(guildID, entry.DiscordID, roleID, discordgo.WithContext(ctx))
+                })
+                if err != nil {
+                    slog.Error("Failed to assign role", "step", "roles", "guild_id", guildID, "discord_id", entry.DiscordID, "role_id", roleID, "error", err)
+                    summary.Record("roles", entry.DiscordID, &insight.AppError{Kind: insight.KindDelivery, Message: "failed to assign role " + roleID, Err: err})
+                    continue
+                }
+                assigned++
+            }
+        }
+    }
+
+    summary.RecordRoles(guildID, assigned, deleted)
+    return nil
+}
+
+// Keep only entries whose Discord ID is well-formed and belongs to a guild member
+func filterGuildMembers(ctx context.Context, dg *discordgo.Session, guildID string, sortedData []insight.DiscordWorkTime, summary *insight.RunSummary) []insight.DiscordWorkTime {
+    var members []insight.DiscordWorkTime
+    var departed, malformed []string
+    for _, entry := range sortedData {
+        if !insight.IsValidDiscordID(entry.DiscordID) {
+            malformed = append(malformed, entry.DiscordID)
+            continue
+        }
+        if dg == nil {
+            members = append(members, entry)
+            continue
+        }
+        err := insight.Retry(ctx, "GuildMember", func() error {
+            _, err := dg.GuildMember(guildID, entry.DiscordID, discordgo.WithContext(ctx))
+            return err
+        })
+        if err != nil {
+            if insight.IsUnknownMemberError(err) {
+                departed = append(departed, entry.DiscordID)
+                continue
+            }
+            // Transient failures should not drop the user; the role add reports its own error
+            slog.Error("Failed to get guild member", "step", "members", "guild_id", guildID, "discord_id", entry.DiscordID, "error", err)
+            summary.Record("members", entry.DiscordID, &insight.AppError{Kind: insight.KindDelivery, Message: "failed to get guild member", Err: err})
+        }
+        members = append(members, entry)
+    }
+
+    if len(departed) > 0 {
+        slog.Warn("Skipped users not in guild", "step", "members", "guild_id", guildID, "discord_ids", departed)
+    }
+    if len(malformed) > 0 {
+        slog.Warn("Skipped malformed Discord IDs", "step", "members", "guild_id", guildID, "discord_ids", malformed)
+    }
+    return members
+}
+
+// Helper function to check if a language is excluded
+func isExcludedLanguage(excluded []string, language string) bool {
+    for _, excludedLanguage := range excluded {
+        if language == excludedLanguage {
+            return true
+        }
+    }
+    return false
+}
+
+// Ensure the role exists, creating it if necessary
+func ensureRoleExists(ctx context.Context, dg *discordgo.Session, guildID, language, suffix string) (string, error) {
+    roles, err := getGuildRoles(ctx, dg, guildID)
+    if err != nil {
+        return "", err
+    }
+
+    roleName := rolePrefix + language + suffix
+    for _, role := range roles {
+        if role.Name == roleName {
+            return role.ID, nil
+        }
+    }
+
+    blueColor := 0x0000FF
+
+    roleParams := &discordgo.RoleParams{
+        Name:  roleName,
+        Color: &blueColor,
+    }
+
+    var role *discordgo.Role
+    err = insight.Retry(ctx, "GuildRoleCreate", func() error {
+        var err error
+        role, err = dg.GuildRoleCreate(guildID, roleParams, discordgo.WithContext(ctx))
+        return err
+    })
+    if err != nil {
+        return "", &insight.AppError{Kind: insight.KindDelivery, Message: "failed to create role " + roleName, Err: err}
+    }
+
+    return role.ID, nil
+}
+
+// Delete roles created by the bot and return how many were deleted
+func deleteBotCreatedRoles(ctx context.Context, dg *discordgo.Session, guildID, suffix string) (int, error) {
+    roles, err := getGuildRoles(ctx, dg, guildID)
+    if err != nil {
+        return 0, err
+    }
+
+    deleted := 0
+
+    for _, role := range roles {
+        if len(role.Name) > len(rolePrefix)+len(suffix) && role.Name[:len(rolePrefix)] == rolePrefix && role.Name[len(role.Name)-len(suffix):] == suffix {
+            err = insight.Retry(ctx, "GuildRoleDelete", func() error {
+                return dg.GuildRoleDelete(guildID, role.ID, discordgo.WithContext(ctx))
+            })
+            if err != nil {
+                slog.Error("Failed to delete role", "step", "roles", "guild_id", guildID, "role_id", role.ID, "error", err)
+                continue
+            }
+            deleted++
+        }
+    }
+
+    return deleted, nil
+}
+
+// Fetch the roles of a guild, retrying transient Discord errors
+func getGuildRoles(ctx context.Context, dg *discordgo.Session, guildID string) ([]*discordgo.Role, error) {
+    var roles []*discordgo.Role
+    err := insight.Retry(ctx, "GuildRoles", func() error {
+        var err error
+        roles, err = dg.GuildRoles(guildID, discordgo.WithContext(ctx))
+        return err
+    })
+    if err != nil {
+        return nil, &insight.AppError{Kind: insight.KindDelivery, Message: "failed to get roles", Err: err}
+    }
+    return roles, nil
+}
\ No newline at end of file
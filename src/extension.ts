@@ -19,7 +19,7 @@ var logger = new Logger(LogLevel.INFO);
 var wakatime: WakaTime;
 
 export function activate(ctx: vscode.ExtensionContext) {
-  wakatime = new WakaTime(ctx.extensionPath, logger);
+  wakatime = new WakaTime(ctx.extensionPath, logger, ctx.secrets);
 
   // ctx.globalState?.setKeysForSync(['wakatime.apiKey']);
 // 
@@ -33,6 +33,11 @@ export function activate(ctx: vscode.ExtensionContext) {
       wakatime.promptForDiscordId();
     }),
   );
+  ctx.subscriptions.push(
+    vscode.commands.registerCommand('devinsights.apitoken', function () {
+      wakatime.promptForApiToken();
+    }),
+  );
 
   // ctx.subscriptions.push(
   //   vscode.commands.registerCommand(COMMAND_PROXY, function () {
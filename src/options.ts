@@ -13,15 +13,20 @@ export interface Setting {
   error?: string;
 }
 
+// SecretStorage に API トークンを保存するキー
+const API_TOKEN_SECRET_KEY = 'devinsights.apiToken';
+
 export class Options {
   private configFile: string;
   private internalConfigFile: string;
   private logFile: string;
   private logger: Logger;
+  private secrets: vscode.SecretStorage;
   private cache: any = {};
 
-  constructor(logger: Logger, resourcesFolder: string) {
+  constructor(logger: Logger, resourcesFolder: string, secrets: vscode.SecretStorage) {
     this.logger = logger;
+    this.secrets = secrets;
     this.configFile = path.join(Desktop.getHomeDirectory(), '.wakatime.cfg');
     this.internalConfigFile = path.join(resourcesFolder, 'wakatime-internal.cfg');
     this.logFile = path.join(resourcesFolder, 'wakatime.log');
@@ -247,6 +252,31 @@ export class Options {
     }
   }
 
+  // 設定ファイルに平文で残さないよう、SecretStorage（OS のキーチェーン）に保存
+  public async setApiTokenAsync(apiToken: string): Promise<void> {
+    await this.secrets.store(API_TOKEN_SECRET_KEY, apiToken);
+    this.cache.apiToken = apiToken;
+  }
+
+  // dev_time_api で発行した API トークン（dev_time_api -issue-token）
+  public async getApiTokenAsync(): Promise<string> {
+    if (this.cache.apiToken) {
+      return this.cache.apiToken;
+    }
+    const apiToken = await this.secrets.get(API_TOKEN_SECRET_KEY);
+    if (apiToken) {
+      this.cache.apiToken = apiToken;
+      return apiToken;
+    }
+    return '';
+  }
+
+  // dev_time_api の URL（例: https://<関数URL>）。WakaTime と同じ .../api/v1 の形式も受け付ける
+  public getIngestUrl(): string {
+    const apiUrl = vscode.workspace.getConfiguration().get<string>('settings.apiUrl') || '';
+    return apiUrl.trim().replace(/\/+$/, '').replace(/\/api\/v1$/, '');
+  }
+
   public async getDiscordIdAsync(): Promise<string> {
       // キャッシュをチェック
       if (this.cache.discordId) {